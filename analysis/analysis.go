@@ -0,0 +1,126 @@
+package analysis
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/models"
+)
+
+// checkTimeout bounds how long the checks of one submission may take
+const checkTimeout = 10 * time.Second
+
+//go:embed analyze.py
+var analyzeSource string
+
+// Diagnostic is a problem found in submitted code. Cell is set for notebook
+// cells and Step for pipeline steps.
+type Diagnostic struct {
+	Cell    *int   `json:"cell,omitempty"`
+	Step    string `json:"step,omitempty"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Rule    string `json:"rule"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// Source is one piece of code to check
+type Source struct {
+	Cell *int
+	Step string
+	Code string
+}
+
+// Analyzer parses submitted code with a Python interpreter, without running
+// it, and checks it against the denylist
+type Analyzer struct {
+	Python string
+}
+
+// NewAnalyzer creates an analyzer from the CodeAnalysis settings. It returns
+// nil when code analysis is disabled.
+func NewAnalyzer(cfg *config.Config) *Analyzer {
+	if !cfg.CodeAnalysis {
+		return nil
+	}
+	return &Analyzer{Python: cfg.CodeAnalysisPython}
+}
+
+// Check returns the diagnostics for the given sources; none means the code
+// may be queued. Notebook sources have IPython magics and shell commands
+// skipped like the harness does.
+func (a *Analyzer) Check(sources []Source, notebook bool, denylist []string) ([]Diagnostic, error) {
+	code := make([]string, len(sources))
+	for i, source := range sources {
+		code[i] = source.Code
+	}
+	request, err := json.Marshal(map[string]interface{}{
+		"sources":  code,
+		"notebook": notebook,
+		"denylist": denylist,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.Python, "-I", "-c", analyzeSource)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("code analysis timed out after %s", checkTimeout)
+		}
+		return nil, fmt.Errorf("code analysis failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response struct {
+		Diagnostics []struct {
+			Diagnostic
+			Source int `json:"source"`
+		} `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("invalid code analysis output: %w", err)
+	}
+
+	diagnostics := make([]Diagnostic, 0, len(response.Diagnostics))
+	for _, d := range response.Diagnostics {
+		if d.Source < 0 || d.Source >= len(sources) {
+			return nil, fmt.Errorf("code analysis reported unknown source %d", d.Source)
+		}
+		d.Diagnostic.Cell = sources[d.Source].Cell
+		d.Diagnostic.Step = sources[d.Source].Step
+		diagnostics = append(diagnostics, d.Diagnostic)
+	}
+	return diagnostics, nil
+}
+
+// Denylist returns the names submitted code may not import or use: the
+// admin-set code policy, or defaults when no policy has been set
+func Denylist(database *gorm.DB, defaults []string) ([]string, error) {
+	var policy models.CodePolicy
+	err := database.Where("id = ?", models.CodePolicyID).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy.Denylist, nil
+}
@@ -0,0 +1,172 @@
+"""Static checks on submitted code, run before it is queued.
+
+Reads {"sources": [...], "notebook": bool, "denylist": [...]} as JSON on
+stdin and writes {"diagnostics": [...]} to stdout. The code is parsed, never
+run. Each diagnostic has the index of its source, the line and column, the
+rule ("syntax" or "denylist"), the denylist entry matched and a message.
+
+Denylist entries are module names (subprocess) or dotted names (os.system).
+An entry matches imports of the name or of anything below it, and uses of it
+through imported names, builtins, getattr() with a constant attribute, and
+__import__() or importlib.import_module() with a constant module name. The
+checks are defense in depth; the sandbox is what contains code.
+"""
+import ast
+import builtins
+import json
+import sys
+
+MAX_DIAGNOSTICS = 100
+
+
+def cell_source(source):
+    """Replace IPython magics and shell commands with pass, as the harness
+    does when it runs a notebook."""
+    lines = []
+    for line in source.splitlines():
+        stripped = line.lstrip()
+        if stripped.startswith(("%", "!")):
+            line = line[:len(line) - len(stripped)] + "pass"
+        lines.append(line)
+    return "\n".join(lines)
+
+
+class Checker(ast.NodeVisitor):
+    """Reports imports and uses of denylisted names."""
+
+    def __init__(self, denylist):
+        self.denylist = denylist
+        self.aliases = {}
+        self.found = []
+
+    def run(self, tree):
+        # Bind imported names first so uses before a nested import resolve too
+        for node in ast.walk(tree):
+            if isinstance(node, ast.Import):
+                for alias in node.names:
+                    if alias.asname:
+                        self.aliases[alias.asname] = alias.name
+                    else:
+                        root = alias.name.split(".")[0]
+                        self.aliases[root] = root
+            elif isinstance(node, ast.ImportFrom):
+                for alias in node.names:
+                    if alias.name != "*":
+                        self.aliases[alias.asname or alias.name] = joined(node.module, alias.name)
+        self.visit(tree)
+        return self.found
+
+    def match(self, name):
+        for entry in self.denylist:
+            if name == entry or name.startswith(entry + "."):
+                return entry
+        return None
+
+    def check(self, node, name, what):
+        entry = self.match(name)
+        if entry is not None:
+            message = "%s %s is not allowed" % (what, name)
+            self.found.append((node.lineno, node.col_offset + 1, entry, message))
+
+    def qualified(self, node):
+        """Return the dotted name of a name or attribute chain with imported
+        names resolved, or None when it does not start with an imported name
+        or a builtin."""
+        parts = []
+        while isinstance(node, ast.Attribute):
+            parts.append(node.attr)
+            node = node.value
+        if not isinstance(node, ast.Name):
+            return None
+        root = self.aliases.get(node.id)
+        if root is None:
+            if not hasattr(builtins, node.id):
+                return None
+            root = node.id
+        parts.append(root)
+        return ".".join(reversed(parts))
+
+    def visit_Import(self, node):
+        for alias in node.names:
+            self.check(node, alias.name, "import of")
+
+    def visit_ImportFrom(self, node):
+        for alias in node.names:
+            if alias.name == "*":
+                self.check(node, node.module or "", "import of")
+            else:
+                self.check(node, joined(node.module, alias.name), "import of")
+
+    def visit_Name(self, node):
+        name = self.qualified(node)
+        if name is not None:
+            self.check(node, name, "use of")
+
+    def visit_Attribute(self, node):
+        name = self.qualified(node)
+        if name is None:
+            self.generic_visit(node)
+            return
+        # The rest of the chain is part of the same name
+        self.check(node, name, "use of")
+
+    def visit_Call(self, node):
+        func = self.qualified(node.func)
+        arg = node.args[0] if node.args else None
+        if func in ("__import__", "importlib.import_module") and constant_str(arg):
+            self.check(node, arg.value, "import of")
+        elif func == "getattr" and len(node.args) >= 2 and constant_str(node.args[1]):
+            target = self.qualified(arg)
+            if target is not None:
+                self.check(node, target + "." + node.args[1].value, "use of")
+        self.generic_visit(node)
+
+
+def joined(module, name):
+    return module + "." + name if module else name
+
+
+def constant_str(node):
+    return isinstance(node, ast.Constant) and isinstance(node.value, str)
+
+
+def analyze(code, denylist):
+    """Return (line, column, rule, name, message) tuples for one source."""
+    try:
+        tree = ast.parse(code, "<code>")
+    except SyntaxError as e:
+        return [(e.lineno or 1, e.offset or 1, "syntax", "", e.msg)]
+    except (ValueError, RecursionError, MemoryError) as e:
+        return [(1, 1, "syntax", "", str(e) or type(e).__name__)]
+
+    try:
+        found = Checker(denylist).run(tree)
+    except RecursionError:
+        return [(1, 1, "syntax", "", "code is too deeply nested to check")]
+    return [(line, column, "denylist", entry, message)
+            for line, column, entry, message in sorted(set(found))]
+
+
+def main():
+    request = json.load(sys.stdin)
+    denylist = sorted(set(request.get("denylist") or []))
+
+    diagnostics = []
+    for index, code in enumerate(request.get("sources") or []):
+        if request.get("notebook"):
+            code = cell_source(code)
+        for line, column, rule, name, message in analyze(code, denylist):
+            diagnostics.append({
+                "source": index,
+                "line": line,
+                "column": column,
+                "rule": rule,
+                "name": name,
+                "message": message,
+            })
+
+    json.dump({"diagnostics": diagnostics[:MAX_DIAGNOSTICS]}, sys.stdout)
+
+
+if __name__ == "__main__":
+    main()
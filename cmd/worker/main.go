@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/joho/godotenv"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/sandbox"
+	"go-deepsandbox/worker"
+)
+
+func main() {
+	// Load environment variables from .env file
+	err := godotenv.Load()
+	if err != nil {
+		log.Println("Warning: .env file not found, using system environment variables")
+	}
+
+	// Initialize configuration
+	cfg := config.NewConfig()
+
+	// Initialize database connection
+	database, err := db.InitDB(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	// Migrate database schemas
+	err = db.MigrateDB(database)
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Initialize Redis connection for the task queue
+	redisClient, err := db.InitRedis(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	// Stop pulling new tasks on SIGINT/SIGTERM and let running ones finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Create the sandbox executor selected by EXECUTOR_BACKEND
+	executor, err := sandbox.NewExecutor(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure sandbox executor: %v", err)
+	}
+
+	w := worker.NewWorker(database, redisClient, executor, cfg)
+	if err := w.Run(ctx); err != nil {
+		log.Fatalf("Worker failed: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -41,9 +42,51 @@ type Config struct {
 	ContainerNetwork     string
 	ContainerTimeout     int
 	ExecutionPoolSize    int
+	WarmPoolSize         int // idle sandboxes kept started per runtime, EXECUTION_POOL_SIZE by default; 0 disables the warm pool
+	DockerHost           string
+	ExecutorBackend      string
+	LocalPython          string
+	CgroupParent         string
+	SandboxRootfsBinds   []string
+
+	// Task Recovery Settings
+	TaskLeaseTimeout int // seconds a worker may go without renewing its lease on a task
+	TaskMaxRetries   int // times a task whose worker stopped responding is requeued before it fails
+
+	// Session Settings
+	MaxSessionsPerUser int // default for the max_sessions quota
+	SessionsPerWorker  int
+	SessionIdleTimeout int // seconds
+	SessionMaxLifetime int // seconds
+
+	// Schedule Settings
+	SchedulerInterval   int // seconds between scheduler ticks; 0 disables the scheduler
+	ScheduleMaxFailures int // consecutive failed runs before a schedule is disabled
+	MaxSchedulesPerUser int // default for the max_schedules quota
+
+	// Code Analysis Settings
+	CodeAnalysis       bool     // check submitted code before queueing it
+	CodeAnalysisPython string   // interpreter that parses submitted code
+	CodeDenylist       []string // default denylist until an admin sets a code policy
+
+	// Package Settings
+	PackageWheelhouse     string   // local wheel directory requirements are installed from; empty disables requirements
+	PackageCacheDir       string   // where installed environments are kept, by requirements hash
+	PackageAllowlist      []string // default allowlist until an admin sets a package policy
+	PackageInstallTimeout int      // seconds
+
+	// Result Cache Settings
+	ResultCacheTTL int // seconds a completed result is reused for identical submissions; 0 disables the cache
+
+	// Artifact Settings
+	ArtifactMaxFiles     int
+	ArtifactMaxFileSize  string
+	ArtifactMaxTotalSize string
 
 	// Data Paths
-	DatasetsDir string
+	DatasetsDir    string
+	SandboxWorkDir string
+	ArtifactsDir   string
 
 	// PostgreSQL Database
 	PostgresHost     string
@@ -72,6 +115,22 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsList gets a comma-separated environment variable as a list or returns a default value
+func getEnvAsList(key string, defaultValue []string) []string {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	var values []string
+	for _, value := range strings.Split(valueStr, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 // NewConfig creates a new configuration with values from environment variables
 func NewConfig() *Config {
 	redisHost := getEnv("REDIS_HOST", "localhost")
@@ -96,6 +155,12 @@ func NewConfig() *Config {
 	celeryBrokerURL := getEnv("CELERY_BROKER_URL", fmt.Sprintf("redis://%s:%d/1", redisHost, redisPort))
 	celeryResultBackend := getEnv("CELERY_RESULT_BACKEND", fmt.Sprintf("redis://%s:%d/2", redisHost, redisPort))
 	
+	// Each execution slot gets a warm sandbox by default, with every backend
+	// that supports them. Warm containers copy datasets in when they cannot
+	// be hard linked, so they also work with the bind mounts of the shipped
+	// docker-compose file.
+	executionPoolSize := getEnvAsInt("EXECUTION_POOL_SIZE", 10)
+	
 	return &Config{
 		// API Settings
 		APITitle:       getEnv("API_TITLE", "DeepSandbox API"),
@@ -128,10 +193,52 @@ func NewConfig() *Config {
 		ContainerCPULimit:    getEnv("CONTAINER_CPU_LIMIT", "1"),
 		ContainerNetwork:     getEnv("CONTAINER_NETWORK", "none"),
 		ContainerTimeout:     getEnvAsInt("CONTAINER_TIMEOUT", 300),
-		ExecutionPoolSize:    getEnvAsInt("EXECUTION_POOL_SIZE", 10),
+		ExecutionPoolSize:    executionPoolSize,
+		WarmPoolSize:         getEnvAsInt("WARM_POOL_SIZE", executionPoolSize),
+		DockerHost:           getEnv("DOCKER_HOST", "unix:///var/run/docker.sock"),
+		ExecutorBackend:      getEnv("EXECUTOR_BACKEND", "docker"),
+		LocalPython:          getEnv("LOCAL_PYTHON", "python3"),
+		CgroupParent:         getEnv("SANDBOX_CGROUP_PARENT", "deepsandbox"),
+		SandboxRootfsBinds:   getEnvAsList("SANDBOX_ROOTFS_BINDS", []string{"/usr", "/lib", "/lib64", "/bin", "/sbin", "/etc"}),
+		
+		// Task Recovery Settings
+		TaskLeaseTimeout: getEnvAsInt("TASK_LEASE_TIMEOUT", 60),
+		TaskMaxRetries:   getEnvAsInt("TASK_MAX_RETRIES", 2),
+		
+		// Session Settings
+		MaxSessionsPerUser: getEnvAsInt("MAX_SESSIONS_PER_USER", 2),
+		SessionsPerWorker:  getEnvAsInt("SESSIONS_PER_WORKER", 4),
+		SessionIdleTimeout: getEnvAsInt("SESSION_IDLE_TIMEOUT", 900),
+		SessionMaxLifetime: getEnvAsInt("SESSION_MAX_LIFETIME", 28800),
+		
+		// Schedule Settings
+		SchedulerInterval:   getEnvAsInt("SCHEDULER_INTERVAL", 15),
+		ScheduleMaxFailures: getEnvAsInt("SCHEDULE_MAX_FAILURES", 3),
+		MaxSchedulesPerUser: getEnvAsInt("MAX_SCHEDULES_PER_USER", 10),
+
+		// Code Analysis Settings
+		CodeAnalysis:       getEnv("CODE_ANALYSIS", "true") != "false",
+		CodeAnalysisPython: getEnv("CODE_ANALYSIS_PYTHON", "python3"),
+		CodeDenylist:       getEnvAsList("CODE_DENYLIST", []string{"subprocess", "socket", "ctypes", "os.system"}),
+
+		// Package Settings
+		PackageWheelhouse:     getEnv("PACKAGE_WHEELHOUSE", ""),
+		PackageCacheDir:       getEnv("PACKAGE_CACHE_DIR", "packages"),
+		PackageAllowlist:      getEnvAsList("PACKAGE_ALLOWLIST", nil),
+		PackageInstallTimeout: getEnvAsInt("PACKAGE_INSTALL_TIMEOUT", 300),
+
+		// Result Cache Settings
+		ResultCacheTTL: getEnvAsInt("RESULT_CACHE_TTL", 86400),
+
+		// Artifact Settings
+		ArtifactMaxFiles:     getEnvAsInt("ARTIFACT_MAX_FILES", 50),
+		ArtifactMaxFileSize:  getEnv("ARTIFACT_MAX_FILE_SIZE", "50m"),
+		ArtifactMaxTotalSize: getEnv("ARTIFACT_MAX_TOTAL_SIZE", "200m"),
 		
 		// Data Paths
-		DatasetsDir: getEnv("DATASETS_DIR", "datasets"),
+		DatasetsDir:    getEnv("DATASETS_DIR", "datasets"),
+		SandboxWorkDir: getEnv("SANDBOX_WORK_DIR", "sandbox"),
+		ArtifactsDir:   getEnv("ARTIFACTS_DIR", "artifacts"),
 		
 		// PostgreSQL Database
 		PostgresHost:     postgresHost,
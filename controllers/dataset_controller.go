@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,6 +18,7 @@ import (
 	"gorm.io/gorm"
 
 	"go-deepsandbox/config"
+	"go-deepsandbox/db"
 	"go-deepsandbox/models"
 )
 
@@ -73,18 +76,63 @@ func (dc *DatasetController) UploadDataset(c *gin.Context) {
 	filePath := filepath.Join(datasetDir, datasetID+filepath.Ext(filename))
 
 	// Save file
+	size, contentHash, ok := dc.writeDatasetFile(c, &user, file, filePath)
+	if !ok {
+		return
+	}
+
+	// Get file size in MB
+	sizeMB := float64(size) / (1024 * 1024)
+
+	// In a real implementation, you would analyze the file here to extract row count, columns, etc.
+	// For this example, we'll use placeholder values
+	rowCount := 1000
+	columns := []string{"column1", "column2", "column3"}
+	schema := "{}"
+
+	// Create dataset record
+	dataset := models.Dataset{
+		ID:          datasetID,
+		UserID:      user.ID,
+		Filename:    filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        size,
+		SizeMB:      math.Round(sizeMB*100) / 100, // Round to 2 decimal places
+		RowCount:    rowCount,
+		Columns:     columns,
+		Schema:      schema,
+		ContentHash: contentHash,
+	}
+
+	// Save to database
+	if err := dc.DB.Create(&dataset).Error; err != nil {
+		// Remove file if database operation fails
+		os.Remove(filePath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save dataset metadata"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, dataset.ToDatasetMetadata())
+}
+
+// writeDatasetFile saves an uploaded file to filePath and returns its size
+// and content hash. It writes the error response and returns false when the
+// file could not be saved or exceeds the user's dataset size quota.
+func (dc *DatasetController) writeDatasetFile(c *gin.Context, user *models.User, file io.Reader, filePath string) (int64, string, bool) {
 	out, err := os.Create(filePath)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-		return
+		return 0, "", false
 	}
 	defer out.Close()
 
-	// Copy file data
-	size, err := io.Copy(out, file)
+	// Copy file data, hashing it on the way
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), file)
 	if err != nil {
+		os.Remove(filePath)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy file data"})
-		return
+		return 0, "", false
 	}
 
 	// Get file size in MB
@@ -109,37 +157,99 @@ func (dc *DatasetController) UploadDataset(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": fmt.Sprintf("File size exceeds the allowed limit of %d MB", maxDatasetSizeMB),
 		})
+		return 0, "", false
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// ReplaceDataset replaces the file of a dataset, keeping its ID. Results
+// cached from executions on the old file are no longer reused.
+func (dc *DatasetController) ReplaceDataset(c *gin.Context) {
+	// Get dataset ID from URL
+	datasetID := c.Param("dataset_id")
+
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
 		return
 	}
+	user := userInterface.(models.User)
 
-	// In a real implementation, you would analyze the file here to extract row count, columns, etc.
-	// For this example, we'll use placeholder values
-	rowCount := 1000
-	columns := []string{"column1", "column2", "column3"}
-	schema := "{}"
+	// Get dataset from database
+	var dataset models.Dataset
+	if err := dc.DB.Where("id = ?", datasetID).First(&dataset).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+		return
+	}
 
-	// Create dataset record
-	dataset := models.Dataset{
-		ID:          datasetID,
-		UserID:      user.ID,
-		Filename:    filename,
-		ContentType: header.Header.Get("Content-Type"),
-		Size:        size,
-		SizeMB:      math.Round(sizeMB*100) / 100, // Round to 2 decimal places
-		RowCount:    rowCount,
-		Columns:     columns,
-		Schema:      schema,
+	// Check if user has access to this dataset
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
 	}
 
-	// Save to database
-	if err := dc.DB.Create(&dataset).Error; err != nil {
-		// Remove file if database operation fails
-		os.Remove(filePath)
+	if dataset.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to replace this dataset"})
+		return
+	}
+
+	// Get file from request
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return
+	}
+	defer file.Close()
+
+	// Validate file format
+	filename := header.Filename
+	if !strings.HasSuffix(filename, ".csv") && !strings.HasSuffix(filename, ".parquet") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported file format. Use CSV or Parquet."})
+		return
+	}
+
+	// Write the new file next to the old one and move it into place, so
+	// executions never see a partial file
+	oldPath := dataset.FilePath(dc.Config.DatasetsDir)
+	replaced := models.Dataset{ID: dataset.ID, UserID: dataset.UserID, Filename: filename}
+	filePath := replaced.FilePath(dc.Config.DatasetsDir)
+	uploadPath := filePath + ".upload"
+
+	size, contentHash, ok := dc.writeDatasetFile(c, &user, file, uploadPath)
+	if !ok {
+		return
+	}
+	if err := os.Rename(uploadPath, filePath); err != nil {
+		os.Remove(uploadPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	if oldPath != filePath {
+		os.Remove(oldPath)
+	}
+
+	sizeMB := float64(size) / (1024 * 1024)
+	dataset.Filename = filename
+	dataset.ContentType = header.Header.Get("Content-Type")
+	dataset.Size = size
+	dataset.SizeMB = math.Round(sizeMB*100) / 100
+	dataset.ContentHash = contentHash
+	if err := dc.DB.Save(&dataset).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save dataset metadata"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, dataset.ToDatasetMetadata())
+	if err := db.InvalidateCachedResults(dc.DB, dataset.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invalidate cached results"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dataset.ToDatasetMetadata())
 }
 
 // ListDatasets lists datasets for the current user
@@ -286,7 +396,7 @@ func (dc *DatasetController) DeleteDataset(c *gin.Context) {
 	}
 
 	// Delete the file
-	filePath := filepath.Join(dc.Config.DatasetsDir, dataset.UserID, datasetID+filepath.Ext(dataset.Filename))
+	filePath := dataset.FilePath(dc.Config.DatasetsDir)
 	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete dataset file"})
 		return
@@ -298,5 +408,11 @@ func (dc *DatasetController) DeleteDataset(c *gin.Context) {
 		return
 	}
 
+	// Results computed from the dataset are no longer reused
+	if err := db.InvalidateCachedResults(dc.DB, dataset.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invalidate cached results"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Dataset %s deleted successfully", datasetID)})
 } 
\ No newline at end of file
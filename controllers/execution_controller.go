@@ -1,21 +1,43 @@
 package controllers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
+	"go-deepsandbox/analysis"
 	"go-deepsandbox/config"
 	"go-deepsandbox/db"
 	"go-deepsandbox/middleware"
 	"go-deepsandbox/models"
+	"go-deepsandbox/packages"
+	"go-deepsandbox/pipeline"
 )
 
+// maxExecutionDatasets caps how many datasets one execution can load
+const maxExecutionDatasets = 10
+
+// datasetAliasPattern matches the aliases datasets can be loaded under
+var datasetAliasPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// denylistEntryPattern matches denylist entries: module or dotted names
+var denylistEntryPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
 // ExecutionController handles code execution related endpoints
 type ExecutionController struct {
 	DB          *gorm.DB
@@ -51,39 +73,55 @@ func (ec *ExecutionController) ExecuteCode(c *gin.Context) {
 		return
 	}
 
-	// Verify the dataset exists and user has access
-	var dataset models.Dataset
-	if err := ec.DB.Where("id = ?", request.DatasetID).First(&dataset).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+	// Exactly one of code or notebook must be given
+	code, kind := request.Code, models.KindCode
+	switch {
+	case len(request.Notebook) > 0 && code != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either code or notebook, not both"})
+		return
+	case len(request.Notebook) > 0:
+		if err := validateNotebook(request.Notebook); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notebook: " + err.Error()})
+			return
+		}
+		code, kind = string(request.Notebook), models.KindNotebook
+	case code == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either code or notebook is required"})
 		return
 	}
 
-	// Check user has access to this dataset
-	isAdmin := false
-	for _, role := range user.Roles {
-		if role == "admin" {
-			isAdmin = true
-			break
+	// Collect the datasets to load by alias; dataset_id is loaded as data
+	aliases := map[string]string{}
+	for alias, datasetID := range request.Datasets {
+		if !datasetAliasPattern.MatchString(alias) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dataset alias " + strconv.Quote(alias) + ": must be a Python identifier"})
+			return
 		}
+		aliases[alias] = datasetID
+	}
+	if request.DatasetID != "" {
+		if _, taken := aliases[models.PrimaryDatasetAlias]; taken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Alias data is reserved for dataset_id"})
+			return
+		}
+		aliases[models.PrimaryDatasetAlias] = request.DatasetID
+	}
+	if len(aliases) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either dataset_id or datasets is required"})
+		return
+	}
+	if len(aliases) > maxExecutionDatasets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxExecutionDatasets) + " datasets can be loaded"})
+		return
 	}
 
-	if dataset.UserID != user.ID && !isAdmin {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have access to this dataset"})
+	links, ok := datasetLinks(c, ec.DB, &user, aliases)
+	if !ok {
 		return
 	}
 
 	// Get user's max execution time
-	maxExecutionTime := ec.Config.ContainerTimeout
-	
-	// Parse quota from JSON if it exists
-	if len(user.Quota) > 0 {
-		var quotaMap map[string]int
-		if err := json.Unmarshal(user.Quota, &quotaMap); err == nil {
-			if quota, ok := quotaMap["max_execution_time"]; ok && quota > 0 {
-				maxExecutionTime = quota
-			}
-		}
-	}
+	maxExecutionTime := user.QuotaLimit("max_execution_time", ec.Config.ContainerTimeout)
 
 	// Determine timeout
 	timeout := maxExecutionTime
@@ -91,17 +129,106 @@ func (ec *ExecutionController) ExecuteCode(c *gin.Context) {
 		timeout = *request.Timeout
 	}
 
+	// Determine priority, limited by the user's roles
+	priority := models.PriorityNormal
+	if request.Priority != "" {
+		priority = request.Priority
+	}
+	if !models.PriorityAllowed(priority, models.MaxPriority(user.Roles)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow " + priority + " priority"})
+		return
+	}
+
+	// Resolve the runtime against the registry
+	runtime, err := db.ResolveRuntime(ec.DB, request.Runtime)
+	if errors.Is(err, db.ErrUnknownRuntime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown runtime " + strconv.Quote(request.Runtime)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve runtime"})
+		return
+	}
+	if kind == models.KindNotebook && !runtime.IsPython() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Notebooks need a Python runtime"})
+		return
+	}
+
+	// Requirements must be allowed and are installed for Python only
+	var requirements []string
+	if len(request.Requirements) > 0 {
+		if !runtime.IsPython() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Requirements need a Python runtime"})
+			return
+		}
+		if requirements, ok = checkRequirements(c, ec.DB, ec.Config, request.Requirements); !ok {
+			return
+		}
+	}
+
+	// Reject code that can never run before it takes a queue slot
+	if runtime.IsPython() {
+		sources := []analysis.Source{{Code: code}}
+		if kind == models.KindNotebook {
+			sources = notebookSources(request.Notebook)
+		}
+		if !checkCode(c, ec.DB, ec.Config, sources, kind == models.KindNotebook) {
+			return
+		}
+	}
+
+	// Identical code on unchanged datasets reuses an earlier result
+	cacheKey := ""
+	if ec.Config.ResultCacheTTL > 0 {
+		hashes, err := db.DatasetHashes(ec.DB, ec.Config.DatasetsDir, aliases)
+		if err != nil {
+			log.Printf("Failed to hash datasets: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash datasets"})
+			return
+		}
+		cacheKey = db.ResultCacheKey(kind, code, runtime, requirements, timeout, aliases, hashes)
+
+		if request.Cache == nil || *request.Cache {
+			ttl := time.Duration(ec.Config.ResultCacheTTL) * time.Second
+			cached, err := db.FindCachedResult(ec.DB, user.ID, cacheKey, ttl)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up cached results"})
+				return
+			}
+			if cached != nil {
+				ec.serveCachedResult(c, cached, &models.CodeExecution{
+					UserID:       user.ID,
+					DatasetID:    request.DatasetID,
+					Code:         code,
+					Kind:         kind,
+					Runtime:      runtime.Name,
+					Requirements: requirements,
+					Datasets:     links,
+					Timeout:      timeout,
+					Priority:     priority,
+				})
+				return
+			}
+		}
+	}
+
 	// Record execution in database
 	execution := models.CodeExecution{
-		ID:        uuid.New().String(),
-		UserID:    user.ID,
-		DatasetID: request.DatasetID,
-		Code:      request.Code,
-		Status:    "queued",
-		StartTime: 0,
-		EndTime:   0,
-		Results:   "",
-		Error:     "",
+		ID:           uuid.New().String(),
+		UserID:       user.ID,
+		DatasetID:    request.DatasetID,
+		Code:         code,
+		Kind:         kind,
+		Runtime:      runtime.Name,
+		Requirements: requirements,
+		CacheKey:     cacheKey,
+		Datasets:     links,
+		Status:       models.StatusQueued,
+		Timeout:      timeout,
+		Priority:     priority,
+		StartTime:    0,
+		EndTime:      0,
+		Error:        "",
 	}
 
 	if err := ec.DB.Create(&execution).Error; err != nil {
@@ -109,37 +236,206 @@ func (ec *ExecutionController) ExecuteCode(c *gin.Context) {
 		return
 	}
 
-	// Submit to queue
-	taskID, err := ec.TaskQueue.SubmitCodeExecution(
-		request.DatasetID,
-		request.Code,
-		user.Username,
-		timeout,
-		"normal",
-	)
+	// Submit to queue, reusing the execution ID as the task ID
+	taskID, err := ec.TaskQueue.SubmitCodeExecution(&db.Task{
+		ID:           execution.ID,
+		DatasetID:    request.DatasetID,
+		Datasets:     aliases,
+		Code:         code,
+		Kind:         kind,
+		Runtime:      runtime.Name,
+		Requirements: requirements,
+		UserID:       user.ID,
+		Timeout:      timeout,
+		Priority:     priority,
+	})
 
 	if err != nil {
+		execution.Status = models.StatusFailed
+		execution.Error = "Failed to submit task to queue"
+		ec.DB.Save(&execution)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit task to queue"})
 		return
 	}
 
-	// Update execution record with task ID
-	execution.ID = taskID
-	ec.DB.Save(&execution)
+	// The execution was queued, so it counts towards the quota
+	middleware.UseReservedExecution(c)
 
-	// Track execution for quota
-	middleware.TrackExecution(ec.RedisClient, user.ID)
+	c.JSON(http.StatusAccepted, gin.H{
+		"task_id":  taskID,
+		"status":   "queued",
+		"kind":     kind,
+		"runtime":  runtime.Name,
+		"timeout":  timeout,
+		"priority": priority,
+		"message":  "Code submitted for execution",
+	})
+}
 
-	// Start background processing (in a real implementation this would be a goroutine)
-	go ec.processExecution(taskID, request.DatasetID, user.ID)
+// serveCachedResult records execution as completed with the results of the
+// earlier execution cached and responds with it. Nothing is queued and no
+// quota is used.
+func (ec *ExecutionController) serveCachedResult(c *gin.Context, cached *models.CodeExecution, execution *models.CodeExecution) {
+	now := db.CurrentTimestamp()
+	execution.ID = uuid.New().String()
+	execution.Status = models.StatusCompleted
+	execution.Results = cached.Results
+	execution.CachedFrom = cached.ID
+	execution.StartTime = now
+	execution.EndTime = now
+	if err := ec.DB.Create(execution).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record execution"})
+		return
+	}
 
-	c.JSON(http.StatusAccepted, gin.H{
-		"task_id": taskID,
-		"status":  "queued",
-		"message": "Code submitted for execution",
+	c.JSON(http.StatusOK, gin.H{
+		"task_id":     execution.ID,
+		"status":      execution.Status,
+		"kind":        execution.Kind,
+		"runtime":     execution.Runtime,
+		"cached_from": cached.ID,
+		"results":     models.ParseExecutionResult(execution.Results),
+		"message":     "Result reused from an identical earlier execution",
 	})
 }
 
+// datasetLinks checks that the user may load every dataset in aliases and
+// returns the links to record on the execution, in alias order. It writes the
+// error response and returns false otherwise.
+func datasetLinks(c *gin.Context, database *gorm.DB, user *models.User, aliases map[string]string) ([]models.ExecutionDataset, bool) {
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	links := make([]models.ExecutionDataset, 0, len(aliases))
+	for alias, datasetID := range aliases {
+		// Verify the dataset exists and user has access
+		var dataset models.Dataset
+		if err := database.Where("id = ?", datasetID).First(&dataset).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found", "dataset_id": datasetID})
+			return nil, false
+		}
+
+		if dataset.UserID != user.ID && !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have access to this dataset", "dataset_id": datasetID})
+			return nil, false
+		}
+		links = append(links, models.ExecutionDataset{Alias: alias, DatasetID: datasetID})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Alias < links[j].Alias })
+	return links, true
+}
+
+// validateNotebook checks that a submitted notebook is an nbformat 4 document
+// with at least one code cell
+func validateNotebook(raw json.RawMessage) error {
+	var notebook struct {
+		NBFormat int `json:"nbformat"`
+		Cells    []struct {
+			CellType string `json:"cell_type"`
+		} `json:"cells"`
+	}
+	if err := json.Unmarshal(raw, &notebook); err != nil {
+		return errors.New("not a JSON notebook document")
+	}
+	if notebook.NBFormat != 4 {
+		return fmt.Errorf("nbformat %d is not supported, only 4", notebook.NBFormat)
+	}
+	for _, cell := range notebook.Cells {
+		if cell.CellType == "code" {
+			return nil
+		}
+	}
+	return errors.New("notebook has no code cells")
+}
+
+// notebookSources returns the code cells of a validated notebook
+func notebookSources(raw json.RawMessage) []analysis.Source {
+	var notebook struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+		} `json:"cells"`
+	}
+	json.Unmarshal(raw, &notebook)
+
+	var sources []analysis.Source
+	for i, cell := range notebook.Cells {
+		if cell.CellType != "code" {
+			continue
+		}
+		// Cell sources are a string or a list of lines
+		var code string
+		if err := json.Unmarshal(cell.Source, &code); err != nil {
+			var lines []string
+			json.Unmarshal(cell.Source, &lines)
+			code = strings.Join(lines, "")
+		}
+		index := i
+		sources = append(sources, analysis.Source{Cell: &index, Code: code})
+	}
+	return sources
+}
+
+// checkCode runs the static checks on code before it is queued. It writes a
+// 422 with line-level diagnostics, or the error response, and returns false
+// when the code must not be queued.
+func checkCode(c *gin.Context, database *gorm.DB, cfg *config.Config, sources []analysis.Source, notebook bool) bool {
+	analyzer := analysis.NewAnalyzer(cfg)
+	if analyzer == nil {
+		return true
+	}
+
+	denylist, err := analysis.Denylist(database, cfg.CodeDenylist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load code policy"})
+		return false
+	}
+
+	diagnostics, err := analyzer.Check(sources, notebook, denylist)
+	if err != nil {
+		log.Printf("Failed to analyze code: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to analyze code"})
+		return false
+	}
+	if len(diagnostics) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Code failed validation", "diagnostics": diagnostics})
+		return false
+	}
+	return true
+}
+
+// checkRequirements validates requirements against the package allowlist
+// and returns them normalized. It writes the error response and returns
+// false when they must not be installed.
+func checkRequirements(c *gin.Context, database *gorm.DB, cfg *config.Config, requested []string) ([]string, bool) {
+	if cfg.PackageWheelhouse == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requirements are not enabled on this server"})
+		return nil, false
+	}
+
+	requirements, err := packages.Parse(requested)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	allowlist, err := packages.Allowlist(database, cfg.PackageAllowlist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load package policy"})
+		return nil, false
+	}
+	if disallowed := packages.Disallowed(requirements, allowlist); len(disallowed) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Packages not on the allowlist: " + strings.Join(disallowed, ", "), "packages": disallowed})
+		return nil, false
+	}
+	return packages.Strings(requirements), true
+}
+
 // GetTaskStatus checks the status of a task
 func (ec *ExecutionController) GetTaskStatus(c *gin.Context) {
 	// Get task ID from URL
@@ -174,9 +470,13 @@ func (ec *ExecutionController) GetTaskStatus(c *gin.Context) {
 		return
 	}
 
-	// Get status from task queue
+	// Get status from task queue, falling back to the database once the
+	// status hash has expired
 	status, err := ec.TaskQueue.GetTaskStatus(taskID)
-	if err != nil {
+	if errors.Is(err, db.ErrTaskNotFound) {
+		fallback := execution.ToTaskStatus()
+		status = &fallback
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get task status"})
 		return
 	}
@@ -184,6 +484,228 @@ func (ec *ExecutionController) GetTaskStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
+// sseKeepAlive is how often a comment is sent on an idle log stream so
+// proxies do not close the connection
+const sseKeepAlive = 15 * time.Second
+
+// StreamTaskLogs streams a task's output as Server-Sent Events. Buffered
+// lines are replayed first, then live lines follow until the task finishes
+// with a final status event. Reconnecting clients resume after Last-Event-ID.
+func (ec *ExecutionController) StreamTaskLogs(c *gin.Context) {
+	// Get task ID from URL
+	taskID := c.Param("task_id")
+
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Get execution from database
+	var execution models.CodeExecution
+	if err := ec.DB.Where("id = ?", taskID).First(&execution).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if execution.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this task"})
+		return
+	}
+
+	// Subscribe before replaying so no line published in between is lost
+	ctx := c.Request.Context()
+	pubsub, err := ec.TaskQueue.SubscribeTaskEvents(ctx, taskID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to task logs"})
+		return
+	}
+	defer pubsub.Close()
+
+	lastSeq, _ := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	sendLog := func(event *models.TaskEvent) {
+		if event.Seq <= lastSeq {
+			return
+		}
+		lastSeq = event.Seq
+		c.Render(-1, sse.Event{Id: strconv.FormatInt(event.Seq, 10), Event: models.TaskEventLog, Data: event})
+		c.Writer.Flush()
+	}
+	sendStatus := func(status *models.TaskStatus) {
+		c.Render(-1, sse.Event{Event: models.TaskEventStatus, Data: status})
+		c.Writer.Flush()
+	}
+
+	// Replay the buffered lines
+	buffered, err := ec.TaskQueue.GetTaskLogs(taskID, lastSeq)
+	if err != nil {
+		return
+	}
+	for i := range buffered {
+		sendLog(&buffered[i])
+	}
+
+	// A finished task has nothing more to stream
+	status, err := ec.TaskQueue.GetTaskStatus(taskID)
+	if errors.Is(err, db.ErrTaskNotFound) {
+		fallback := execution.ToTaskStatus()
+		status = &fallback
+	} else if err != nil {
+		return
+	}
+	if models.IsTerminalStatus(status.Status) {
+		// Pick up lines appended between the replay and the status check
+		if rest, err := ec.TaskQueue.GetTaskLogs(taskID, lastSeq); err == nil {
+			for i := range rest {
+				sendLog(&rest[i])
+			}
+		}
+		sendStatus(status)
+		return
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			c.Writer.WriteString(": keep-alive\n\n")
+			c.Writer.Flush()
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			event, err := db.ParseTaskEvent(message.Payload)
+			if err != nil {
+				continue
+			}
+			if event.Type == models.TaskEventStatus {
+				sendStatus(event.Status)
+				return
+			}
+			sendLog(event)
+		}
+	}
+}
+
+// ListTaskArtifacts lists the files a task wrote to its output directory
+func (ec *ExecutionController) ListTaskArtifacts(c *gin.Context) {
+	// Get task ID from URL
+	taskID := c.Param("task_id")
+
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Get execution from database
+	var execution models.CodeExecution
+	if err := ec.DB.Where("id = ?", taskID).First(&execution).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if execution.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this task"})
+		return
+	}
+
+	var artifacts []models.ExecutionArtifact
+	if err := ec.DB.Where("execution_id = ?", execution.ResultsID()).Order("name").Find(&artifacts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch artifacts"})
+		return
+	}
+	if artifacts == nil {
+		artifacts = []models.ExecutionArtifact{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"artifacts": artifacts})
+}
+
+// DownloadTaskArtifact downloads a file a task wrote to its output directory
+func (ec *ExecutionController) DownloadTaskArtifact(c *gin.Context) {
+	// Get task ID from URL
+	taskID := c.Param("task_id")
+
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Get execution from database
+	var execution models.CodeExecution
+	if err := ec.DB.Where("id = ?", taskID).First(&execution).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if execution.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this task"})
+		return
+	}
+
+	// Only files recorded for the task are served, so the name cannot escape
+	// the task's artifacts directory
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	var artifact models.ExecutionArtifact
+	if err := ec.DB.Where("execution_id = ? AND name = ?", execution.ResultsID(), name).First(&artifact).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+		return
+	}
+
+	// Artifacts are produced by user code, so never let browsers render them inline
+	c.Header("Content-Type", artifact.ContentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.FileAttachment(artifact.FilePath(ec.Config.ArtifactsDir), path.Base(artifact.Name))
+}
+
 // CancelTask cancels a task
 func (ec *ExecutionController) CancelTask(c *gin.Context) {
 	// Get task ID from URL
@@ -219,29 +741,94 @@ func (ec *ExecutionController) CancelTask(c *gin.Context) {
 	}
 
 	// Try to cancel the task
-	cancelled, err := ec.TaskQueue.CancelTask(taskID, user.Username)
+	outcome, err := ec.TaskQueue.CancelTask(taskID, user.Username)
+	if errors.Is(err, db.ErrTaskNotFound) {
+		// The status hash has expired, so only finished tasks end up here
+		c.JSON(http.StatusConflict, gin.H{"error": "Task has already finished", "status": execution.Status})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel task"})
 		return
 	}
 
-	if !cancelled {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to cancel task: task may have completed or doesn't exist"})
+	switch outcome {
+	case db.CancelFinished:
+		status, _ := ec.TaskQueue.GetTaskStatus(taskID)
+		finalStatus := execution.Status
+		if status != nil {
+			finalStatus = status.Status
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Task has already finished", "status": finalStatus})
+		return
+
+	case db.CancelRemoved:
+		// Update status in database
+		execution.Status = models.StatusCancelled
+		execution.EndTime = db.CurrentTimestamp()
+		execution.Error = "Cancelled by " + user.Username
+		ec.DB.Save(&execution)
+		ec.TaskQueue.PublishFinalStatus(taskID)
+		pipeline.RecordOutcome(ec.DB, ec.TaskQueue, ec.Config, &execution)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":    models.StatusCancelled,
+			"cancelled": true,
+			"message":   "Task has been removed from the queue",
+		})
 		return
 	}
 
-	// Update status in database
-	execution.Status = "cancelled"
-	execution.EndTime = float64(time.Now().Unix())
-	ec.DB.Save(&execution)
+	// The owning worker stops the task; wait briefly to report the outcome
+	status := waitForTerminalStatus(ec.TaskQueue, taskID, cancelWait)
+	switch {
+	case status == nil:
+		c.JSON(http.StatusAccepted, gin.H{
+			"status":    "cancelling",
+			"cancelled": false,
+			"message":   "Cancellation requested; the task has not stopped yet",
+		})
+	case status.Status == models.StatusCancelled:
+		c.JSON(http.StatusOK, gin.H{
+			"status":    models.StatusCancelled,
+			"cancelled": true,
+			"message":   "Task has been stopped",
+		})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Task finished before it could be cancelled", "status": status.Status})
+	}
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":  "cancelled",
-		"message": "Task has been cancelled",
-	})
+// cancelWait is how long CancelTask waits for a worker to stop a running task
+const cancelWait = 5 * time.Second
+
+// waitForTerminalStatus polls a task's status until it is terminal or the
+// timeout expires, in which case it returns nil
+func waitForTerminalStatus(taskQueue *db.TaskQueue, taskID string, timeout time.Duration) *models.TaskStatus {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := taskQueue.GetTaskStatus(taskID)
+		if err == nil && models.IsTerminalStatus(status.Status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
-// GetUserExecutions returns all executions for a user
+// Page sizes for GetUserExecutions
+const (
+	defaultExecutionPageSize = 50
+	maxExecutionPageSize     = 200
+)
+
+// GetUserExecutions lists executions, newest first, one page at a time.
+// Regular users see their own executions; admins may pass user_id to see
+// another user's, or omit it to see everyone's. Results can be filtered by
+// status (comma-separated), dataset_id and a created_at range given by from
+// and to. The compact view leaves out code and results unless view=full.
 func (ec *ExecutionController) GetUserExecutions(c *gin.Context) {
 	// Get user from context
 	userInterface, exists := c.Get("user")
@@ -251,49 +838,427 @@ func (ec *ExecutionController) GetUserExecutions(c *gin.Context) {
 	}
 	user := userInterface.(models.User)
 
-	// Query executions
+	// Check if user is admin
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	query := ec.DB.Model(&models.CodeExecution{})
+
+	// Regular users only see their own executions
+	if userID := c.Query("user_id"); userID != "" {
+		if userID != user.ID && !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view other users' executions"})
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	} else if !isAdmin {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
+	// Filters
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status IN ?", strings.Split(status, ","))
+	}
+	if datasetID := c.Query("dataset_id"); datasetID != "" {
+		linked := ec.DB.Model(&models.ExecutionDataset{}).Select("execution_id").Where("dataset_id = ?", datasetID)
+		query = query.Where("dataset_id = ? OR id IN (?)", datasetID, linked)
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseTimeParam(from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from: " + err.Error()})
+			return
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseTimeParam(to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to: " + err.Error()})
+			return
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	// Pagination continues after the last row of the previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+		createdAt, id, err := decodeExecutionCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", createdAt, createdAt, id)
+	}
+
+	limit := defaultExecutionPageSize
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxExecutionPageSize {
+		limit = maxExecutionPageSize
+	}
+
+	// Fetch one extra row to know whether there is another page
 	var executions []models.CodeExecution
-	if err := ec.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&executions).Error; err != nil {
+	if c.Query("view") != "full" {
+		query = query.Omit("code", "results")
+	} else {
+		query = query.Preload("Datasets")
+	}
+	if err := query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&executions).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch executions"})
 		return
 	}
 
-	c.JSON(http.StatusOK, executions)
+	nextCursor := ""
+	if len(executions) > limit {
+		executions = executions[:limit]
+		last := executions[limit-1]
+		nextCursor = encodeExecutionCursor(last.CreatedAt, last.ID)
+	}
+
+	var items interface{} = executions
+	if c.Query("view") != "full" {
+		summaries := make([]models.ExecutionSummary, len(executions))
+		for i, execution := range executions {
+			summaries[i] = execution.ToExecutionSummary()
+		}
+		items = summaries
+	} else if executions == nil {
+		items = []models.CodeExecution{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"executions":  items,
+		"next_cursor": nextCursor,
+	})
+}
+
+// encodeExecutionCursor returns an opaque cursor pointing after an execution
+func encodeExecutionCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+// decodeExecutionCursor reverses encodeExecutionCursor
+func decodeExecutionCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return createdAt, parts[1], nil
+}
+
+// parseTimeParam parses a query parameter given as RFC 3339, a date or Unix seconds
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+	return time.Time{}, errors.New("expected RFC 3339 time, YYYY-MM-DD date or Unix seconds")
+}
+
+// GetQueuePositions returns where each user's pending tasks sit in the
+// fair-share dequeue order
+func (ec *ExecutionController) GetQueuePositions(c *gin.Context) {
+	positions, err := ec.TaskQueue.QueuePositions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read queue"})
+		return
+	}
+
+	if userID := c.Query("user_id"); userID != "" {
+		filtered := make([]db.UserQueuePosition, 0, len(positions))
+		for _, position := range positions {
+			if position.UserID == userID {
+				filtered = append(filtered, position)
+			}
+		}
+		positions = filtered
+	}
+	if positions == nil {
+		positions = []db.UserQueuePosition{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": positions})
 }
 
-// GetQueueStatus returns queue statistics
+// queueStatusWindow is the time range queue statistics cover by default,
+// ending now
+const queueStatusWindow = time.Hour
+
+// GetQueueStatus returns live queue depths from Redis, and execution counts,
+// wait and run times and worker utilization over a time range from the
+// database (admin only)
 func (ec *ExecutionController) GetQueueStatus(c *gin.Context) {
-	// In a real implementation, this would query the task queue system
+	// Parse the time range
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to: " + err.Error()})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-queueStatusWindow)
+	if value := c.Query("from"); value != "" {
+		t, err := parseTimeParam(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from: " + err.Error()})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	// Pending tasks are only known to the queue
+	depths, err := ec.TaskQueue.QueueDepths()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read queue"})
+		return
+	}
+	now := db.CurrentTimestamp()
+	var queued int64
+	var oldestAge float64
+	priorities := make(gin.H, len(depths))
+	for _, depth := range depths {
+		queued += depth.Depth
+		age := 0.0
+		if depth.OldestEnqueuedAt > 0 {
+			age = now - depth.OldestEnqueuedAt
+		}
+		if age > oldestAge {
+			oldestAge = age
+		}
+		priorities[depth.Priority] = gin.H{"depth": depth.Depth, "oldest_age": age}
+	}
+
+	stats, err := db.ExecutionStats(ec.DB, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute execution statistics"})
+		return
+	}
+
+	// Utilization is the share of a worker's slots busy during the part of
+	// the range it has been up, as far as live workers tell
+	statuses, err := ec.TaskQueue.GetWorkerStatuses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load worker statuses"})
+		return
+	}
+	workerIDs := make([]string, 0, len(statuses)+len(stats.BusySeconds))
+	for workerID := range statuses {
+		workerIDs = append(workerIDs, workerID)
+	}
+	for workerID := range stats.BusySeconds {
+		if _, ok := statuses[workerID]; !ok {
+			workerIDs = append(workerIDs, workerID)
+		}
+	}
+	sort.Strings(workerIDs)
+
+	rangeStart, rangeEnd := float64(from.UnixNano())/1e9, float64(to.UnixNano())/1e9
+	workers := make([]gin.H, 0, len(workerIDs))
+	for _, workerID := range workerIDs {
+		busy := stats.BusySeconds[workerID]
+		worker := gin.H{"worker_id": workerID, "busy_seconds": busy, "live": false}
+		if status, ok := statuses[workerID]; ok {
+			worker["live"] = true
+			worker["slots"] = status.Slots
+			worker["running"] = status.Running
+			up := rangeEnd - rangeStart
+			if status.StartedAt > rangeStart {
+				up = rangeEnd - status.StartedAt
+			}
+			utilization := 0.0
+			if up > 0 && status.Slots > 0 {
+				utilization = busy / (up * float64(status.Slots))
+			}
+			worker["utilization"] = utilization
+		}
+		workers = append(workers, worker)
+	}
+
+	// Warm pools are reported across workers and per worker
+	pools, err := ec.TaskQueue.GetWarmPoolStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load warm pool statistics"})
+		return
+	}
+	if pools == nil {
+		pools = []models.WarmPoolStats{}
+	}
+	var total models.WarmPoolStats
+	for i := range pools {
+		total.Add(&pools[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"queued":   0,
-		"running":  0,
-		"completed": 0,
-		"failed":   0,
+		"from":              rangeStart,
+		"to":                rangeEnd,
+		"queued":            queued,
+		"running":           stats.Running,
+		"completed":         stats.Finished[models.StatusCompleted],
+		"failed":            stats.Finished[models.StatusFailed],
+		"timed_out":         stats.Finished[models.StatusTimedOut],
+		"cancelled":         stats.Finished[models.StatusCancelled],
+		"priorities":        priorities,
+		"oldest_queued_age": oldestAge,
+		"wait_time":         stats.WaitTime,
+		"run_time":          stats.RunTime,
+		"workers":           workers,
+		"warm_pool": gin.H{
+			"total":   total,
+			"workers": pools,
+		},
 	})
 }
 
-// processExecution simulates processing an execution task
-func (ec *ExecutionController) processExecution(taskID, datasetID, userID string) {
-	// In a real implementation, this would be handled by a worker
-	// For this example, we'll just update the status in the database
-	
-	// Get execution from database
-	var execution models.CodeExecution
-	if err := ec.DB.Where("id = ?", taskID).First(&execution).Error; err != nil {
+// GetCodePolicy returns the denylist submitted code is checked against (admin only)
+func (ec *ExecutionController) GetCodePolicy(c *gin.Context) {
+	var policy models.CodePolicy
+	err := ec.DB.Where("id = ?", models.CodePolicyID).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// No admin has set a policy yet
+		c.JSON(http.StatusOK, gin.H{"denylist": ec.Config.CodeDenylist, "default": true})
 		return
 	}
-	
-	// Update status to running
-	execution.Status = "running"
-	execution.StartTime = float64(time.Now().Unix())
-	ec.DB.Save(&execution)
-	
-	// Simulate processing time
-	time.Sleep(2 * time.Second)
-	
-	// Update status to completed
-	execution.Status = "completed"
-	execution.EndTime = float64(time.Now().Unix())
-	execution.Results = `{"result": "Execution completed successfully."}`
-	ec.DB.Save(&execution)
-} 
\ No newline at end of file
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load code policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// UpdateCodePolicy replaces the denylist submitted code is checked against (admin only)
+func (ec *ExecutionController) UpdateCodePolicy(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.CodePolicyUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	denylist := make([]string, 0, len(request.Denylist))
+	seen := make(map[string]bool, len(request.Denylist))
+	for _, entry := range request.Denylist {
+		entry = strings.TrimSpace(entry)
+		if !denylistEntryPattern.MatchString(entry) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid denylist entry " + strconv.Quote(entry) + ": must be a module or dotted name"})
+			return
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			denylist = append(denylist, entry)
+		}
+	}
+	sort.Strings(denylist)
+
+	policy := models.CodePolicy{
+		ID:        models.CodePolicyID,
+		Denylist:  denylist,
+		UpdatedBy: user.Username,
+	}
+	if err := ec.DB.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update code policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// GetPackagePolicy returns the packages executions may list as requirements (admin only)
+func (ec *ExecutionController) GetPackagePolicy(c *gin.Context) {
+	var policy models.PackagePolicy
+	err := ec.DB.Where("id = ?", models.PackagePolicyID).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// No admin has set a policy yet
+		allowlist := ec.Config.PackageAllowlist
+		if allowlist == nil {
+			allowlist = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"allowlist": allowlist, "default": true})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load package policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// UpdatePackagePolicy replaces the packages executions may list as requirements (admin only)
+func (ec *ExecutionController) UpdatePackagePolicy(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.PackagePolicyUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	allowlist := make([]string, 0, len(request.Allowlist))
+	seen := make(map[string]bool, len(request.Allowlist))
+	for _, entry := range request.Allowlist {
+		if !packages.ValidName(entry) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid allowlist entry " + strconv.Quote(entry) + ": must be a package name"})
+			return
+		}
+		name := packages.Normalize(entry)
+		if !seen[name] {
+			seen[name] = true
+			allowlist = append(allowlist, name)
+		}
+	}
+	sort.Strings(allowlist)
+
+	policy := models.PackagePolicy{
+		ID:        models.PackagePolicyID,
+		Allowlist: allowlist,
+		UpdatedBy: user.Username,
+	}
+	if err := ec.DB.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update package policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/analysis"
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/middleware"
+	"go-deepsandbox/models"
+	"go-deepsandbox/pipeline"
+)
+
+// PipelineController handles multi-step pipeline endpoints
+type PipelineController struct {
+	DB          *gorm.DB
+	Config      *config.Config
+	RedisClient *redis.Client
+	TaskQueue   *db.TaskQueue
+}
+
+// NewPipelineController creates a new pipeline controller
+func NewPipelineController(database *gorm.DB, redisClient *redis.Client, cfg *config.Config) *PipelineController {
+	return &PipelineController{
+		DB:          database,
+		Config:      cfg,
+		RedisClient: redisClient,
+		TaskQueue:   db.GetTaskQueue(redisClient),
+	}
+}
+
+// CreatePipeline creates a pipeline and starts the steps that have no
+// dependencies
+func (pc *PipelineController) CreatePipeline(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.PipelineCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := pipeline.ValidateSteps(request.Steps); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify the dataset exists and user has access
+	var dataset models.Dataset
+	if err := pc.DB.Where("id = ?", request.DatasetID).First(&dataset).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+		return
+	}
+
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if dataset.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have access to this dataset"})
+		return
+	}
+
+	// Determine priority, limited by the user's roles
+	priority := models.PriorityNormal
+	if request.Priority != "" {
+		priority = request.Priority
+	}
+	if !models.PriorityAllowed(priority, models.MaxPriority(user.Roles)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow " + priority + " priority"})
+		return
+	}
+
+	sources := make([]analysis.Source, len(request.Steps))
+	for i, step := range request.Steps {
+		sources[i] = analysis.Source{Step: step.Name, Code: step.Code}
+	}
+	if !checkCode(c, pc.DB, pc.Config, sources, false) {
+		return
+	}
+
+	maxExecutionTime := user.QuotaLimit("max_execution_time", pc.Config.ContainerTimeout)
+
+	p := models.Pipeline{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Name:      request.Name,
+		DatasetID: request.DatasetID,
+		Priority:  priority,
+		Status:    models.PipelineRunning,
+	}
+	for i, step := range request.Steps {
+		timeout := maxExecutionTime
+		if step.Timeout != nil && *step.Timeout > 0 && *step.Timeout < maxExecutionTime {
+			timeout = *step.Timeout
+		}
+		p.Steps = append(p.Steps, models.PipelineStep{
+			Name:      step.Name,
+			Position:  i,
+			Code:      step.Code,
+			DependsOn: step.DependsOn,
+			Timeout:   timeout,
+			Status:    models.StepWaiting,
+		})
+	}
+
+	if err := pc.DB.Create(&p).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pipeline"})
+		return
+	}
+
+	// Each step reserves its own execution quota when it is queued
+	middleware.ReleaseReservedExecution(c, pc.RedisClient)
+	if err := pipeline.Advance(pc.DB, pc.TaskQueue, pc.Config, p.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start pipeline"})
+		return
+	}
+
+	created, ok := pc.reload(c, p.ID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+// ListPipelines lists the current user's pipelines, newest first, without
+// their steps
+func (pc *PipelineController) ListPipelines(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	query := pc.DB.Where("user_id = ?", user.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var pipelines []models.Pipeline
+	if err := query.Order("created_at DESC").Limit(100).Find(&pipelines).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pipelines"})
+		return
+	}
+	if pipelines == nil {
+		pipelines = []models.Pipeline{}
+	}
+
+	c.JSON(http.StatusOK, pipelines)
+}
+
+// GetPipeline returns a pipeline with the status of each step
+func (pc *PipelineController) GetPipeline(c *gin.Context) {
+	p, ok := pc.loadPipeline(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+// CancelPipeline cancels every step of a running pipeline that has not
+// finished. Running steps are stopped by their workers.
+func (pc *PipelineController) CancelPipeline(c *gin.Context) {
+	p, ok := pc.loadPipeline(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet("user").(models.User)
+
+	err := pipeline.Cancel(pc.DB, pc.TaskQueue, p.ID, user.Username)
+	if errors.Is(err, pipeline.ErrNotRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Pipeline has already finished", "status": p.Status})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel pipeline"})
+		return
+	}
+
+	cancelled, ok := pc.reload(c, p.ID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, cancelled)
+}
+
+// RetryPipeline restarts a failed or cancelled pipeline from the steps that
+// did not complete
+func (pc *PipelineController) RetryPipeline(c *gin.Context) {
+	p, ok := pc.loadPipeline(c)
+	if !ok {
+		return
+	}
+
+	// Each step reserves its own execution quota when it is queued
+	middleware.ReleaseReservedExecution(c, pc.RedisClient)
+	err := pipeline.Retry(pc.DB, pc.TaskQueue, pc.Config, p)
+	if errors.Is(err, pipeline.ErrNotRetryable) || errors.Is(err, pipeline.ErrStepsActive) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": p.Status})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry pipeline"})
+		return
+	}
+
+	retried, ok := pc.reload(c, p.ID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusAccepted, retried)
+}
+
+// loadPipeline loads the pipeline named in the URL with its steps and checks
+// that the user may access it. It writes the error response and returns
+// false otherwise.
+func (pc *PipelineController) loadPipeline(c *gin.Context) (*models.Pipeline, bool) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return nil, false
+	}
+	user := userInterface.(models.User)
+
+	p, ok := pc.reload(c, c.Param("pipeline_id"))
+	if !ok {
+		return nil, false
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if p.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this pipeline"})
+		return nil, false
+	}
+
+	return p, true
+}
+
+// reload loads a pipeline with its steps in order. Submitted steps that have
+// not finished show the status of their execution. It writes the error
+// response and returns false when the pipeline cannot be loaded.
+func (pc *PipelineController) reload(c *gin.Context, pipelineID string) (*models.Pipeline, bool) {
+	var p models.Pipeline
+	if err := pc.DB.Preload("Steps").Where("id = ?", pipelineID).First(&p).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return nil, false
+	}
+	sort.Slice(p.Steps, func(i, j int) bool { return p.Steps[i].Position < p.Steps[j].Position })
+
+	var executionIDs []string
+	for _, step := range p.Steps {
+		if step.Status == models.StatusQueued {
+			executionIDs = append(executionIDs, step.ExecutionID)
+		}
+	}
+	if len(executionIDs) > 0 {
+		var executions []models.CodeExecution
+		pc.DB.Select("id", "status").Where("id IN ?", executionIDs).Find(&executions)
+		status := make(map[string]string, len(executions))
+		for _, execution := range executions {
+			status[execution.ID] = execution.Status
+		}
+		for i := range p.Steps {
+			if s, ok := status[p.Steps[i].ExecutionID]; ok && p.Steps[i].Status == models.StatusQueued {
+				p.Steps[i].Status = s
+			}
+		}
+	}
+
+	return &p, true
+}
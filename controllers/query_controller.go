@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/middleware"
+	"go-deepsandbox/models"
+)
+
+// Row pages for query results
+const (
+	defaultQueryPageSize = 1000
+	maxQueryPageSize     = 10000
+)
+
+// defaultQueryWait is how long RunQuery waits for rows before answering 202
+const defaultQueryWait = 30 * time.Second
+
+// readOnlyQueryPattern matches queries that start, after any comments, like
+// a read-only statement. The engine enforces read-only access; this rejects
+// other statements before they are queued.
+var readOnlyQueryPattern = regexp.MustCompile(`(?is)^(\s|--[^\n]*|/\*.*?\*/)*(select|with|values|from|\()`)
+
+// QueryController handles SQL query endpoints
+type QueryController struct {
+	DB          *gorm.DB
+	Config      *config.Config
+	RedisClient *redis.Client
+	TaskQueue   *db.TaskQueue
+}
+
+// NewQueryController creates a new query controller
+func NewQueryController(database *gorm.DB, redisClient *redis.Client, cfg *config.Config) *QueryController {
+	return &QueryController{
+		DB:          database,
+		Config:      cfg,
+		RedisClient: redisClient,
+		TaskQueue:   db.GetTaskQueue(redisClient),
+	}
+}
+
+// RunQuery queues a read-only SQL query over the dataset in the URL, loaded
+// as the table data, and any datasets given by alias. Queries run in the
+// sandbox like code, under the same timeout and quota. The response waits
+// for the query to finish for up to wait seconds (30 by default) and returns
+// the first page of rows, or 202 with the task ID to poll with GetQueryResult.
+func (qc *QueryController) RunQuery(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.QueryRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !readOnlyQueryPattern.MatchString(request.SQL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only read-only SELECT queries are allowed"})
+		return
+	}
+
+	// Collect the datasets to query by alias; the dataset in the URL is data
+	datasetID := c.Param("dataset_id")
+	aliases := map[string]string{}
+	for alias, id := range request.Datasets {
+		if !datasetAliasPattern.MatchString(alias) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dataset alias " + strconv.Quote(alias) + ": must be a SQL identifier"})
+			return
+		}
+		aliases[alias] = id
+	}
+	if datasetID != "" {
+		if _, taken := aliases[models.PrimaryDatasetAlias]; taken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Alias data is reserved for the dataset in the URL"})
+			return
+		}
+		aliases[models.PrimaryDatasetAlias] = datasetID
+	}
+	if len(aliases) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "datasets is required"})
+		return
+	}
+	if len(aliases) > maxExecutionDatasets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxExecutionDatasets) + " datasets can be queried"})
+		return
+	}
+
+	links, ok := datasetLinks(c, qc.DB, &user, aliases)
+	if !ok {
+		return
+	}
+
+	// Determine timeout
+	maxExecutionTime := user.QuotaLimit("max_execution_time", qc.Config.ContainerTimeout)
+	timeout := maxExecutionTime
+	if request.Timeout != nil && *request.Timeout > 0 && *request.Timeout < maxExecutionTime {
+		timeout = *request.Timeout
+	}
+
+	// Determine priority, limited by the user's roles
+	priority := models.PriorityNormal
+	if request.Priority != "" {
+		priority = request.Priority
+	}
+	if !models.PriorityAllowed(priority, models.MaxPriority(user.Roles)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow " + priority + " priority"})
+		return
+	}
+
+	execution := &models.CodeExecution{
+		UserID:    user.ID,
+		DatasetID: datasetID,
+		Code:      request.SQL,
+		Kind:      models.KindSQL,
+		Datasets:  links,
+		Timeout:   timeout,
+		Priority:  priority,
+	}
+	if err := db.SubmitExecution(qc.DB, qc.TaskQueue, execution); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit query"})
+		return
+	}
+
+	// The execution was queued, so it counts towards the quota
+	middleware.UseReservedExecution(c)
+
+	wait := defaultQueryWait
+	if seconds, err := strconv.Atoi(c.Query("wait")); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	if limit := time.Duration(timeout+5) * time.Second; wait > limit {
+		wait = limit
+	}
+
+	if waitForTerminalStatus(qc.TaskQueue, execution.ID, wait) == nil {
+		status := models.StatusQueued
+		if latest, err := qc.TaskQueue.GetTaskStatus(execution.ID); err == nil {
+			status = latest.Status
+		}
+		c.JSON(http.StatusAccepted, gin.H{"task_id": execution.ID, "status": status})
+		return
+	}
+
+	// The worker saves the execution before publishing its final status
+	if err := qc.DB.Where("id = ?", execution.ID).First(execution).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch query result"})
+		return
+	}
+	qc.writeRows(c, execution)
+}
+
+// GetQueryResult returns a page of the rows of a query, given by offset and
+// limit, or 202 while the query has not finished
+func (qc *QueryController) GetQueryResult(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	var execution models.CodeExecution
+	if err := qc.DB.Where("id = ? AND kind = ?", c.Param("task_id"), models.KindSQL).First(&execution).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Query not found"})
+		return
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if execution.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this query"})
+		return
+	}
+
+	if !models.IsTerminalStatus(execution.Status) {
+		c.JSON(http.StatusAccepted, gin.H{"task_id": execution.ID, "status": execution.Status})
+		return
+	}
+	qc.writeRows(c, &execution)
+}
+
+// writeRows responds with the page of a finished query's rows given by the
+// offset and limit parameters. A query that did not complete has its error
+// instead.
+func (qc *QueryController) writeRows(c *gin.Context, execution *models.CodeExecution) {
+	var result models.ExecutionResult
+	if len(execution.Results) > 0 {
+		json.Unmarshal(execution.Results, &result)
+	}
+
+	if execution.Status != models.StatusCompleted || result.Query == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"task_id": execution.ID,
+			"status":  execution.Status,
+			"error":   execution.Error,
+			"stderr":  result.Stderr,
+		})
+		return
+	}
+
+	offset := 0
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		offset = o
+	}
+	limit := defaultQueryPageSize
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxQueryPageSize {
+		limit = maxQueryPageSize
+	}
+
+	query := result.Query
+	rows := [][]interface{}{}
+	if offset < len(query.Rows) {
+		end := offset + limit
+		if end > len(query.Rows) {
+			end = len(query.Rows)
+		}
+		rows = query.Rows[offset:end]
+	}
+
+	response := gin.H{
+		"task_id":    execution.ID,
+		"status":     execution.Status,
+		"engine":     query.Engine,
+		"columns":    query.Columns,
+		"rows":       rows,
+		"offset":     offset,
+		"limit":      limit,
+		"total_rows": query.TotalRows,
+		"truncated":  query.Truncated,
+	}
+	if next := offset + len(rows); len(rows) > 0 && next < len(query.Rows) {
+		response["next_offset"] = next
+	}
+	c.JSON(http.StatusOK, response)
+}
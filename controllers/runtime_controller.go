@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/models"
+)
+
+// runtimeNamePattern matches runtime names such as python-3.12 or R-4.3
+var runtimeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// RuntimeController handles the runtime registry endpoints
+type RuntimeController struct {
+	DB     *gorm.DB
+	Config *config.Config
+}
+
+// NewRuntimeController creates a new runtime controller
+func NewRuntimeController(database *gorm.DB, cfg *config.Config) *RuntimeController {
+	return &RuntimeController{
+		DB:     database,
+		Config: cfg,
+	}
+}
+
+// ListRuntimes lists the runtimes executions can ask for, starting with the
+// builtin Python runtime. Admins also see disabled runtimes.
+func (rc *RuntimeController) ListRuntimes(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	query := rc.DB.Order("name")
+	if !isAdmin {
+		query = query.Where("enabled = ?", true)
+	}
+	var registered []models.Runtime
+	if err := query.Find(&registered).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch runtimes"})
+		return
+	}
+
+	builtin := models.Runtime{
+		Name:      models.BuiltinRuntime,
+		Language:  models.LanguagePython,
+		Image:     rc.Config.ContainerImage,
+		Command:   []string{"python3"},
+		IsDefault: true,
+		Enabled:   true,
+	}
+	for _, runtime := range registered {
+		if runtime.IsDefault && runtime.Enabled {
+			builtin.IsDefault = false
+		}
+	}
+
+	c.JSON(http.StatusOK, append([]models.Runtime{builtin}, registered...))
+}
+
+// CreateRuntime registers a runtime (admin only)
+func (rc *RuntimeController) CreateRuntime(c *gin.Context) {
+	// Parse request
+	var request models.RuntimeCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !runtimeNamePattern.MatchString(request.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid runtime name: use letters, digits, ., _ and -"})
+		return
+	}
+	if request.Name == models.BuiltinRuntime {
+		c.JSON(http.StatusConflict, gin.H{"error": "Runtime " + models.BuiltinRuntime + " is builtin"})
+		return
+	}
+	if err := rc.DB.Where("name = ?", request.Name).First(&models.Runtime{}).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Runtime already exists"})
+		return
+	}
+
+	runtime := models.Runtime{
+		Name:      request.Name,
+		Language:  request.Language,
+		Image:     request.Image,
+		Command:   request.Command,
+		IsDefault: request.Default,
+		Enabled:   request.Enabled == nil || *request.Enabled,
+	}
+	if !rc.validate(c, &runtime) {
+		return
+	}
+
+	if err := rc.save(&runtime, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create runtime"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, runtime)
+}
+
+// UpdateRuntime changes a runtime (admin only). Executions already queued
+// run with the changed runtime.
+func (rc *RuntimeController) UpdateRuntime(c *gin.Context) {
+	var runtime models.Runtime
+	if err := rc.DB.Where("name = ?", c.Param("name")).First(&runtime).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Runtime not found"})
+		return
+	}
+
+	// Parse request
+	var request models.RuntimeUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Language != nil {
+		runtime.Language = *request.Language
+	}
+	if request.Image != nil {
+		runtime.Image = *request.Image
+	}
+	if request.Command != nil {
+		runtime.Command = request.Command
+	}
+	if request.Default != nil {
+		runtime.IsDefault = *request.Default
+	}
+	if request.Enabled != nil {
+		runtime.Enabled = *request.Enabled
+	}
+	if !rc.validate(c, &runtime) {
+		return
+	}
+
+	if err := rc.save(&runtime, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update runtime"})
+		return
+	}
+
+	c.JSON(http.StatusOK, runtime)
+}
+
+// DeleteRuntime removes a runtime from the registry (admin only). Past
+// executions keep its name.
+func (rc *RuntimeController) DeleteRuntime(c *gin.Context) {
+	deleted := rc.DB.Delete(&models.Runtime{}, "name = ?", c.Param("name"))
+	if deleted.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete runtime"})
+		return
+	}
+	if deleted.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Runtime not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Runtime deleted successfully"})
+}
+
+// validate checks a new or changed runtime. It writes the error response and
+// returns false when the runtime is invalid.
+func (rc *RuntimeController) validate(c *gin.Context, runtime *models.Runtime) bool {
+	if strings.TrimSpace(runtime.Image) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Runtime image is required"})
+		return false
+	}
+	if len(runtime.Command) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Runtime command is required"})
+		return false
+	}
+	for _, arg := range runtime.Command {
+		if arg == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Runtime command has an empty argument"})
+			return false
+		}
+	}
+
+	// Notebooks, queries, schedules and pipelines run with the default runtime
+	if runtime.IsDefault && (!runtime.IsPython() || !runtime.Enabled) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default runtime must be an enabled Python runtime"})
+		return false
+	}
+	return true
+}
+
+// save creates or updates a runtime. A default runtime replaces the previous
+// default.
+func (rc *RuntimeController) save(runtime *models.Runtime, create bool) error {
+	return rc.DB.Transaction(func(tx *gorm.DB) error {
+		if runtime.IsDefault {
+			err := tx.Model(&models.Runtime{}).
+				Where("name <> ? AND is_default = ?", runtime.Name, true).
+				Update("is_default", false).Error
+			if err != nil {
+				return err
+			}
+		}
+		if create {
+			return tx.Create(runtime).Error
+		}
+		return tx.Save(runtime).Error
+	})
+}
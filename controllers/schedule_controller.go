@@ -0,0 +1,331 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/analysis"
+	"go-deepsandbox/config"
+	"go-deepsandbox/models"
+	"go-deepsandbox/scheduler"
+)
+
+// maxScheduleRuns caps how many runs GetScheduleRuns returns
+const maxScheduleRuns = 200
+
+// ScheduleController handles scheduled execution endpoints
+type ScheduleController struct {
+	DB     *gorm.DB
+	Config *config.Config
+}
+
+// NewScheduleController creates a new schedule controller
+func NewScheduleController(database *gorm.DB, cfg *config.Config) *ScheduleController {
+	return &ScheduleController{
+		DB:     database,
+		Config: cfg,
+	}
+}
+
+// CreateSchedule creates a schedule that runs code against a dataset at the
+// times given by a cron expression
+func (sc *ScheduleController) CreateSchedule(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.ScheduleCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check the user's schedule limit
+	maxSchedules := user.QuotaLimit("max_schedules", sc.Config.MaxSchedulesPerUser)
+	var count int64
+	sc.DB.Model(&models.Schedule{}).Where("user_id = ?", user.ID).Count(&count)
+	if count >= int64(maxSchedules) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "You have reached your limit of " + strconv.Itoa(maxSchedules) + " schedules"})
+		return
+	}
+
+	schedule := models.Schedule{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Name:      request.Name,
+		DatasetID: request.DatasetID,
+		Code:      request.Code,
+		Cron:      request.Cron,
+		Timezone:  request.Timezone,
+		Priority:  request.Priority,
+		Enabled:   request.Enabled == nil || *request.Enabled,
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	if request.Timeout != nil {
+		schedule.Timeout = *request.Timeout
+	}
+	if schedule.Priority == "" {
+		schedule.Priority = models.PriorityNormal
+	}
+
+	if !sc.validate(c, &user, &schedule, true) {
+		return
+	}
+	if !checkCode(c, sc.DB, sc.Config, []analysis.Source{{Code: schedule.Code}}, false) {
+		return
+	}
+
+	if err := sc.DB.Create(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create schedule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// ListSchedules lists the current user's schedules
+func (sc *ScheduleController) ListSchedules(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	var schedules []models.Schedule
+	if err := sc.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+	if schedules == nil {
+		schedules = []models.Schedule{}
+	}
+
+	c.JSON(http.StatusOK, schedules)
+}
+
+// GetSchedule returns a schedule
+func (sc *ScheduleController) GetSchedule(c *gin.Context) {
+	schedule, ok := sc.loadSchedule(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+// UpdateSchedule changes a schedule. Enabling a schedule resets its failure
+// count; changing when it runs recomputes its next run.
+func (sc *ScheduleController) UpdateSchedule(c *gin.Context) {
+	schedule, ok := sc.loadSchedule(c)
+	if !ok {
+		return
+	}
+
+	// The schedule runs as its owner, who may not be the user editing it
+	var owner models.User
+	if err := sc.DB.Where("id = ?", schedule.UserID).First(&owner).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule owner not found"})
+		return
+	}
+
+	// Parse request
+	var request models.ScheduleUpdate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Name != nil {
+		schedule.Name = *request.Name
+	}
+	if request.DatasetID != nil {
+		schedule.DatasetID = *request.DatasetID
+	}
+	if request.Code != nil {
+		schedule.Code = *request.Code
+	}
+	if request.Cron != nil {
+		schedule.Cron = *request.Cron
+	}
+	if request.Timezone != nil {
+		schedule.Timezone = *request.Timezone
+	}
+	if request.Timeout != nil {
+		schedule.Timeout = *request.Timeout
+	}
+	if request.Priority != nil {
+		schedule.Priority = *request.Priority
+	}
+	if request.Enabled != nil {
+		if *request.Enabled && !schedule.Enabled {
+			schedule.ConsecutiveFailures = 0
+			schedule.DisabledReason = ""
+		}
+		schedule.Enabled = *request.Enabled
+	}
+
+	reschedule := request.Cron != nil || request.Timezone != nil || request.Enabled != nil
+	if !sc.validate(c, &owner, schedule, reschedule) {
+		return
+	}
+	if request.Code != nil && !checkCode(c, sc.DB, sc.Config, []analysis.Source{{Code: schedule.Code}}, false) {
+		return
+	}
+
+	if err := sc.DB.Save(schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteSchedule deletes a schedule. Its past runs are kept.
+func (sc *ScheduleController) DeleteSchedule(c *gin.Context) {
+	schedule, ok := sc.loadSchedule(c)
+	if !ok {
+		return
+	}
+
+	if err := sc.DB.Delete(&models.Schedule{}, "id = ?", schedule.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully"})
+}
+
+// GetScheduleRuns lists the executions a schedule has fired, newest first
+func (sc *ScheduleController) GetScheduleRuns(c *gin.Context) {
+	schedule, ok := sc.loadSchedule(c)
+	if !ok {
+		return
+	}
+
+	limit := defaultExecutionPageSize
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxScheduleRuns {
+		limit = maxScheduleRuns
+	}
+
+	var executions []models.CodeExecution
+	err := sc.DB.Omit("code", "results").
+		Where("schedule_id = ?", schedule.ID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&executions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedule runs"})
+		return
+	}
+
+	runs := make([]models.ExecutionSummary, len(executions))
+	for i, execution := range executions {
+		runs[i] = execution.ToExecutionSummary()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// validate checks a new or changed schedule against its owner, user, and
+// caps its timeout by the owner's quota. With reschedule, its next run is
+// computed again. It writes the error response and returns false when the
+// schedule is invalid.
+func (sc *ScheduleController) validate(c *gin.Context, user *models.User, schedule *models.Schedule, reschedule bool) bool {
+	// Verify the dataset exists and user has access
+	var dataset models.Dataset
+	if err := sc.DB.Where("id = ?", schedule.DatasetID).First(&dataset).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+		return false
+	}
+
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if dataset.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have access to this dataset"})
+		return false
+	}
+
+	if !models.PriorityAllowed(schedule.Priority, models.MaxPriority(user.Roles)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your role does not allow " + schedule.Priority + " priority"})
+		return false
+	}
+
+	maxExecutionTime := user.QuotaLimit("max_execution_time", sc.Config.ContainerTimeout)
+	if schedule.Timeout <= 0 || schedule.Timeout > maxExecutionTime {
+		schedule.Timeout = maxExecutionTime
+	}
+
+	next, err := scheduler.NextRun(schedule.Cron, schedule.Timezone, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if next == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cron expression has no upcoming runs"})
+		return false
+	}
+
+	if !schedule.Enabled {
+		schedule.NextRunAt = nil
+	} else if reschedule || schedule.NextRunAt == nil {
+		schedule.NextRunAt = next
+	}
+	return true
+}
+
+// loadSchedule loads the schedule named in the URL and checks that the user
+// may access it. It writes the error response and returns false otherwise.
+func (sc *ScheduleController) loadSchedule(c *gin.Context) (*models.Schedule, bool) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return nil, false
+	}
+	user := userInterface.(models.User)
+
+	var schedule models.Schedule
+	if err := sc.DB.Where("id = ?", c.Param("schedule_id")).First(&schedule).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return nil, false
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if schedule.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this schedule"})
+		return nil, false
+	}
+
+	return &schedule, true
+}
@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"go-deepsandbox/analysis"
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/middleware"
+	"go-deepsandbox/models"
+)
+
+// defaultCellWait is how long RunCell waits for a result before answering 202
+const defaultCellWait = 30 * time.Second
+
+// errSessionLimit is returned when a user already has their maximum number
+// of active sessions
+var errSessionLimit = errors.New("session limit reached")
+
+// SessionController handles interactive session endpoints
+type SessionController struct {
+	DB          *gorm.DB
+	Config      *config.Config
+	RedisClient *redis.Client
+	TaskQueue   *db.TaskQueue
+	Sessions    *db.SessionQueue
+}
+
+// NewSessionController creates a new session controller
+func NewSessionController(database *gorm.DB, redisClient *redis.Client, cfg *config.Config) *SessionController {
+	return &SessionController{
+		DB:          database,
+		Config:      cfg,
+		RedisClient: redisClient,
+		TaskQueue:   db.GetTaskQueue(redisClient),
+		Sessions:    db.NewSessionQueue(redisClient),
+	}
+}
+
+// CreateSession starts an interactive session with a dataset loaded
+func (sc *SessionController) CreateSession(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	// Parse request
+	var request models.SessionCreate
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify the dataset exists and user has access
+	var dataset models.Dataset
+	if err := sc.DB.Where("id = ?", request.DatasetID).First(&dataset).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+		return
+	}
+
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if dataset.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have access to this dataset"})
+		return
+	}
+
+	// Determine idle timeout
+	idleTimeout := sc.Config.SessionIdleTimeout
+	if request.IdleTimeout != nil && *request.IdleTimeout > 0 && *request.IdleTimeout < idleTimeout {
+		idleTimeout = *request.IdleTimeout
+	}
+
+	session := models.Session{
+		ID:           uuid.New().String(),
+		UserID:       user.ID,
+		DatasetID:    request.DatasetID,
+		Status:       models.SessionStarting,
+		IdleTimeout:  idleTimeout,
+		CellTimeout:  user.QuotaLimit("max_execution_time", sc.Config.ContainerTimeout),
+		LastActivity: db.CurrentTimestamp(),
+	}
+
+	// Check the user's session limit and record the session together. The
+	// user's row is locked so concurrent requests cannot both pass the check.
+	maxSessions := user.QuotaLimit("max_sessions", sc.Config.MaxSessionsPerUser)
+	err := sc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", user.ID).First(&models.User{}).Error; err != nil {
+			return err
+		}
+		var activeSessions int64
+		err := tx.Model(&models.Session{}).
+			Where("user_id = ? AND status IN ?", user.ID, []string{models.SessionStarting, models.SessionReady}).
+			Count(&activeSessions).Error
+		if err != nil {
+			return err
+		}
+		if activeSessions >= int64(maxSessions) {
+			return errSessionLimit
+		}
+		return tx.Create(&session).Error
+	})
+	if errors.Is(err, errSessionLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "You have reached your limit of " + strconv.Itoa(maxSessions) + " active sessions"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record session"})
+		return
+	}
+
+	if err := sc.Sessions.StartSession(session.ID); err != nil {
+		session.Status = models.SessionFailed
+		session.Error = "Failed to submit session to workers"
+		sc.DB.Save(&session)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit session to workers"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// ListSessions lists the current user's sessions, newest first. Closed and
+// failed sessions are included when all=true.
+func (sc *SessionController) ListSessions(c *gin.Context) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+	user := userInterface.(models.User)
+
+	query := sc.DB.Where("user_id = ?", user.ID)
+	if c.Query("all") != "true" {
+		query = query.Where("status IN ?", []string{models.SessionStarting, models.SessionReady})
+	}
+
+	var sessions []models.Session
+	if err := query.Order("created_at DESC").Limit(100).Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	if sessions == nil {
+		sessions = []models.Session{}
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// GetSession returns a session
+func (sc *SessionController) GetSession(c *gin.Context) {
+	session, ok := sc.loadSession(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// CloseSession stops a session's sandbox
+func (sc *SessionController) CloseSession(c *gin.Context) {
+	session, ok := sc.loadSession(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet("user").(models.User)
+
+	// Only one request can move the session out of an active status
+	closed := sc.DB.Model(&models.Session{}).
+		Where("id = ? AND status IN ?", session.ID, []string{models.SessionStarting, models.SessionReady}).
+		Updates(map[string]interface{}{
+			"status":    models.SessionClosed,
+			"error":     "Closed by " + user.Username,
+			"closed_at": db.CurrentTimestamp(),
+		})
+	if closed.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close session"})
+		return
+	}
+	if closed.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has already ended", "status": session.Status})
+		return
+	}
+
+	// Stop the sandbox if a worker already has the session
+	if removed, err := sc.Sessions.RemovePending(session.ID); err == nil && !removed && session.WorkerID != "" {
+		sc.TaskQueue.SendCancelRequest(session.WorkerID, db.CancelRequest{TaskID: session.ID, RequestedBy: user.Username})
+	}
+	sc.Sessions.FailPendingCells(session.ID, "Session closed")
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  models.SessionClosed,
+		"message": "Session has been closed",
+	})
+}
+
+// RunCell runs a code cell in a session. Variables defined by earlier cells
+// are still available. The response waits for the cell to finish for up to
+// wait seconds (30 by default) and otherwise returns 202 with the cell, which
+// can then be polled with GetCell.
+func (sc *SessionController) RunCell(c *gin.Context) {
+	session, ok := sc.loadSession(c)
+	if !ok {
+		return
+	}
+
+	if !models.IsActiveSession(session.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has ended", "status": session.Status})
+		return
+	}
+
+	// Parse request
+	var request models.CellRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkCode(c, sc.DB, sc.Config, []analysis.Source{{Code: request.Code}}, false) {
+		return
+	}
+
+	// Determine timeout
+	timeout := session.CellTimeout
+	if request.Timeout != nil && *request.Timeout > 0 && *request.Timeout < timeout {
+		timeout = *request.Timeout
+	}
+
+	cell := &models.SessionCell{
+		ID:          uuid.New().String(),
+		SessionID:   session.ID,
+		Code:        request.Code,
+		Timeout:     timeout,
+		Status:      models.StatusQueued,
+		SubmittedAt: db.CurrentTimestamp(),
+	}
+	if err := sc.Sessions.SubmitCell(cell); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit cell"})
+		return
+	}
+
+	// The session may have ended since it was loaded, after its waiting cells
+	// were failed, in which case nothing will ever run this cell
+	var current models.Session
+	if err := sc.DB.Select("status").Where("id = ?", session.ID).First(&current).Error; err != nil || !models.IsActiveSession(current.Status) {
+		sc.Sessions.FailPendingCells(session.ID, "Session has ended")
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has ended", "status": current.Status})
+		return
+	}
+
+	// The cell was queued, so it counts towards the quota
+	middleware.UseReservedExecution(c)
+
+	wait := defaultCellWait
+	if seconds, err := strconv.Atoi(c.Query("wait")); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	if limit := time.Duration(timeout+5) * time.Second; wait > limit {
+		wait = limit
+	}
+
+	latest, err := sc.Sessions.WaitCell(session.ID, cell.ID, wait)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get cell status"})
+		return
+	}
+
+	if !models.IsTerminalStatus(latest.Status) {
+		c.JSON(http.StatusAccepted, latest)
+		return
+	}
+	c.JSON(http.StatusOK, latest)
+}
+
+// GetCell returns a cell and, once it has run, its result
+func (sc *SessionController) GetCell(c *gin.Context) {
+	session, ok := sc.loadSession(c)
+	if !ok {
+		return
+	}
+
+	cell, err := sc.Sessions.GetCell(session.ID, c.Param("cell_id"))
+	if errors.Is(err, db.ErrCellNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cell not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get cell"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cell)
+}
+
+// loadSession loads the session named in the URL and checks that the user
+// may access it. It writes the error response and returns false otherwise.
+func (sc *SessionController) loadSession(c *gin.Context) (*models.Session, bool) {
+	// Get user from context
+	userInterface, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return nil, false
+	}
+	user := userInterface.(models.User)
+
+	var session models.Session
+	if err := sc.DB.Where("id = ?", c.Param("session_id")).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return nil, false
+	}
+
+	// Check permissions
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+
+	if session.UserID != user.ID && !isAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this session"})
+		return nil, false
+	}
+
+	return &session, true
+}
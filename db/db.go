@@ -28,6 +28,15 @@ func MigrateDB(db *gorm.DB) error {
 		&models.User{},
 		&models.Dataset{},
 		&models.CodeExecution{},
+		&models.ExecutionDataset{},
+		&models.ExecutionArtifact{},
+		&models.Session{},
+		&models.Schedule{},
+		&models.Pipeline{},
+		&models.PipelineStep{},
+		&models.CodePolicy{},
+		&models.PackagePolicy{},
+		&models.Runtime{},
 	)
 }
 
@@ -71,48 +80,3 @@ func InitRedis(cfg *config.Config) (*redis.Client, error) {
 func CurrentTimestamp() float64 {
 	return float64(time.Now().UnixNano()) / 1e9
 }
-
-// TaskQueue handles task queue operations
-type TaskQueue struct {
-	Redis *redis.Client
-}
-
-// NewTaskQueue creates a new task queue
-func NewTaskQueue(redisClient *redis.Client) *TaskQueue {
-	return &TaskQueue{
-		Redis: redisClient,
-	}
-}
-
-// GetTaskQueue returns a task queue instance
-func GetTaskQueue(redisClient *redis.Client) *TaskQueue {
-	return NewTaskQueue(redisClient)
-}
-
-// SubmitCodeExecution submits a new code execution task to the queue
-func (tq *TaskQueue) SubmitCodeExecution(datasetID, code, userID string, timeout int, priority string) (string, error) {
-	// In a real implementation, this would interact with a task queue system
-	// For this example, we'll just create a task ID
-	taskID := fmt.Sprintf("task-%d", time.Now().UnixNano())
-	
-	// Here you would actually submit the task to a queue system
-	// For example, using Redis list operations or a dedicated task queue
-	
-	return taskID, nil
-}
-
-// GetTaskStatus gets the status of a task
-func (tq *TaskQueue) GetTaskStatus(taskID string) (*models.TaskStatus, error) {
-	// In a real implementation, this would fetch the task status from Redis or the database
-	return &models.TaskStatus{
-		TaskID:   taskID,
-		Status:   "pending",
-		Progress: 0,
-	}, nil
-}
-
-// CancelTask cancels a task
-func (tq *TaskQueue) CancelTask(taskID, userID string) (bool, error) {
-	// In a real implementation, this would cancel the task in the queue
-	return true, nil
-} 
\ No newline at end of file
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/models"
+)
+
+// SubmitExecution records a new execution as queued, together with its
+// dataset links, and queues it for the workers. An execution that could not
+// be queued is kept as failed.
+func SubmitExecution(database *gorm.DB, taskQueue *TaskQueue, execution *models.CodeExecution) error {
+	if execution.ID == "" {
+		execution.ID = uuid.New().String()
+	}
+	execution.Status = models.StatusQueued
+
+	// Record the runtime the execution runs with
+	if execution.Runtime == "" {
+		runtime, err := ResolveRuntime(database, "")
+		if err != nil {
+			return fmt.Errorf("failed to resolve runtime: %w", err)
+		}
+		execution.Runtime = runtime.Name
+	}
+
+	if err := database.Create(execution).Error; err != nil {
+		return fmt.Errorf("failed to record execution: %w", err)
+	}
+
+	_, err := taskQueue.SubmitCodeExecution(TaskForExecution(execution))
+	if err != nil {
+		execution.Status = models.StatusFailed
+		execution.EndTime = CurrentTimestamp()
+		execution.Error = "Failed to submit task to queue"
+		database.Model(execution).Updates(map[string]interface{}{
+			"status":   execution.Status,
+			"end_time": execution.EndTime,
+			"error":    execution.Error,
+		})
+		return err
+	}
+	return nil
+}
+
+// TaskForExecution returns the queue task that runs an execution. The
+// execution ID doubles as the task ID. Datasets are taken from the
+// execution's dataset links, which must be loaded.
+func TaskForExecution(execution *models.CodeExecution) *Task {
+	datasets := make(map[string]string, len(execution.Datasets))
+	for _, link := range execution.Datasets {
+		datasets[link.Alias] = link.DatasetID
+	}
+
+	return &Task{
+		ID:           execution.ID,
+		DatasetID:    execution.DatasetID,
+		Datasets:     datasets,
+		Code:         execution.Code,
+		Kind:         execution.Kind,
+		Runtime:      execution.Runtime,
+		Requirements: execution.Requirements,
+		UserID:       execution.UserID,
+		Timeout:      execution.Timeout,
+		Priority:     execution.Priority,
+	}
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// Pending tasks are kept in one sub-queue per user and priority class. Each
+// class has a ring of the users with pending tasks, and workers take one task
+// from the next user in the ring so that a user with a large backlog cannot
+// starve everyone else. Higher classes are always served first.
+const (
+	queueKeyPrefix = "deepsandbox:queue:"
+	readyQueueKey  = "deepsandbox:queue:ready"
+)
+
+// userRingKey returns the key of the round-robin ring of users for a priority class
+func userRingKey(priority string) string {
+	return queueKeyPrefix + priority + ":users"
+}
+
+// userQueueKey returns the key of a user's sub-queue for a priority class
+func userQueueKey(priority, userID string) string {
+	return queueKeyPrefix + priority + ":user:" + userID
+}
+
+// enqueueScript appends a task to its user's sub-queue, adds the user to the
+// ring when the sub-queue was empty and wakes up one waiting worker
+var enqueueScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('LREM', KEYS[1], 0, ARGV[2])
+	redis.call('LPUSH', KEYS[1], ARGV[2])
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+redis.call('LPUSH', KEYS[3], 1)
+return 1
+`)
+
+// dequeueScript takes the oldest task of the user ARGV[1] at the tail of the
+// ring KEYS[1], whose sub-queue is KEYS[2], moves it onto the processing list
+// and leases it to the worker ARGV[3] until ARGV[4]. The user is rotated to
+// the back of the ring, or dropped from it once their sub-queue is empty.
+// ARGV[2] is "1" when the caller did not already consume a wake-up token. It
+// returns false, changing nothing, when another worker served the user first.
+var dequeueScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], -1) ~= ARGV[1] then
+	return false
+end
+redis.call('RPOPLPUSH', KEYS[1], KEYS[1])
+local taskID = redis.call('RPOP', KEYS[2])
+if redis.call('LLEN', KEYS[2]) == 0 then
+	redis.call('LREM', KEYS[1], 0, ARGV[1])
+end
+if not taskID then
+	return ''
+end
+redis.call('LPUSH', KEYS[3], taskID)
+redis.call('ZADD', KEYS[5], ARGV[4], taskID)
+redis.call('HSET', KEYS[6], taskID, ARGV[3])
+if ARGV[2] == '1' then
+	redis.call('RPOP', KEYS[4])
+end
+return taskID
+`)
+
+// popNext moves the next scheduled task onto the processing list, leased to
+// the worker for the lease duration, and returns its ID, or an empty string
+// when nothing is pending. The next user is read from the highest non-empty
+// ring before the script runs, since a script may only touch the keys it is
+// given; the script checks they were not served in between.
+func (tq *TaskQueue) popNext(ctx context.Context, consumeToken bool, workerID string, lease time.Duration) (string, error) {
+	token := "0"
+	if consumeToken {
+		token = "1"
+	}
+
+	for _, priority := range models.Priorities {
+		ring := userRingKey(priority)
+		for {
+			userID, err := tq.Redis.LIndex(ctx, ring, -1).Result()
+			if errors.Is(err, redis.Nil) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+
+			keys := []string{ring, userQueueKey(priority, userID), processingQueueKey, readyQueueKey, leasesKey, leaseOwnersKey}
+			taskID, err := dequeueScript.Run(ctx, tq.Redis, keys, userID, token, workerID, leaseExpiry(lease)).Text()
+			if errors.Is(err, redis.Nil) || (err == nil && taskID == "") {
+				// Served by another worker, or left in the ring with an
+				// empty sub-queue; either way the ring has moved on
+				continue
+			}
+			return taskID, err
+		}
+	}
+	return "", nil
+}
+
+// UserQueuePosition describes where a user's pending tasks of one priority
+// class sit in the dequeue order. Positions are 1-based and count every
+// pending task that will be dequeued first.
+type UserQueuePosition struct {
+	UserID       string `json:"user_id"`
+	Priority     string `json:"priority"`
+	Pending      int64  `json:"pending"`
+	NextPosition int64  `json:"next_position"`
+	LastPosition int64  `json:"last_position"`
+}
+
+// QueuePositions returns the queue position of every user with pending
+// tasks, in dequeue order. The snapshot is not atomic, so positions are
+// approximate while the queue is changing.
+func (tq *TaskQueue) QueuePositions() ([]UserQueuePosition, error) {
+	ctx := context.Background()
+
+	var positions []UserQueuePosition
+	var offset int64
+	for _, priority := range models.Priorities {
+		ring, err := tq.Redis.LRange(ctx, userRingKey(priority), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// The ring is served from its tail
+		users := make([]string, 0, len(ring))
+		for i := len(ring) - 1; i >= 0; i-- {
+			users = append(users, ring[i])
+		}
+
+		lengths := make([]*redis.IntCmd, len(users))
+		_, err = tq.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, userID := range users {
+				lengths[i] = pipe.LLen(ctx, userQueueKey(priority, userID))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		pending := make([]int64, len(users))
+		var classTotal int64
+		for i := range users {
+			pending[i] = lengths[i].Val()
+			classTotal += pending[i]
+		}
+
+		for i, userID := range users {
+			if pending[i] == 0 {
+				continue
+			}
+			positions = append(positions, UserQueuePosition{
+				UserID:       userID,
+				Priority:     priority,
+				Pending:      pending[i],
+				NextPosition: offset + roundRobinPosition(pending, i, 0),
+				LastPosition: offset + roundRobinPosition(pending, i, pending[i]-1),
+			})
+		}
+		offset += classTotal
+	}
+
+	return positions, nil
+}
+
+// roundRobinPosition returns the 1-based dequeue position of the k-th task of
+// the user at index u of a ring served in index order, given each user's
+// number of pending tasks
+func roundRobinPosition(pending []int64, u int, k int64) int64 {
+	position := k + 1
+	for v, n := range pending {
+		if v == u {
+			continue
+		}
+		// Users ahead of u in the ring get one more turn before u's k-th task
+		turns := k
+		if v < u {
+			turns++
+		}
+		if n < turns {
+			turns = n
+		}
+		position += turns
+	}
+	return position
+}
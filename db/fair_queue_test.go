@@ -0,0 +1,113 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// newTestQueue returns a task queue backed by an empty miniredis server
+func newTestQueue(t *testing.T) *TaskQueue {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewTaskQueue(client)
+}
+
+// submitTask queues a task for a user
+func submitTask(t *testing.T, tq *TaskQueue, id, userID, priority string) {
+	t.Helper()
+
+	if _, err := tq.SubmitCodeExecution(&Task{ID: id, UserID: userID, Priority: priority, Code: "print(1)"}); err != nil {
+		t.Fatalf("failed to submit task %s: %v", id, err)
+	}
+}
+
+// dequeueN takes n tasks and returns their IDs in order
+func dequeueN(t *testing.T, tq *TaskQueue, n int) []string {
+	t.Helper()
+
+	var ids []string
+	for len(ids) < n {
+		task, err := tq.Dequeue(context.Background(), "worker-1", time.Minute, time.Second)
+		if err != nil {
+			t.Fatalf("failed to dequeue: %v", err)
+		}
+		if task == nil {
+			t.Fatalf("dequeued %v, then the queue was empty", ids)
+		}
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestDequeueRoundRobinAcrossUsers(t *testing.T) {
+	tq := newTestQueue(t)
+	for _, id := range []string{"a1", "a2", "a3", "a4"} {
+		submitTask(t, tq, id, "alice", models.PriorityNormal)
+	}
+	submitTask(t, tq, "b1", "bob", models.PriorityNormal)
+	submitTask(t, tq, "b2", "bob", models.PriorityNormal)
+	submitTask(t, tq, "c1", "carol", models.PriorityNormal)
+
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3", "a4"}
+	got := dequeueN(t, tq, len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dequeued %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDequeueHigherPriorityFirst(t *testing.T) {
+	tq := newTestQueue(t)
+	submitTask(t, tq, "low", "alice", models.PriorityLow)
+	submitTask(t, tq, "normal", "alice", models.PriorityNormal)
+	submitTask(t, tq, "high", "bob", models.PriorityHigh)
+
+	want := []string{"high", "normal", "low"}
+	got := dequeueN(t, tq, len(want))
+	if got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("dequeued %v, want %v", got, want)
+	}
+}
+
+func TestQueuePositionsMatchDequeueOrder(t *testing.T) {
+	tq := newTestQueue(t)
+	for _, id := range []string{"a1", "a2", "a3"} {
+		submitTask(t, tq, id, "alice", models.PriorityNormal)
+	}
+	submitTask(t, tq, "b1", "bob", models.PriorityNormal)
+	submitTask(t, tq, "c1", "carol", models.PriorityHigh)
+
+	positions, err := tq.QueuePositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := dequeueN(t, tq, 5)
+	position := map[string]int64{}
+	for i, id := range order {
+		position[id] = int64(i + 1)
+	}
+
+	want := map[string][2]int64{
+		"alice": {position["a1"], position["a3"]},
+		"bob":   {position["b1"], position["b1"]},
+		"carol": {position["c1"], position["c1"]},
+	}
+	if len(positions) != len(want) {
+		t.Fatalf("positions = %+v, want one per user", positions)
+	}
+	for _, p := range positions {
+		if got := [2]int64{p.NextPosition, p.LastPosition}; got != want[p.UserID] {
+			t.Errorf("%s positions = %v, want %v from dequeue order %v", p.UserID, got, want[p.UserID], order)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// leasesKey is a sorted set of the tasks held by workers, scored by when
+// their lease expires. A worker that stops renewing its leases is presumed
+// dead and its tasks are recovered by the reaper.
+const leasesKey = "deepsandbox:leases"
+
+// leaseOwnersKey is a hash of the worker holding each leased task
+const leaseOwnersKey = "deepsandbox:lease-owners"
+
+// reconcileLockKey is held by the worker reconciling the database with the
+// queue at startup
+const reconcileLockKey = "deepsandbox:reconcile:lock"
+
+// leaseExpiry returns when a lease taken now for the duration expires, in
+// Unix seconds
+func leaseExpiry(lease time.Duration) float64 {
+	return CurrentTimestamp() + lease.Seconds()
+}
+
+// renewScript extends the leases of the tasks ARGV[3..] held by the worker
+// ARGV[1] until ARGV[2]. It returns the tasks whose lease the worker lost.
+var renewScript = redis.NewScript(`
+local lost = {}
+for i = 3, #ARGV do
+	local taskID = ARGV[i]
+	if redis.call('HGET', KEYS[2], taskID) == ARGV[1] and redis.call('ZSCORE', KEYS[1], taskID) then
+		redis.call('ZADD', KEYS[1], ARGV[2], taskID)
+	else
+		table.insert(lost, taskID)
+	end
+end
+return lost
+`)
+
+// RenewLeases extends the worker's leases on the tasks it holds and returns
+// the tasks whose lease it lost, which must no longer be worked on
+func (tq *TaskQueue) RenewLeases(workerID string, taskIDs []string, lease time.Duration) ([]string, error) {
+	if len(taskIDs) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{workerID, leaseExpiry(lease)}
+	for _, taskID := range taskIDs {
+		args = append(args, taskID)
+	}
+	return renewScript.Run(context.Background(), tq.Redis, []string{leasesKey, leaseOwnersKey}, args...).StringSlice()
+}
+
+// claimScript removes up to ARGV[2] leases that expired by ARGV[1] and
+// returns each task followed by the worker that held it
+var claimScript = redis.NewScript(`
+local claimed = {}
+for _, taskID in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])) do
+	redis.call('ZREM', KEYS[1], taskID)
+	table.insert(claimed, taskID)
+	table.insert(claimed, redis.call('HGET', KEYS[2], taskID) or '')
+	redis.call('HDEL', KEYS[2], taskID)
+end
+return claimed
+`)
+
+// ClaimExpiredLeases removes up to limit expired leases and returns the
+// tasks they were on, together with the worker that held each. Every expired
+// lease is claimed by exactly one caller, which must recover its task.
+func (tq *TaskQueue) ClaimExpiredLeases(limit int64) (map[string]string, error) {
+	reply, err := claimScript.Run(context.Background(), tq.Redis, []string{leasesKey, leaseOwnersKey},
+		strconv.FormatFloat(CurrentTimestamp(), 'f', -1, 64), limit).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := make(map[string]string, len(reply)/2)
+	for i := 0; i+1 < len(reply); i += 2 {
+		claimed[reply[i]] = reply[i+1]
+	}
+	return claimed, nil
+}
+
+// finishScript records the terminal state of the task ARGV[1] and releases
+// it, provided the worker ARGV[2] still holds its lease
+var finishScript = redis.NewScript(`
+if redis.call('HGET', KEYS[4], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[3], 'end_time', ARGV[4], 'results', ARGV[5], 'error', ARGV[6])
+redis.call('EXPIRE', KEYS[1], ARGV[7])
+redis.call('LREM', KEYS[2], 0, ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+return 1
+`)
+
+// FinishLeased records the terminal state of a task, like MarkFinished, and
+// releases it, like Ack, in one step. It returns false, recording nothing,
+// when the worker no longer holds the task's lease because the task was
+// recovered; its outcome then belongs to whoever recovered it.
+func (tq *TaskQueue) FinishLeased(taskID, workerID, status string, endTime float64, results []byte, errMsg string) (bool, error) {
+	finished, err := finishScript.Run(context.Background(), tq.Redis,
+		[]string{taskKey(taskID), processingQueueKey, leasesKey, leaseOwnersKey},
+		taskID, workerID, status, endTime, results, errMsg, int64(taskRetention/time.Second)).Int()
+	if err != nil {
+		return false, err
+	}
+	return finished == 1, nil
+}
+
+// HasLease reports whether a worker holds the task, expired leases included
+func (tq *TaskQueue) HasLease(taskID string) (bool, error) {
+	err := tq.Redis.ZScore(context.Background(), leasesKey, taskID).Err()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnleasedProcessing returns the tasks on the processing list no worker
+// holds a lease on, left behind by workers that died before leases existed
+func (tq *TaskQueue) UnleasedProcessing() ([]string, error) {
+	ctx := context.Background()
+	taskIDs, err := tq.Redis.LRange(ctx, processingQueueKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var unleased []string
+	for _, taskID := range taskIDs {
+		leased, err := tq.HasLease(taskID)
+		if err != nil {
+			return nil, err
+		}
+		if !leased {
+			unleased = append(unleased, taskID)
+		}
+	}
+	return unleased, nil
+}
+
+// IsPending reports whether the task is waiting in its user's sub-queue or
+// held by a worker
+func (tq *TaskQueue) IsPending(taskID, priority, userID string) (bool, error) {
+	if leased, err := tq.HasLease(taskID); err != nil || leased {
+		return leased, err
+	}
+
+	ctx := context.Background()
+	if priority == "" {
+		priority = models.PriorityNormal
+	}
+	for _, key := range []string{userQueueKey(priority, userID), processingQueueKey} {
+		err := tq.Redis.LPos(ctx, key, taskID, redis.LPosArgs{}).Err()
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Release removes a task from the processing list and drops its lease,
+// whichever worker held it, once the task has been recovered
+func (tq *TaskQueue) Release(taskID string) error {
+	ctx := context.Background()
+	_, err := tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingQueueKey, 0, taskID)
+		pipe.ZRem(ctx, leasesKey, taskID)
+		pipe.HDel(ctx, leaseOwnersKey, taskID)
+		return nil
+	})
+	return err
+}
+
+// Requeue puts a task that was being worked on back into its user's
+// sub-queue, dropping what is known about the previous attempt
+func (tq *TaskQueue) Requeue(task *Task) error {
+	ctx := context.Background()
+	_, err := tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, processingQueueKey, 0, task.ID)
+		pipe.ZRem(ctx, leasesKey, task.ID)
+		pipe.HDel(ctx, leaseOwnersKey, task.ID)
+		pipe.HDel(ctx, taskKey(task.ID), "worker", "start_time", "end_time", "results", "error")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tq.SubmitCodeExecution(task)
+	return err
+}
+
+// LockReconcile takes the lock that lets one worker at a time reconcile the
+// database with the queue. It returns false when another worker holds it.
+func (tq *TaskQueue) LockReconcile(workerID string, ttl time.Duration) (bool, error) {
+	return tq.Redis.SetNX(context.Background(), reconcileLockKey, workerID, ttl).Result()
+}
+
+// unlockReconcileScript releases the reconcile lock if the caller holds it
+var unlockReconcileScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// UnlockReconcile releases the reconcile lock held by the worker
+func (tq *TaskQueue) UnlockReconcile(workerID string) error {
+	return unlockReconcileScript.Run(context.Background(), tq.Redis, []string{reconcileLockKey}, workerID).Err()
+}
+
+// DeregisterWorker removes a stopping worker's status and warm pool
+// statistics so it is no longer reported as live
+func (tq *TaskQueue) DeregisterWorker(workerID string) error {
+	ctx := context.Background()
+	_, err := tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, workerStatusKey(workerID), warmPoolKey(workerID))
+		pipe.SRem(ctx, workersKey, workerID)
+		pipe.SRem(ctx, warmPoolsKey, workerID)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-deepsandbox/models"
+)
+
+// lease dequeues the next task for the worker with the given lease
+func lease(t *testing.T, tq *TaskQueue, workerID string, duration time.Duration) string {
+	t.Helper()
+
+	task, err := tq.Dequeue(context.Background(), workerID, duration, time.Second)
+	if err != nil {
+		t.Fatalf("failed to dequeue: %v", err)
+	}
+	if task == nil {
+		t.Fatal("no task was queued")
+	}
+	return task.ID
+}
+
+func TestRenewLeases(t *testing.T) {
+	tq := newTestQueue(t)
+	submitTask(t, tq, "a1", "alice", models.PriorityNormal)
+	taskID := lease(t, tq, "worker-1", time.Minute)
+
+	lost, err := tq.RenewLeases("worker-1", []string{taskID}, time.Minute)
+	if err != nil || len(lost) != 0 {
+		t.Errorf("RenewLeases by the holder = %v, %v; want no lost leases", lost, err)
+	}
+	lost, err = tq.RenewLeases("worker-2", []string{taskID}, time.Minute)
+	if err != nil || len(lost) != 1 || lost[0] != taskID {
+		t.Errorf("RenewLeases by another worker = %v, %v; want the lease lost", lost, err)
+	}
+}
+
+func TestClaimExpiredLeases(t *testing.T) {
+	tq := newTestQueue(t)
+	submitTask(t, tq, "expired", "alice", models.PriorityNormal)
+	submitTask(t, tq, "live", "bob", models.PriorityNormal)
+	lease(t, tq, "worker-1", -time.Second)
+	lease(t, tq, "worker-2", time.Minute)
+
+	claimed, err := tq.ClaimExpiredLeases(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed["expired"] != "worker-1" {
+		t.Fatalf("claimed %v, want the expired task held by worker-1", claimed)
+	}
+	if again, err := tq.ClaimExpiredLeases(10); err != nil || len(again) != 0 {
+		t.Errorf("second claim = %v, %v; want nothing left to claim", again, err)
+	}
+
+	// The worker that held the lease finds it lost and cannot ack the task
+	// once another worker has it
+	lost, err := tq.RenewLeases("worker-1", []string{"expired"}, time.Minute)
+	if err != nil || len(lost) != 1 {
+		t.Errorf("RenewLeases after the claim = %v, %v; want the lease lost", lost, err)
+	}
+}
+
+func TestAckIgnoresFormerHolder(t *testing.T) {
+	tq := newTestQueue(t)
+	submitTask(t, tq, "a1", "alice", models.PriorityNormal)
+	lease(t, tq, "worker-1", -time.Second)
+	if _, err := tq.ClaimExpiredLeases(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.Requeue(&Task{ID: "a1", UserID: "alice", Priority: models.PriorityNormal, Code: "print(1)"}); err != nil {
+		t.Fatal(err)
+	}
+	lease(t, tq, "worker-2", time.Minute)
+
+	if err := tq.Ack("a1", "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	if leased, err := tq.HasLease("a1"); err != nil || !leased {
+		t.Errorf("HasLease = %v, %v; want worker-2 to keep its lease", leased, err)
+	}
+	if err := tq.Ack("a1", "worker-2"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := tq.IsPending("a1", models.PriorityNormal, "alice"); err != nil || pending {
+		t.Errorf("IsPending after ack = %v, %v; want the task released", pending, err)
+	}
+}
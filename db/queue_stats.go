@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/models"
+)
+
+// workersKey is the set of workers that have published their status
+const workersKey = "deepsandbox:workers"
+
+// workerStatusTTL is how long a worker's published status is reported
+// after it stops publishing it
+const workerStatusTTL = 30 * time.Second
+
+// workerStatusKey returns the key of a worker's published status
+func workerStatusKey(workerID string) string {
+	return "deepsandbox:worker:" + workerID + ":status"
+}
+
+// WorkerStatus is what a worker publishes about itself for the queue status
+type WorkerStatus struct {
+	WorkerID  string  `json:"worker_id"`
+	Slots     int     `json:"slots"`   // tasks it runs at once
+	Running   int     `json:"running"` // tasks and sessions it is running
+	StartedAt float64 `json:"started_at"`
+	UpdatedAt float64 `json:"updated_at"`
+}
+
+// PublishWorkerStatus stores a worker's status for the queue status
+func (tq *TaskQueue) PublishWorkerStatus(status *WorkerStatus) error {
+	ctx := context.Background()
+	status.UpdatedAt = CurrentTimestamp()
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	_, err = tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, workerStatusKey(status.WorkerID), data, workerStatusTTL)
+		pipe.SAdd(ctx, workersKey, status.WorkerID)
+		return nil
+	})
+	return err
+}
+
+// GetWorkerStatuses returns the statuses of the workers that published them
+// recently, by worker ID. Workers that stopped publishing are forgotten.
+func (tq *TaskQueue) GetWorkerStatuses() (map[string]WorkerStatus, error) {
+	ctx := context.Background()
+	workerIDs, err := tq.Redis.SMembers(ctx, workersKey).Result()
+	if err != nil || len(workerIDs) == 0 {
+		return map[string]WorkerStatus{}, err
+	}
+
+	keys := make([]string, len(workerIDs))
+	for i, workerID := range workerIDs {
+		keys[i] = workerStatusKey(workerID)
+	}
+	values, err := tq.Redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]WorkerStatus, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			tq.Redis.SRem(ctx, workersKey, workerIDs[i])
+			continue
+		}
+		var status WorkerStatus
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			continue
+		}
+		statuses[status.WorkerID] = status
+	}
+	return statuses, nil
+}
+
+// PriorityDepth describes the pending tasks of one priority class
+type PriorityDepth struct {
+	Priority string `json:"priority"`
+	Depth    int64  `json:"depth"`
+	// OldestEnqueuedAt is when the longest waiting task was queued; 0 when
+	// the class is empty
+	OldestEnqueuedAt float64 `json:"oldest_enqueued_at,omitempty"`
+}
+
+// QueueDepths returns the pending tasks of every priority class, in the
+// order the classes are served. Like QueuePositions, the snapshot is not
+// atomic.
+func (tq *TaskQueue) QueueDepths() ([]PriorityDepth, error) {
+	ctx := context.Background()
+
+	depths := make([]PriorityDepth, 0, len(models.Priorities))
+	for _, priority := range models.Priorities {
+		users, err := tq.Redis.LRange(ctx, userRingKey(priority), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// Sub-queues are pushed on the left, so each user's oldest task is last
+		lengths := make([]*redis.IntCmd, len(users))
+		oldest := make([]*redis.StringCmd, len(users))
+		_, err = tq.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, userID := range users {
+				lengths[i] = pipe.LLen(ctx, userQueueKey(priority, userID))
+				oldest[i] = pipe.LIndex(ctx, userQueueKey(priority, userID), -1)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		depth := PriorityDepth{Priority: priority}
+		enqueuedAt := make([]*redis.StringCmd, 0, len(users))
+		_, err = tq.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := range users {
+				depth.Depth += lengths[i].Val()
+				if taskID := oldest[i].Val(); taskID != "" {
+					enqueuedAt = append(enqueuedAt, pipe.HGet(ctx, taskKey(taskID), "enqueued_at"))
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		for _, cmd := range enqueuedAt {
+			at, err := strconv.ParseFloat(cmd.Val(), 64)
+			if err != nil {
+				continue
+			}
+			if depth.OldestEnqueuedAt == 0 || at < depth.OldestEnqueuedAt {
+				depth.OldestEnqueuedAt = at
+			}
+		}
+		depths = append(depths, depth)
+	}
+	return depths, nil
+}
+
+// DurationStats summarizes durations in seconds
+type DurationStats struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+}
+
+// ExecutionWindowStats describes the executions of a time window
+type ExecutionWindowStats struct {
+	Running  int64            `json:"running"`   // executions running now
+	Finished map[string]int64 `json:"finished"`  // executions that finished in the window, by status
+	WaitTime DurationStats    `json:"wait_time"` // from submission until start, for executions started in the window
+	RunTime  DurationStats    `json:"run_time"`  // from start until end, for executions finished in the window
+	// BusySeconds is how long each worker spent running executions within
+	// the window, by worker ID
+	BusySeconds map[string]float64 `json:"-"`
+}
+
+// ExecutionStats returns execution counts, wait and run time percentiles
+// and per-worker busy time between from and to. Results served from the
+// result cache are counted but never ran, so they are left out of the
+// durations.
+func ExecutionStats(database *gorm.DB, from, to time.Time) (*ExecutionWindowStats, error) {
+	start, end := float64(from.UnixNano())/1e9, float64(to.UnixNano())/1e9
+	stats := &ExecutionWindowStats{
+		Finished:    map[string]int64{},
+		BusySeconds: map[string]float64{},
+	}
+
+	if err := database.Model(&models.CodeExecution{}).
+		Where("status = ?", models.StatusRunning).
+		Count(&stats.Running).Error; err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		Status string
+		Count  int64
+	}
+	if err := database.Model(&models.CodeExecution{}).
+		Select("status, COUNT(*) AS count").
+		Where("status IN ? AND end_time >= ? AND end_time < ?",
+			[]string{models.StatusCompleted, models.StatusFailed, models.StatusCancelled, models.StatusTimedOut}, start, end).
+		Group("status").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		stats.Finished[count.Status] = count.Count
+	}
+
+	ran := "COALESCE(cached_from, '') = '' AND start_time > 0"
+	if err := database.Raw(`SELECT COUNT(*) AS count,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY start_time - EXTRACT(EPOCH FROM created_at)), 0) AS p50,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY start_time - EXTRACT(EPOCH FROM created_at)), 0) AS p95
+		FROM code_executions WHERE `+ran+` AND start_time >= ? AND start_time < ?`, start, end).
+		Scan(&stats.WaitTime).Error; err != nil {
+		return nil, err
+	}
+	if err := database.Raw(`SELECT COUNT(*) AS count,
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY end_time - start_time), 0) AS p50,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY end_time - start_time), 0) AS p95
+		FROM code_executions WHERE `+ran+` AND end_time > 0 AND end_time >= ? AND end_time < ?`, start, end).
+		Scan(&stats.RunTime).Error; err != nil {
+		return nil, err
+	}
+
+	// Executions still running are busy until now, or the end of the window
+	now := CurrentTimestamp()
+	var busy []struct {
+		WorkerID string
+		Seconds  float64
+	}
+	if err := database.Raw(`SELECT worker_id, SUM(GREATEST(LEAST(CASE WHEN status = ? THEN ? ELSE end_time END, ?) - GREATEST(start_time, ?), 0)) AS seconds
+		FROM code_executions
+		WHERE `+ran+` AND COALESCE(worker_id, '') <> '' AND start_time < ? AND (status = ? OR end_time >= ?)
+		GROUP BY worker_id`,
+		models.StatusRunning, now, end, start, end, models.StatusRunning, start).
+		Scan(&busy).Error; err != nil {
+		return nil, err
+	}
+	for _, worker := range busy {
+		stats.BusySeconds[worker.WorkerID] = worker.Seconds
+	}
+
+	return stats, nil
+}
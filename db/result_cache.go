@@ -0,0 +1,100 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+
+	"go-deepsandbox/models"
+)
+
+// HashFile returns the hex encoded SHA-256 of a file's content
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DatasetHashes returns the content hashes of the datasets in aliases, by
+// alias. Datasets uploaded before hashes were recorded are hashed once and
+// their hash is stored.
+func DatasetHashes(database *gorm.DB, datasetsDir string, aliases map[string]string) (map[string]string, error) {
+	hashes := make(map[string]string, len(aliases))
+	for alias, datasetID := range aliases {
+		var dataset models.Dataset
+		if err := database.Where("id = ?", datasetID).First(&dataset).Error; err != nil {
+			return nil, fmt.Errorf("dataset %s not found: %w", datasetID, err)
+		}
+		if dataset.ContentHash == "" {
+			hash, err := HashFile(dataset.FilePath(datasetsDir))
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash dataset %s: %w", datasetID, err)
+			}
+			dataset.ContentHash = hash
+			database.Model(&dataset).Update("content_hash", hash)
+		}
+		hashes[alias] = dataset.ContentHash
+	}
+	return hashes, nil
+}
+
+// ResultCacheKey identifies the result of running code: what it runs, the
+// runtime and packages it runs with, its timeout, and the datasets it loads
+// by alias along with their content. Executions with equal keys produce the
+// same result unless the code itself is not deterministic.
+func ResultCacheKey(kind, code string, runtime *models.Runtime, requirements []string, timeout int, aliases, datasetHashes map[string]string) string {
+	// Maps are encoded with sorted keys, so the key is stable
+	encoded, _ := json.Marshal(map[string]interface{}{
+		"kind":         kind,
+		"code":         code,
+		"runtime":      []interface{}{runtime.Name, runtime.Language, runtime.Image, []string(runtime.Command)},
+		"requirements": requirements,
+		"timeout":      timeout,
+		"aliases":      aliases,
+		"datasets":     datasetHashes,
+	})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindCachedResult returns the user's latest execution with the cache key
+// that completed within ttl, or nil when there is none
+func FindCachedResult(database *gorm.DB, userID, key string, ttl time.Duration) (*models.CodeExecution, error) {
+	var execution models.CodeExecution
+	err := database.
+		Where("user_id = ? AND cache_key = ? AND status = ? AND end_time >= ?",
+			userID, key, models.StatusCompleted, CurrentTimestamp()-ttl.Seconds()).
+		Order("end_time DESC").
+		First(&execution).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &execution, nil
+}
+
+// InvalidateCachedResults stops the results of executions that loaded the
+// dataset from being reused, after it was replaced or deleted
+func InvalidateCachedResults(database *gorm.DB, datasetID string) error {
+	return database.Model(&models.CodeExecution{}).
+		Where("cache_key <> '' AND id IN (?)",
+			database.Model(&models.ExecutionDataset{}).Select("execution_id").Where("dataset_id = ?", datasetID)).
+		Update("cache_key", "").Error
+}
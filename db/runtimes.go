@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"go-deepsandbox/models"
+)
+
+// ErrUnknownRuntime is returned for runtimes that are not registered or are
+// disabled
+var ErrUnknownRuntime = errors.New("unknown runtime")
+
+// ResolveRuntime returns the runtime an execution asking for name runs
+// with. An empty name is the default runtime: the registered runtime marked
+// default, or the builtin Python runtime, whose image and command are empty
+// so the executor's own settings apply.
+func ResolveRuntime(database *gorm.DB, name string) (*models.Runtime, error) {
+	var runtime models.Runtime
+	if name == "" {
+		err := database.Where("is_default = ? AND enabled = ?", true, true).First(&runtime).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return builtinRuntime(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &runtime, nil
+	}
+
+	if name == models.BuiltinRuntime {
+		return builtinRuntime(), nil
+	}
+
+	err := database.Where("name = ? AND enabled = ?", name, true).First(&runtime).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRuntime, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &runtime, nil
+}
+
+// builtinRuntime returns the runtime configured by CONTAINER_IMAGE and LOCAL_PYTHON
+func builtinRuntime() *models.Runtime {
+	return &models.Runtime{
+		Name:     models.BuiltinRuntime,
+		Language: models.LanguagePython,
+		Enabled:  true,
+	}
+}
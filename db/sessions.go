@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// Redis keys used to hand sessions and their cells to workers
+const (
+	pendingSessionsKey = "deepsandbox:sessions:pending"
+	sessionKeyPrefix   = "deepsandbox:session:"
+)
+
+// cellRetention is how long a cell and its result are kept in Redis
+const cellRetention = 24 * time.Hour
+
+// ErrCellNotFound is returned when a cell does not exist or has expired
+var ErrCellNotFound = errors.New("cell not found")
+
+// sessionCellsKey returns the key of the list of cells waiting to run in a session
+func sessionCellsKey(sessionID string) string {
+	return sessionKeyPrefix + sessionID + ":cells"
+}
+
+// sessionCellKey returns the key holding a cell and its result
+func sessionCellKey(sessionID, cellID string) string {
+	return sessionKeyPrefix + sessionID + ":cell:" + cellID
+}
+
+// SessionQueue hands new sessions to workers and routes code cells to the
+// worker hosting their session
+type SessionQueue struct {
+	Redis *redis.Client
+}
+
+// NewSessionQueue creates a new session queue
+func NewSessionQueue(redisClient *redis.Client) *SessionQueue {
+	return &SessionQueue{
+		Redis: redisClient,
+	}
+}
+
+// StartSession queues a session to be started by the next worker with a free
+// session slot
+func (sq *SessionQueue) StartSession(sessionID string) error {
+	return sq.Redis.LPush(context.Background(), pendingSessionsKey, sessionID).Err()
+}
+
+// RemovePending removes a session no worker has picked up yet. It returns
+// false when a worker already has it.
+func (sq *SessionQueue) RemovePending(sessionID string) (bool, error) {
+	removed, err := sq.Redis.LRem(context.Background(), pendingSessionsKey, 0, sessionID).Result()
+	return removed > 0, err
+}
+
+// NextSession blocks for up to timeout waiting for a session to start. It
+// returns an empty string without an error when none became available.
+func (sq *SessionQueue) NextSession(ctx context.Context, timeout time.Duration) (string, error) {
+	reply, err := sq.Redis.BRPop(ctx, timeout, pendingSessionsKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return reply[1], nil
+}
+
+// SubmitCell stores a cell and queues it to run in its session
+func (sq *SessionQueue) SubmitCell(cell *models.SessionCell) error {
+	data, err := json.Marshal(cell)
+	if err != nil {
+		return fmt.Errorf("failed to encode cell: %w", err)
+	}
+
+	ctx := context.Background()
+	_, err = sq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionCellKey(cell.SessionID, cell.ID), data, cellRetention)
+		pipe.LPush(ctx, sessionCellsKey(cell.SessionID), cell.ID)
+		pipe.Expire(ctx, sessionCellsKey(cell.SessionID), cellRetention)
+		return nil
+	})
+	return err
+}
+
+// NextCell blocks for up to timeout waiting for the next cell of a session.
+// It returns nil without an error when no cell arrived.
+func (sq *SessionQueue) NextCell(ctx context.Context, sessionID string, timeout time.Duration) (*models.SessionCell, error) {
+	for {
+		reply, err := sq.Redis.BRPop(ctx, timeout, sessionCellsKey(sessionID)).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cell, err := sq.GetCell(sessionID, reply[1])
+		if errors.Is(err, ErrCellNotFound) {
+			// The cell expired while waiting; skip it
+			continue
+		}
+		return cell, err
+	}
+}
+
+// SaveCell updates a cell's status and result
+func (sq *SessionQueue) SaveCell(cell *models.SessionCell) error {
+	data, err := json.Marshal(cell)
+	if err != nil {
+		return fmt.Errorf("failed to encode cell: %w", err)
+	}
+	return sq.Redis.Set(context.Background(), sessionCellKey(cell.SessionID, cell.ID), data, cellRetention).Err()
+}
+
+// GetCell returns a cell and, once it has run, its result
+func (sq *SessionQueue) GetCell(sessionID, cellID string) (*models.SessionCell, error) {
+	data, err := sq.Redis.Get(context.Background(), sessionCellKey(sessionID, cellID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrCellNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cell models.SessionCell
+	if err := json.Unmarshal(data, &cell); err != nil {
+		return nil, fmt.Errorf("failed to decode cell %s: %w", cellID, err)
+	}
+	return &cell, nil
+}
+
+// WaitCell polls a cell until it has finished or the timeout expires, and
+// returns its latest state
+func (sq *SessionQueue) WaitCell(sessionID, cellID string, timeout time.Duration) (*models.SessionCell, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cell, err := sq.GetCell(sessionID, cellID)
+		if err != nil || models.IsTerminalStatus(cell.Status) || time.Now().After(deadline) {
+			return cell, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// FailPendingCells marks every cell still waiting in a session as failed,
+// for when the session ends before running them
+func (sq *SessionQueue) FailPendingCells(sessionID, reason string) {
+	ctx := context.Background()
+	for {
+		cellID, err := sq.Redis.RPop(ctx, sessionCellsKey(sessionID)).Result()
+		if err != nil {
+			return
+		}
+
+		cell, err := sq.GetCell(sessionID, cellID)
+		if err != nil {
+			continue
+		}
+		cell.Status = models.StatusFailed
+		cell.EndTime = CurrentTimestamp()
+		cell.Error = reason
+		sq.SaveCell(cell)
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// maxLogEvents caps how many output lines are kept and streamed per task
+const maxLogEvents = 10000
+
+// taskLogsKey returns the key of the list replayed to late log subscribers
+func taskLogsKey(taskID string) string {
+	return taskKeyPrefix + taskID + ":logs"
+}
+
+// taskLogSeqKey returns the key of the counter that numbers a task's events
+func taskLogSeqKey(taskID string) string {
+	return taskKeyPrefix + taskID + ":logseq"
+}
+
+// TaskEventsChannel returns the pub/sub channel live task events are published on
+func TaskEventsChannel(taskID string) string {
+	return taskKeyPrefix + taskID + ":events"
+}
+
+// AppendLog stores an output line in the task's replay buffer and publishes
+// it to live subscribers. Lines beyond maxLogEvents are dropped.
+func (tq *TaskQueue) AppendLog(taskID, stream, text string, timestamp float64) error {
+	ctx := context.Background()
+
+	seq, err := tq.Redis.Incr(ctx, taskLogSeqKey(taskID)).Result()
+	if err != nil {
+		return err
+	}
+	if seq > maxLogEvents {
+		return nil
+	}
+
+	event := models.TaskEvent{Seq: seq, Type: models.TaskEventLog, Stream: stream, Text: text, Time: timestamp}
+	if seq == maxLogEvents {
+		event.Stream = "stderr"
+		event.Text = "[log truncated]"
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tq.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, taskLogsKey(taskID), data)
+		pipe.Publish(ctx, TaskEventsChannel(taskID), data)
+		return nil
+	})
+	return err
+}
+
+// PublishFinalStatus tells live subscribers that a task has finished and
+// schedules its log buffer for expiry together with its status hash
+func (tq *TaskQueue) PublishFinalStatus(taskID string) error {
+	status, err := tq.GetTaskStatus(taskID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(models.TaskEvent{Type: models.TaskEventStatus, Time: CurrentTimestamp(), Status: status})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err = tq.Redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Publish(ctx, TaskEventsChannel(taskID), data)
+		pipe.Expire(ctx, taskLogsKey(taskID), taskRetention)
+		pipe.Expire(ctx, taskLogSeqKey(taskID), taskRetention)
+		return nil
+	})
+	return err
+}
+
+// GetTaskLogs returns the buffered log events of a task with a sequence
+// number greater than afterSeq
+func (tq *TaskQueue) GetTaskLogs(taskID string, afterSeq int64) ([]models.TaskEvent, error) {
+	start := afterSeq
+	if start < 0 {
+		start = 0
+	}
+
+	entries, err := tq.Redis.LRange(context.Background(), taskLogsKey(taskID), start, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]models.TaskEvent, 0, len(entries))
+	for _, entry := range entries {
+		var event models.TaskEvent
+		if err := json.Unmarshal([]byte(entry), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// SubscribeTaskEvents subscribes to the live events of a task. The
+// subscription is confirmed before returning so no event published afterwards is missed.
+func (tq *TaskQueue) SubscribeTaskEvents(ctx context.Context, taskID string) (*redis.PubSub, error) {
+	pubsub := tq.Redis.Subscribe(ctx, TaskEventsChannel(taskID))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// ParseTaskEvent decodes an event received on a task's events channel
+func ParseTaskEvent(payload string) (*models.TaskEvent, error) {
+	var event models.TaskEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,352 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+
+	"go-deepsandbox/models"
+)
+
+// Redis keys used by the task queue
+const (
+	processingQueueKey = "deepsandbox:queue:processing"
+	taskKeyPrefix      = "deepsandbox:task:"
+)
+
+// taskRetention is how long a finished task's status hash is kept in Redis
+const taskRetention = 7 * 24 * time.Hour
+
+// ErrTaskNotFound is returned when a task has no status hash in Redis
+var ErrTaskNotFound = errors.New("task not found")
+
+// Task is the payload stored in the queue for a code execution
+type Task struct {
+	ID           string            `json:"id"`
+	DatasetID    string            `json:"dataset_id"`
+	Datasets     map[string]string `json:"datasets,omitempty"` // dataset IDs by alias, including DatasetID as data
+	Code         string            `json:"code"`
+	Kind         string            `json:"kind,omitempty"`
+	Runtime      string            `json:"runtime,omitempty"`
+	Requirements []string          `json:"requirements,omitempty"` // normalized package requirements
+	UserID       string            `json:"user_id"`
+	Timeout      int               `json:"timeout"`
+	Priority     string            `json:"priority"`
+	EnqueuedAt   float64           `json:"enqueued_at"`
+}
+
+// TaskQueue handles task queue operations
+type TaskQueue struct {
+	Redis *redis.Client
+}
+
+// NewTaskQueue creates a new task queue
+func NewTaskQueue(redisClient *redis.Client) *TaskQueue {
+	return &TaskQueue{
+		Redis: redisClient,
+	}
+}
+
+// GetTaskQueue returns a task queue instance
+func GetTaskQueue(redisClient *redis.Client) *TaskQueue {
+	return NewTaskQueue(redisClient)
+}
+
+// taskKey returns the key of the status hash for a task
+func taskKey(taskID string) string {
+	return taskKeyPrefix + taskID
+}
+
+// SubmitCodeExecution submits a new code execution task to its user's
+// sub-queue for its priority class. The payload and the status hash are
+// written in the same transaction as the push so a worker never dequeues a
+// task it cannot read.
+func (tq *TaskQueue) SubmitCodeExecution(task *Task) (string, error) {
+	if task.ID == "" {
+		task.ID = uuid.New().String()
+	}
+	if task.Priority == "" {
+		task.Priority = models.PriorityNormal
+	}
+	task.EnqueuedAt = CurrentTimestamp()
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode task: %w", err)
+	}
+
+	ctx := context.Background()
+	_, err = tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, taskKey(task.ID), map[string]interface{}{
+			"payload":     payload,
+			"user_id":     task.UserID,
+			"status":      models.StatusQueued,
+			"priority":    task.Priority,
+			"timeout":     task.Timeout,
+			"enqueued_at": task.EnqueuedAt,
+		})
+		keys := []string{userRingKey(task.Priority), userQueueKey(task.Priority, task.UserID), readyQueueKey}
+		enqueueScript.Eval(ctx, pipe, keys, task.ID, task.UserID)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to enqueue task: %w", err)
+	}
+
+	return task.ID, nil
+}
+
+// Dequeue blocks for up to timeout waiting for the next task in fair-share
+// order. The task ID is moved atomically onto the processing list and leased
+// to the worker, which must renew the lease with RenewLeases while it holds
+// the task and release it with Ack. It returns nil without an error when no
+// task became available.
+func (tq *TaskQueue) Dequeue(ctx context.Context, workerID string, lease, timeout time.Duration) (*Task, error) {
+	taskID, err := tq.popNext(ctx, true, workerID, lease)
+	if err != nil {
+		return nil, err
+	}
+	if taskID == "" {
+		// Wait for a submission to wake us up, then try again
+		_, err := tq.Redis.BRPop(ctx, timeout, readyQueueKey).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if taskID, err = tq.popNext(ctx, false, workerID, lease); err != nil || taskID == "" {
+			return nil, err
+		}
+	}
+
+	payload, err := tq.Redis.HGet(ctx, taskKey(taskID), "payload").Result()
+	if errors.Is(err, redis.Nil) {
+		// The status hash expired or was never written; drop the orphaned ID
+		tq.Ack(taskID, workerID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var task Task
+	if err := json.Unmarshal([]byte(payload), &task); err != nil {
+		tq.Ack(taskID, workerID)
+		return nil, fmt.Errorf("failed to decode task %s: %w", taskID, err)
+	}
+
+	return &task, nil
+}
+
+// ackScript removes a task from the processing list and drops its lease,
+// unless the task has been handed to another worker since
+var ackScript = redis.NewScript(`
+local worker = redis.call('HGET', KEYS[3], ARGV[1])
+if worker and worker ~= ARGV[2] then
+	return 0
+end
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// Ack removes a task from the processing list and releases the worker's
+// lease once the worker has handled it
+func (tq *TaskQueue) Ack(taskID, workerID string) error {
+	return ackScript.Run(context.Background(), tq.Redis,
+		[]string{processingQueueKey, leasesKey, leaseOwnersKey}, taskID, workerID).Err()
+}
+
+// markRunningScript marks a task running unless a cancel was requested
+// while it was waiting to be picked up
+var markRunningScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'cancel_requested') == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[1], 'start_time', ARGV[2], 'worker', ARGV[3])
+return 1
+`)
+
+// MarkRunning records that a worker has started executing a task. It returns
+// false when the task was cancelled and must not be run.
+func (tq *TaskQueue) MarkRunning(taskID, workerID string, startTime float64) (bool, error) {
+	started, err := markRunningScript.Run(context.Background(), tq.Redis,
+		[]string{taskKey(taskID)}, models.StatusRunning, startTime, workerID).Int()
+	if err != nil {
+		return false, err
+	}
+	return started == 1, nil
+}
+
+// MarkFinished records the terminal state of a task and schedules its status
+// hash for expiry
+func (tq *TaskQueue) MarkFinished(taskID, status string, endTime float64, results []byte, errMsg string) error {
+	ctx := context.Background()
+	_, err := tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, taskKey(taskID), map[string]interface{}{
+			"status":   status,
+			"end_time": endTime,
+			"results":  results,
+			"error":    errMsg,
+		})
+		pipe.Expire(ctx, taskKey(taskID), taskRetention)
+		return nil
+	})
+	return err
+}
+
+// GetTaskStatus gets the status of a task
+func (tq *TaskQueue) GetTaskStatus(taskID string) (*models.TaskStatus, error) {
+	fields, err := tq.Redis.HGetAll(context.Background(), taskKey(taskID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrTaskNotFound
+	}
+
+	status := &models.TaskStatus{
+		TaskID:   taskID,
+		Status:   fields["status"],
+		Priority: fields["priority"],
+		Error:    fields["error"],
+	}
+	status.Timeout, _ = strconv.Atoi(fields["timeout"])
+	status.StartTime, _ = strconv.ParseFloat(fields["start_time"], 64)
+	status.EndTime, _ = strconv.ParseFloat(fields["end_time"], 64)
+	if models.IsTerminalStatus(status.Status) {
+		status.Progress = 100
+	}
+	status.Results = models.ParseExecutionResult([]byte(fields["results"]))
+
+	return status, nil
+}
+
+// Outcomes of a cancel request
+const (
+	CancelRemoved  = "removed"  // the task was still queued and has been removed
+	CancelSignaled = "signaled" // the task is running and its worker was told to stop it
+	CancelPending  = "pending"  // a worker has dequeued the task and will not start it
+	CancelFinished = "finished" // the task had already reached a terminal state
+)
+
+// CancelRequest is published to the worker that owns a running task or
+// session. TaskID holds the session ID for sessions.
+type CancelRequest struct {
+	TaskID      string `json:"task_id"`
+	RequestedBy string `json:"requested_by"`
+}
+
+// WorkerCancelChannel returns the pub/sub channel a worker receives cancel requests on
+func WorkerCancelChannel(workerID string) string {
+	return "deepsandbox:worker:" + workerID + ":cancel"
+}
+
+// cancelScript atomically removes a queued task or flags a running one so
+// that a cancel cannot race with a worker picking the task up
+var cancelScript = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status then
+	return {'', ''}
+end
+if status ~= ARGV[3] and status ~= ARGV[4] then
+	return {'finished', ''}
+end
+if redis.call('LREM', KEYS[2], 0, ARGV[1]) > 0 then
+	if redis.call('LLEN', KEYS[2]) == 0 then
+		redis.call('LREM', KEYS[3], 0, ARGV[8])
+	end
+	redis.call('RPOP', KEYS[4])
+	redis.call('HSET', KEYS[1], 'status', ARGV[5], 'end_time', ARGV[6], 'error', 'Cancelled by ' .. ARGV[2])
+	redis.call('EXPIRE', KEYS[1], ARGV[7])
+	return {'removed', ''}
+end
+redis.call('HSET', KEYS[1], 'cancel_requested', ARGV[2])
+if status == ARGV[4] then
+	return {'signaled', redis.call('HGET', KEYS[1], 'worker') or ''}
+end
+return {'pending', ''}
+`)
+
+// CancelTask cancels a task. A task still waiting in the queue is removed
+// and marked cancelled; a running task's worker is asked to kill its sandbox.
+// The returned outcome is one of the Cancel* constants.
+func (tq *TaskQueue) CancelTask(taskID, requestedBy string) (string, error) {
+	ctx := context.Background()
+
+	// The owner and priority never change, so the sub-queue can be looked up
+	// outside the script
+	owner, err := tq.Redis.HMGet(ctx, taskKey(taskID), "user_id", "priority").Result()
+	if err != nil {
+		return "", err
+	}
+	userID, _ := owner[0].(string)
+	priority, _ := owner[1].(string)
+	if priority == "" {
+		priority = models.PriorityNormal
+	}
+
+	keys := []string{taskKey(taskID), userQueueKey(priority, userID), userRingKey(priority), readyQueueKey}
+	reply, err := cancelScript.Run(ctx, tq.Redis, keys,
+		taskID, requestedBy, models.StatusQueued, models.StatusRunning, models.StatusCancelled,
+		CurrentTimestamp(), int64(taskRetention/time.Second), userID).StringSlice()
+	if err != nil {
+		return "", err
+	}
+	outcome, workerID := reply[0], reply[1]
+	if outcome == "" {
+		return "", ErrTaskNotFound
+	}
+
+	if outcome == CancelSignaled && workerID != "" {
+		if err := tq.SendCancelRequest(workerID, CancelRequest{TaskID: taskID, RequestedBy: requestedBy}); err != nil {
+			return "", err
+		}
+	}
+
+	return outcome, nil
+}
+
+// SendCancelRequest asks a worker to stop a task or session it is running
+func (tq *TaskQueue) SendCancelRequest(workerID string, request CancelRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return tq.Redis.Publish(context.Background(), WorkerCancelChannel(workerID), data).Err()
+}
+
+// CancelRequestedBy returns who asked for a task to be cancelled, or an empty
+// string when no cancel was requested
+func (tq *TaskQueue) CancelRequestedBy(taskID string) string {
+	requestedBy, _ := tq.Redis.HGet(context.Background(), taskKey(taskID), "cancel_requested").Result()
+	return requestedBy
+}
+
+// SubscribeCancelRequests subscribes to the cancel requests sent to a worker.
+// The subscription is confirmed before returning.
+func (tq *TaskQueue) SubscribeCancelRequests(ctx context.Context, workerID string) (*redis.PubSub, error) {
+	pubsub := tq.Redis.Subscribe(ctx, WorkerCancelChannel(workerID))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// ParseCancelRequest decodes a message received on a worker's cancel channel
+func ParseCancelRequest(payload string) (*CancelRequest, error) {
+	var request CancelRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"go-deepsandbox/models"
+)
+
+// warmPoolsKey is the set of workers that have published warm pool statistics
+const warmPoolsKey = "deepsandbox:warm-pools"
+
+// warmPoolStatsTTL is how long a worker's published statistics are reported
+// after it stops publishing them
+const warmPoolStatsTTL = 30 * time.Second
+
+// warmPoolKey returns the key of a worker's warm pool statistics
+func warmPoolKey(workerID string) string {
+	return "deepsandbox:warm-pool:" + workerID
+}
+
+// PublishWarmPoolStats stores a worker's warm pool statistics for the queue status
+func (tq *TaskQueue) PublishWarmPoolStats(stats *models.WarmPoolStats) error {
+	ctx := context.Background()
+	stats.UpdatedAt = CurrentTimestamp()
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	_, err = tq.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, warmPoolKey(stats.WorkerID), data, warmPoolStatsTTL)
+		pipe.SAdd(ctx, warmPoolsKey, stats.WorkerID)
+		return nil
+	})
+	return err
+}
+
+// GetWarmPoolStats returns the warm pool statistics of the workers that
+// published them recently. Workers that stopped publishing are forgotten.
+func (tq *TaskQueue) GetWarmPoolStats() ([]models.WarmPoolStats, error) {
+	ctx := context.Background()
+	workerIDs, err := tq.Redis.SMembers(ctx, warmPoolsKey).Result()
+	if err != nil || len(workerIDs) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(workerIDs))
+	for i, workerID := range workerIDs {
+		keys[i] = warmPoolKey(workerID)
+	}
+	values, err := tq.Redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []models.WarmPoolStats
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			tq.Redis.SRem(ctx, warmPoolsKey, workerIDs[i])
+			continue
+		}
+		var stats models.WarmPoolStats
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			continue
+		}
+		pools = append(pools, stats)
+	}
+	return pools, nil
+}
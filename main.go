@@ -59,6 +59,11 @@ func main() {
 	routes.RegisterAuthRoutes(router, database, cfg)
 	routes.RegisterDatasetRoutes(router, database, cfg)
 	routes.RegisterExecutionRoutes(router, database, redisClient, cfg)
+	routes.RegisterSessionRoutes(router, database, redisClient, cfg)
+	routes.RegisterScheduleRoutes(router, database, cfg)
+	routes.RegisterPipelineRoutes(router, database, redisClient, cfg)
+	routes.RegisterQueryRoutes(router, database, redisClient, cfg)
+	routes.RegisterRuntimeRoutes(router, database, cfg)
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
@@ -2,7 +2,6 @@ package middleware
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -201,7 +200,10 @@ func (a *Auth) AdminMiddleware() gin.HandlerFunc {
 	}
 }
 
-// ExecutionQuotaMiddleware checks if the user has exceeded their execution quota
+// ExecutionQuotaMiddleware reserves one execution of the user's daily
+// quota for the request. The reservation is returned after the handler
+// unless it called UseReservedExecution, so rejected requests and cached
+// results do not use quota.
 func (a *Auth) ExecutionQuotaMiddleware(redisClient *redis.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get user from context (assuming AuthMiddleware has been applied)
@@ -214,53 +216,100 @@ func (a *Auth) ExecutionQuotaMiddleware(redisClient *redis.Client) gin.HandlerFu
 		
 		user := userInterface.(models.User)
 		
-		// Check execution quota
-		ctx := context.Background()
-		key := fmt.Sprintf("execution_quota:%s:%s", user.ID, time.Now().Format("2006-01-02"))
-		
-		count, err := redisClient.Get(ctx, key).Int()
-		if errors.Is(err, redis.Nil) {
-			// First execution of the day
-			redisClient.Set(ctx, key, 1, 24*time.Hour)
-		} else if err == nil {
-			// Get user's max executions per day from quota
-			maxExecutions := a.Config.MaxExecutionsPerDay
-			
-			// Parse quota from JSON if it exists
-			if len(user.Quota) > 0 {
-				var quotaMap map[string]int
-				if err := json.Unmarshal(user.Quota, &quotaMap); err == nil {
-					if quota, ok := quotaMap["max_executions_per_day"]; ok && quota > 0 {
-						maxExecutions = quota
-					}
-				}
-			}
-			
-			if count >= maxExecutions {
-				c.JSON(http.StatusTooManyRequests, gin.H{"error": "You have exceeded your daily execution quota"})
-				c.Abort()
-				return
-			}
-			
-			// Increment counter
-			redisClient.Incr(ctx, key)
+		// Check and reserve in one step so concurrent requests cannot
+		// exceed the quota together
+		reservation, err := ReserveExecution(redisClient, user.ID, ExecutionLimit(a.Config, &user))
+		if err != nil {
+			// The quota is not enforced while Redis is unavailable
+			c.Next()
+			return
+		}
+		if reservation == "" {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "You have exceeded your daily execution quota"})
+			c.Abort()
+			return
 		}
+		c.Set(executionReservedKey, reservation)
 		
 		c.Next()
+		
+		ReleaseReservedExecution(c, redisClient)
 	}
 }
 
-// TrackExecution increments the execution counter for a user
-func TrackExecution(redisClient *redis.Client, userID string) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("execution_quota:%s:%s", userID, time.Now().Format("2006-01-02"))
-	
-	_, err := redisClient.Incr(ctx, key).Result()
-	if err != nil {
-		return err
+// executionReservedKey holds in the gin context the reservation
+// ExecutionQuotaMiddleware made for the request, until the handler settles it
+const executionReservedKey = "execution_quota_reserved"
+
+// UseReservedExecution keeps the execution reserved for the request counted
+// against the user's quota, once the handler has queued it
+func UseReservedExecution(c *gin.Context) {
+	c.Set(executionReservedKey, "")
+}
+
+// ReleaseReservedExecution returns the execution reserved for the request
+// to the user's quota. Handlers whose executions reserve quota themselves,
+// like pipeline steps, call it before queueing them.
+func ReleaseReservedExecution(c *gin.Context, redisClient *redis.Client) {
+	reservation := c.GetString(executionReservedKey)
+	if reservation == "" {
+		return
 	}
-	
-	// Set expiration if it doesn't exist
-	redisClient.Expire(ctx, key, 24*time.Hour)
-	return nil
-} 
\ No newline at end of file
+	c.Set(executionReservedKey, "")
+	ReleaseExecution(redisClient, reservation)
+}
+
+// executionQuotaKey returns the key counting a user's executions today
+func executionQuotaKey(userID string) string {
+	return fmt.Sprintf("execution_quota:%s:%s", userID, time.Now().Format("2006-01-02"))
+}
+
+// ExecutionLimit returns how many executions a user may queue per day
+func ExecutionLimit(cfg *config.Config, user *models.User) int {
+	return user.QuotaLimit("max_executions_per_day", cfg.MaxExecutionsPerDay)
+}
+
+// reserveScript counts an execution against the quota in KEYS[1] unless the
+// limit ARGV[1] has been reached, in which case the count is left unchanged
+var reserveScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+if count > tonumber(ARGV[1]) then
+	redis.call('DECR', KEYS[1])
+	return 0
+end
+return 1
+`)
+
+// ReserveExecution counts an execution against the user's daily quota and
+// returns the reservation, which names the day's counter it was made on. It
+// returns an empty reservation, counting nothing, when limit executions were
+// already counted today. A reservation that ends up unused is returned with
+// ReleaseExecution.
+func ReserveExecution(redisClient *redis.Client, userID string, limit int) (string, error) {
+	key := executionQuotaKey(userID)
+	reserved, err := reserveScript.Run(context.Background(), redisClient,
+		[]string{key}, limit, int64(24*time.Hour/time.Second)).Int()
+	if err != nil || reserved == 0 {
+		return "", err
+	}
+	return key, nil
+}
+
+// releaseScript takes one execution off the count in KEYS[1], never going
+// below zero
+var releaseScript = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+	redis.call('DECR', KEYS[1])
+end
+return 1
+`)
+
+// ReleaseExecution returns an execution reserved with ReserveExecution that
+// was not queued. It is taken off the day it was reserved on, even when the
+// release happens on the next day.
+func ReleaseExecution(redisClient *redis.Client, reservation string) error {
+	return releaseScript.Run(context.Background(), redisClient, []string{reservation}).Err()
+}
\ No newline at end of file
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestReserveAndReleaseExecution(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	var reservations []string
+	for i := 0; i < 3; i++ {
+		reservation, err := ReserveExecution(client, "user-1", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reservations = append(reservations, reservation)
+	}
+	if reservations[0] == "" || reservations[1] == "" || reservations[2] != "" {
+		t.Fatalf("reservations = %q, want the first two of a limit of 2", reservations)
+	}
+
+	// A reservation is returned to the day it was made on, whenever that is
+	server.Set("execution_quota:user-1:1999-12-31", "1")
+	if err := ReleaseExecution(client, "execution_quota:user-1:1999-12-31"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := server.Get("execution_quota:user-1:1999-12-31"); count != "0" {
+		t.Errorf("earlier day's count = %s, want 0", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := ReleaseExecution(client, reservations[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := client.Get(context.Background(), reservations[0]).Int(); err != nil || count != 0 {
+		t.Errorf("count after releasing more than was reserved = %d, %v; want 0", count, err)
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,23 +36,123 @@ type Dataset struct {
 	RowCount    int       `json:"row_count"`
 	Columns     []string  `json:"columns" gorm:"type:text[]"`
 	Schema      string    `json:"schema" gorm:"type:jsonb"`
+	ContentHash string    `json:"content_hash"` // SHA-256 of the file, hex encoded
 	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 }
 
+// Execution statuses shared by the task queue and the CodeExecution table
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+	StatusTimedOut  = "timed_out"
+)
+
+// Execution kinds: what the Code of an execution holds
+const (
+	KindCode     = "code"
+	KindNotebook = "notebook"
+	KindSQL      = "sql"
+)
+
+// Execution priority classes
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities lists the priority classes in the order they are served
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// priorityRank orders priority classes from lowest to highest
+var priorityRank = map[string]int{PriorityLow: 0, PriorityNormal: 1, PriorityHigh: 2}
+
+// MaxPriority returns the highest priority class a user with the given roles
+// may request. Admins and users with the "priority" role may use high.
+func MaxPriority(roles []string) string {
+	for _, role := range roles {
+		if role == "admin" || role == "priority" {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
+
+// PriorityAllowed reports whether priority is at most max
+func PriorityAllowed(priority, max string) bool {
+	return priorityRank[priority] <= priorityRank[max]
+}
+
+// IsTerminalStatus reports whether an execution in the given status can no longer change
+func IsTerminalStatus(status string) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusCancelled, StatusTimedOut:
+		return true
+	}
+	return false
+}
+
 // CodeExecution represents a code execution request
 type CodeExecution struct {
-	ID        string    `json:"id" gorm:"primaryKey"`
-	UserID    string    `json:"user_id" gorm:"index"`
-	DatasetID string    `json:"dataset_id" gorm:"index"`
-	Code      string    `json:"code" gorm:"type:text"`
-	Status    string    `json:"status" gorm:"index"`
-	Results   string    `json:"results" gorm:"type:jsonb"`
-	StartTime float64   `json:"start_time"`
-	EndTime   float64   `json:"end_time"`
-	Error     string    `json:"error" gorm:"type:text"`
-	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+	ID           string          `json:"id" gorm:"primaryKey"`
+	UserID       string          `json:"user_id" gorm:"index"`
+	DatasetID    string          `json:"dataset_id" gorm:"index"`
+	Code         string          `json:"code" gorm:"type:text"`
+	Kind         string          `json:"kind" gorm:"default:code"`
+	Runtime      string          `json:"runtime" gorm:"default:python"`             // name of the Runtime the code ran with
+	Requirements pq.StringArray  `json:"requirements,omitempty" gorm:"type:text[]"` // packages installed for the code
+	CacheKey     string          `json:"-" gorm:"index"`                            // identifies the result for the result cache
+	CachedFrom   string          `json:"cached_from,omitempty"`                     // set when the result was served from an earlier execution
+	Status       string          `json:"status" gorm:"index"`
+	Results      json.RawMessage `json:"results" gorm:"type:jsonb"`
+	Timeout      int             `json:"timeout"`
+	Priority     string          `json:"priority"`
+	WorkerID     string          `json:"worker_id,omitempty" gorm:"index"`   // worker that ran the execution
+	Retries      int             `json:"retries,omitempty"`                  // times it was requeued after its worker stopped responding
+	ScheduleID   string          `json:"schedule_id,omitempty" gorm:"index"` // set for runs of a Schedule
+	PipelineID   string          `json:"pipeline_id,omitempty" gorm:"index"` // set for steps of a Pipeline
+	StartTime    float64         `json:"start_time"`
+	EndTime      float64         `json:"end_time"`
+	Error        string          `json:"error" gorm:"type:text"`
+	CreatedAt    time.Time       `json:"created_at" gorm:"autoCreateTime;index"`
+	UpdatedAt    time.Time       `json:"updated_at" gorm:"autoUpdateTime"`
+
+	// Datasets links every dataset the execution loads, by alias
+	Datasets []ExecutionDataset `json:"datasets,omitempty" gorm:"foreignKey:ExecutionID"`
+}
+
+// ResultsID returns the ID of the execution whose results and artifacts this
+// one has: the earlier execution for results served from the cache
+func (c *CodeExecution) ResultsID() string {
+	if c.CachedFrom != "" {
+		return c.CachedFrom
+	}
+	return c.ID
+}
+
+// PrimaryDatasetAlias is the alias of the dataset loaded as data; DatasetID
+// holds its ID
+const PrimaryDatasetAlias = "data"
+
+// ExecutionDataset links an execution to a dataset it loads under an alias
+type ExecutionDataset struct {
+	ExecutionID string `json:"-" gorm:"primaryKey"`
+	Alias       string `json:"alias" gorm:"primaryKey"`
+	DatasetID   string `json:"dataset_id" gorm:"index"`
+}
+
+// ExecutionArtifact is a file an execution wrote to its output directory,
+// kept under the artifacts directory
+type ExecutionArtifact struct {
+	ExecutionID string    `json:"execution_id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"primaryKey"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
 }
 
 // BeforeCreate will generate a UUID for entities before creation
@@ -70,6 +171,35 @@ func (d *Dataset) BeforeCreate(tx *gorm.DB) (err error) {
 	return
 }
 
+// FilePath returns where the dataset file is stored under the datasets directory
+func (d *Dataset) FilePath(datasetsDir string) string {
+	return filepath.Join(datasetsDir, d.UserID, d.ID+filepath.Ext(d.Filename))
+}
+
+// ArtifactsPath returns the directory an execution's artifacts are kept in
+func ArtifactsPath(artifactsDir, executionID string) string {
+	return filepath.Join(artifactsDir, executionID)
+}
+
+// FilePath returns where the artifact is stored under the artifacts directory
+func (a *ExecutionArtifact) FilePath(artifactsDir string) string {
+	return filepath.Join(ArtifactsPath(artifactsDir, a.ExecutionID), filepath.FromSlash(a.Name))
+}
+
+// QuotaLimit returns the value of a limit in the user's quota JSON, or
+// defaultValue when the user has no positive override
+func (u *User) QuotaLimit(key string, defaultValue int) int {
+	if len(u.Quota) > 0 {
+		var quotaMap map[string]int
+		if err := json.Unmarshal(u.Quota, &quotaMap); err == nil {
+			if quota, ok := quotaMap[key]; ok && quota > 0 {
+				return quota
+			}
+		}
+	}
+	return defaultValue
+}
+
 // SetPassword sets the hashed password field from a plain-text password
 func (u *User) SetPassword(password string) error {
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -162,6 +292,7 @@ type DatasetMetadata struct {
 	SizeMB      float64   `json:"size_mb"`
 	RowCount    int       `json:"row_count"`
 	Columns     []string  `json:"columns"`
+	ContentHash string    `json:"content_hash"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -175,6 +306,7 @@ func (d *Dataset) ToDatasetMetadata() DatasetMetadata {
 		SizeMB:      d.SizeMB,
 		RowCount:    d.RowCount,
 		Columns:     d.Columns,
+		ContentHash: d.ContentHash,
 		CreatedAt:   d.CreatedAt,
 	}
 }
@@ -188,37 +320,165 @@ type DatasetResponse struct {
 
 // CodeExecutionRequest is the DTO for code execution requests
 type CodeExecutionRequest struct {
-	DatasetID string `json:"dataset_id" binding:"required"`
-	Code      string `json:"code" binding:"required"`
+	DatasetID string `json:"dataset_id"`
+	Code      string `json:"code"`
 	Timeout   *int   `json:"timeout,omitempty"`
+	Priority  string `json:"priority,omitempty" binding:"omitempty,oneof=low normal high"`
+
+	// Datasets maps aliases to further datasets to load alongside DatasetID
+	Datasets map[string]string `json:"datasets,omitempty"`
+
+	// Notebook is a Jupyter notebook (nbformat 4) to run instead of Code
+	Notebook json.RawMessage `json:"notebook,omitempty"`
+
+	// Runtime names the registered runtime to run with; empty uses the default
+	Runtime string `json:"runtime,omitempty"`
+
+	// Cache set to false runs the code even when an identical earlier
+	// execution can be reused
+	Cache *bool `json:"cache,omitempty"`
+
+	// Requirements lists packages to install from the wheelhouse, such as
+	// pandas==2.1.4; each must be on the package allowlist
+	Requirements []string `json:"requirements,omitempty"`
+}
+
+// ExecutionResult is the structured result of an execution, stored as JSON in
+// CodeExecution.Results
+type ExecutionResult struct {
+	Stdout           string            `json:"stdout"`
+	Stderr           string            `json:"stderr"`
+	ExitCode         int               `json:"exit_code"`
+	ReturnValue      interface{}       `json:"return_value"`
+	DataFrames       []DataFrameOutput `json:"dataframes"`
+	Artifacts        []Artifact        `json:"artifacts"`
+	ArtifactsSkipped int               `json:"artifacts_skipped,omitempty"` // output files over the artifact limits
+	Notebook         json.RawMessage   `json:"notebook,omitempty"`          // the executed notebook, for notebook executions
+	Query            *QueryResult      `json:"query,omitempty"`             // the rows of a SQL query
+	Duration         float64           `json:"duration"`
+	LogError         string            `json:"log_error,omitempty"`         // why the output is incomplete
+}
+
+// DataFrameOutput is a DataFrame or Series produced by an execution, encoded
+// as a JSON table. Only the first rows are kept; TotalRows has the full count.
+type DataFrameOutput struct {
+	Name      string            `json:"name"`
+	Columns   []string          `json:"columns"`
+	Dtypes    map[string]string `json:"dtypes"`
+	Index     []interface{}     `json:"index"`
+	Data      [][]interface{}   `json:"data"`
+	TotalRows int               `json:"total_rows"`
+	Truncated bool              `json:"truncated"`
+}
+
+// Artifact is a file written by an execution to its output directory
+type Artifact struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ParseExecutionResult decodes the JSON stored in CodeExecution.Results
+func ParseExecutionResult(data []byte) *ExecutionResult {
+	if len(data) == 0 {
+		return nil
+	}
+	var result ExecutionResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil
+	}
+	return &result
+}
+
+// ExecutionSummary is the compact DTO for execution listings, without the
+// code and results
+type ExecutionSummary struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	DatasetID  string    `json:"dataset_id"`
+	Kind       string    `json:"kind"`
+	Runtime    string    `json:"runtime"`
+	Status     string    `json:"status"`
+	Priority   string    `json:"priority"`
+	Timeout    int       `json:"timeout"`
+	ScheduleID string    `json:"schedule_id,omitempty"`
+	PipelineID string    `json:"pipeline_id,omitempty"`
+	CachedFrom string    `json:"cached_from,omitempty"`
+	StartTime  float64   `json:"start_time"`
+	EndTime    float64   `json:"end_time"`
+	Error      string    `json:"error"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ToExecutionSummary converts a CodeExecution model to an ExecutionSummary DTO
+func (c *CodeExecution) ToExecutionSummary() ExecutionSummary {
+	return ExecutionSummary{
+		ID:         c.ID,
+		UserID:     c.UserID,
+		DatasetID:  c.DatasetID,
+		Kind:       c.Kind,
+		Runtime:    c.Runtime,
+		Status:     c.Status,
+		Priority:   c.Priority,
+		Timeout:    c.Timeout,
+		ScheduleID: c.ScheduleID,
+		PipelineID: c.PipelineID,
+		CachedFrom: c.CachedFrom,
+		StartTime:  c.StartTime,
+		EndTime:    c.EndTime,
+		Error:      c.Error,
+		CreatedAt:  c.CreatedAt,
+	}
 }
 
 // TaskStatus is the DTO for task status information
 type TaskStatus struct {
-	TaskID    string                 `json:"task_id"`
-	Status    string                 `json:"status"`
-	Progress  float64                `json:"progress"`
-	StartTime float64                `json:"start_time,omitempty"`
-	EndTime   float64                `json:"end_time,omitempty"`
-	Results   map[string]interface{} `json:"results,omitempty"`
-	Error     string                 `json:"error,omitempty"`
+	TaskID     string           `json:"task_id"`
+	Status     string           `json:"status"`
+	Progress   float64          `json:"progress"`
+	Timeout    int              `json:"timeout,omitempty"`
+	Priority   string           `json:"priority,omitempty"`
+	StartTime  float64          `json:"start_time,omitempty"`
+	EndTime    float64          `json:"end_time,omitempty"`
+	Results    *ExecutionResult `json:"results,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	CachedFrom string           `json:"cached_from,omitempty"`
+}
+
+// Task event types sent on the log stream
+const (
+	TaskEventLog    = "log"
+	TaskEventStatus = "status"
+)
+
+// TaskEvent is an output line or the final status of a task, as published
+// to log stream subscribers
+type TaskEvent struct {
+	Seq    int64       `json:"seq,omitempty"`
+	Type   string      `json:"type"`
+	Stream string      `json:"stream,omitempty"`
+	Text   string      `json:"text,omitempty"`
+	Time   float64     `json:"time"`
+	Status *TaskStatus `json:"status,omitempty"`
 }
 
 // ToTaskStatus converts a CodeExecution model to a TaskStatus DTO
 func (c *CodeExecution) ToTaskStatus() TaskStatus {
-	var results map[string]interface{}
-	if c.Results != "" {
-		// In a real implementation, you'd parse JSON from c.Results
-		results = map[string]interface{}{}
+	progress := 0.0
+	if IsTerminalStatus(c.Status) {
+		progress = 100.0
 	}
 
 	return TaskStatus{
-		TaskID:    c.ID,
-		Status:    c.Status,
-		Progress:  100.0,
-		StartTime: c.StartTime,
-		EndTime:   c.EndTime,
-		Results:   results,
-		Error:     c.Error,
+		TaskID:     c.ID,
+		Status:     c.Status,
+		Progress:   progress,
+		Timeout:    c.Timeout,
+		Priority:   c.Priority,
+		StartTime:  c.StartTime,
+		EndTime:    c.EndTime,
+		Results:    ParseExecutionResult(c.Results),
+		Error:      c.Error,
+		CachedFrom: c.CachedFrom,
 	}
-}
\ No newline at end of file
+}
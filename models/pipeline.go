@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Pipeline statuses
+const (
+	PipelineRunning   = "running"
+	PipelineCompleted = "completed"
+	PipelineFailed    = "failed"
+	PipelineCancelled = "cancelled"
+)
+
+// StepWaiting is the status of a pipeline step whose dependencies have not
+// all completed yet. Steps that have been submitted take the status of their
+// execution.
+const StepWaiting = "waiting"
+
+// Pipeline is a set of code steps with dependencies between them. Each step
+// runs as a regular CodeExecution once the steps it depends on have
+// completed, and can read their artifacts.
+type Pipeline struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"index"`
+	Name      string    `json:"name"`
+	DatasetID string    `json:"dataset_id" gorm:"index"`
+	Priority  string    `json:"priority"`
+	Status    string    `json:"status" gorm:"index"`
+	Error     string    `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Steps []PipelineStep `json:"steps,omitempty" gorm:"foreignKey:PipelineID"`
+}
+
+// PipelineStep is one step of a pipeline
+type PipelineStep struct {
+	PipelineID  string         `json:"-" gorm:"primaryKey"`
+	Name        string         `json:"name" gorm:"primaryKey"`
+	Position    int            `json:"position"`
+	Code        string         `json:"code" gorm:"type:text"`
+	DependsOn   pq.StringArray `json:"depends_on" gorm:"type:text[]"`
+	Timeout     int            `json:"timeout"`
+	Status      string         `json:"status"`
+	ExecutionID string         `json:"execution_id,omitempty" gorm:"index"`
+	Attempts    int            `json:"attempts"`
+	Error       string         `json:"error,omitempty" gorm:"type:text"`
+}
+
+// PipelineCreate is the DTO for creating a pipeline
+type PipelineCreate struct {
+	Name      string               `json:"name" binding:"required"`
+	DatasetID string               `json:"dataset_id" binding:"required"`
+	Priority  string               `json:"priority,omitempty" binding:"omitempty,oneof=low normal high"`
+	Steps     []PipelineStepCreate `json:"steps" binding:"required,min=1,dive"`
+}
+
+// PipelineStepCreate is the DTO for one step of a new pipeline
+type PipelineStepCreate struct {
+	Name      string   `json:"name" binding:"required"`
+	Code      string   `json:"code" binding:"required"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	Timeout   *int     `json:"timeout,omitempty"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CodePolicyID is the ID of the only CodePolicy row
+const CodePolicyID = 1
+
+// CodePolicy is the admin-set policy submitted code is checked against
+// before it is queued. Until an admin sets one, the CODE_DENYLIST setting
+// applies.
+type CodePolicy struct {
+	ID        int            `json:"-" gorm:"primaryKey"`
+	Denylist  pq.StringArray `json:"denylist" gorm:"type:text[]"`
+	UpdatedBy string         `json:"updated_by,omitempty"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// CodePolicyUpdate is the DTO for replacing the code policy
+type CodePolicyUpdate struct {
+	Denylist []string `json:"denylist" binding:"required"`
+}
+
+// PackagePolicyID is the ID of the only PackagePolicy row
+const PackagePolicyID = 1
+
+// PackagePolicy is the admin-set allowlist of packages executions may list
+// as requirements. Until an admin sets one, the PACKAGE_ALLOWLIST setting
+// applies.
+type PackagePolicy struct {
+	ID        int            `json:"-" gorm:"primaryKey"`
+	Allowlist pq.StringArray `json:"allowlist" gorm:"type:text[]"`
+	UpdatedBy string         `json:"updated_by,omitempty"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// PackagePolicyUpdate is the DTO for replacing the package allowlist
+type PackagePolicyUpdate struct {
+	Allowlist []string `json:"allowlist" binding:"required"`
+}
@@ -0,0 +1,26 @@
+package models
+
+// QueryRequest is the DTO for SQL queries over datasets. The dataset in the
+// URL, if any, is the table data; Datasets adds further tables by alias.
+type QueryRequest struct {
+	SQL      string            `json:"sql" binding:"required"`
+	Datasets map[string]string `json:"datasets,omitempty"`
+	Timeout  *int              `json:"timeout,omitempty"`
+	Priority string            `json:"priority,omitempty" binding:"omitempty,oneof=low normal high"`
+}
+
+// QueryResult holds the rows of a SQL query, stored in ExecutionResult.Query.
+// Only the first rows are kept; TotalRows has the full count.
+type QueryResult struct {
+	Engine    string          `json:"engine"`
+	Columns   []QueryColumn   `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	TotalRows int             `json:"total_rows"`
+	Truncated bool            `json:"truncated"`
+}
+
+// QueryColumn is a column of a query result with the engine's type name
+type QueryColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
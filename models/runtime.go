@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Runtime languages. Python runtimes run code through the harness; code in
+// other languages is run directly by the runtime's command.
+const (
+	LanguagePython = "python"
+	LanguageR      = "r"
+)
+
+// BuiltinRuntime names the Python runtime configured by CONTAINER_IMAGE and
+// LOCAL_PYTHON. It is used when no registered runtime is the default.
+const BuiltinRuntime = "python"
+
+// Runtime is an admin-registered language runtime executions can ask for by
+// name. The script to run, the harness for Python and the code file
+// otherwise, is appended to Command.
+type Runtime struct {
+	Name      string         `json:"name" gorm:"primaryKey"`
+	Language  string         `json:"language"`
+	Image     string         `json:"image"`                      // container image, for the docker backend
+	Command   pq.StringArray `json:"command" gorm:"type:text[]"` // entry command, e.g. python3.12 or Rscript
+	IsDefault bool           `json:"default"`                    // used when a request names no runtime
+	Enabled   bool           `json:"enabled"`
+	CreatedAt time.Time      `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// IsPython reports whether code for the runtime runs through the Python harness
+func (r *Runtime) IsPython() bool {
+	return r.Language == LanguagePython
+}
+
+// RuntimeCreate is the DTO for registering a runtime
+type RuntimeCreate struct {
+	Name     string   `json:"name" binding:"required"`
+	Language string   `json:"language" binding:"required,oneof=python r"`
+	Image    string   `json:"image" binding:"required"`
+	Command  []string `json:"command" binding:"required,min=1"`
+	Default  bool     `json:"default"`
+	Enabled  *bool    `json:"enabled,omitempty"`
+}
+
+// RuntimeUpdate is the DTO for changing a runtime
+type RuntimeUpdate struct {
+	Language *string  `json:"language,omitempty" binding:"omitempty,oneof=python r"`
+	Image    *string  `json:"image,omitempty"`
+	Command  []string `json:"command,omitempty"`
+	Default  *bool    `json:"default,omitempty"`
+	Enabled  *bool    `json:"enabled,omitempty"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Schedule runs code against a dataset at the times given by a cron
+// expression. Each run is a regular CodeExecution with ScheduleID set.
+type Schedule struct {
+	ID        string `json:"id" gorm:"primaryKey"`
+	UserID    string `json:"user_id" gorm:"index"`
+	Name      string `json:"name"`
+	DatasetID string `json:"dataset_id" gorm:"index"`
+	Code      string `json:"code" gorm:"type:text"`
+	Cron      string `json:"cron"`
+	Timezone  string `json:"timezone"`
+	Timeout   int    `json:"timeout"`
+	Priority  string `json:"priority"`
+	Enabled   bool   `json:"enabled" gorm:"index"`
+
+	NextRunAt           *time.Time `json:"next_run_at" gorm:"index"`
+	LastRunAt           *time.Time `json:"last_run_at"`
+	LastExecutionID     string     `json:"last_execution_id,omitempty"`
+	LastStatus          string     `json:"last_status,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledReason      string     `json:"disabled_reason,omitempty" gorm:"type:text"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// ScheduleCreate is the DTO for creating a schedule
+type ScheduleCreate struct {
+	Name      string `json:"name" binding:"required"`
+	DatasetID string `json:"dataset_id" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+	Cron      string `json:"cron" binding:"required"`
+	Timezone  string `json:"timezone,omitempty"`
+	Timeout   *int   `json:"timeout,omitempty"`
+	Priority  string `json:"priority,omitempty" binding:"omitempty,oneof=low normal high"`
+	Enabled   *bool  `json:"enabled,omitempty"`
+}
+
+// ScheduleUpdate is the DTO for changing a schedule; omitted fields are kept
+type ScheduleUpdate struct {
+	Name      *string `json:"name,omitempty"`
+	DatasetID *string `json:"dataset_id,omitempty"`
+	Code      *string `json:"code,omitempty"`
+	Cron      *string `json:"cron,omitempty"`
+	Timezone  *string `json:"timezone,omitempty"`
+	Timeout   *int    `json:"timeout,omitempty"`
+	Priority  *string `json:"priority,omitempty" binding:"omitempty,oneof=low normal high"`
+	Enabled   *bool   `json:"enabled,omitempty"`
+}
@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Session statuses
+const (
+	SessionStarting = "starting"
+	SessionReady    = "ready"
+	SessionClosed   = "closed"
+	SessionFailed   = "failed"
+)
+
+// IsActiveSession reports whether a session in the given status still counts
+// towards its user's session limit
+func IsActiveSession(status string) bool {
+	return status == SessionStarting || status == SessionReady
+}
+
+// Session is an interactive sandbox that keeps a Python interpreter, with the
+// dataset loaded, alive between code cells
+type Session struct {
+	ID           string    `json:"id" gorm:"primaryKey"`
+	UserID       string    `json:"user_id" gorm:"index"`
+	DatasetID    string    `json:"dataset_id" gorm:"index"`
+	Status       string    `json:"status" gorm:"index"`
+	WorkerID     string    `json:"-"`
+	IdleTimeout  int       `json:"idle_timeout"`
+	CellTimeout  int       `json:"cell_timeout"`
+	CellCount    int       `json:"cell_count"`
+	LastActivity float64   `json:"last_activity"`
+	ClosedAt     float64   `json:"closed_at,omitempty"`
+	Error        string    `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// SessionCreate is the DTO for starting a session
+type SessionCreate struct {
+	DatasetID   string `json:"dataset_id" binding:"required"`
+	IdleTimeout *int   `json:"idle_timeout,omitempty"`
+}
+
+// CellRequest is the DTO for running a code cell in a session
+type CellRequest struct {
+	Code    string `json:"code" binding:"required"`
+	Timeout *int   `json:"timeout,omitempty"`
+}
+
+// SessionCell is a code cell submitted to a session and, once it has run,
+// its result
+type SessionCell struct {
+	ID          string           `json:"id"`
+	SessionID   string           `json:"session_id"`
+	Code        string           `json:"code,omitempty"`
+	Timeout     int              `json:"timeout"`
+	Status      string           `json:"status"`
+	SubmittedAt float64          `json:"submitted_at"`
+	StartTime   float64          `json:"start_time,omitempty"`
+	EndTime     float64          `json:"end_time,omitempty"`
+	Results     *ExecutionResult `json:"results,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
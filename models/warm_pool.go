@@ -0,0 +1,50 @@
+package models
+
+// WarmPoolStats describes a worker's pool of pre-started sandboxes. Workers
+// publish it periodically and the queue status reports it.
+type WarmPoolStats struct {
+	WorkerID string `json:"worker_id,omitempty"`
+	Size     int    `json:"size"`     // idle sandboxes kept per runtime
+	Runtimes int    `json:"runtimes"` // runtimes sandboxes are kept for
+	Idle     int    `json:"idle"`
+
+	// Hits ran in a warm sandbox and misses found none idle. Bypassed jobs
+	// cannot use one, such as sessions and jobs with requirements.
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Bypassed int64   `json:"bypassed"`
+	HitRate  float64 `json:"hit_rate"` // hits out of hits and misses
+
+	// Time from a job being handed to the sandbox until its code started
+	WarmStarts     int64   `json:"warm_starts"`
+	AvgWarmStartMs float64 `json:"avg_warm_start_ms"`
+	ColdStarts     int64   `json:"cold_starts"`
+	AvgColdStartMs float64 `json:"avg_cold_start_ms"`
+
+	UpdatedAt float64 `json:"updated_at,omitempty"`
+}
+
+// Add accumulates other's counts into s, keeping averages weighted by count
+func (s *WarmPoolStats) Add(other *WarmPoolStats) {
+	s.Size += other.Size
+	s.Runtimes += other.Runtimes
+	s.Idle += other.Idle
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Bypassed += other.Bypassed
+	if s.Hits+s.Misses > 0 {
+		s.HitRate = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	s.AvgWarmStartMs = weightedAverage(s.AvgWarmStartMs, s.WarmStarts, other.AvgWarmStartMs, other.WarmStarts)
+	s.WarmStarts += other.WarmStarts
+	s.AvgColdStartMs = weightedAverage(s.AvgColdStartMs, s.ColdStarts, other.AvgColdStartMs, other.ColdStarts)
+	s.ColdStarts += other.ColdStarts
+}
+
+// weightedAverage combines the averages of two sets of samples
+func weightedAverage(a float64, countA int64, b float64, countB int64) float64 {
+	if countA+countB == 0 {
+		return 0
+	}
+	return (a*float64(countA) + b*float64(countB)) / float64(countA+countB)
+}
@@ -0,0 +1,124 @@
+package packages
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"go-deepsandbox/models"
+)
+
+// MaxRequirements caps how many requirements one execution may list
+const MaxRequirements = 50
+
+// namePattern matches a package name as PEP 508 defines it
+var namePattern = regexp.MustCompile(`^([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9._-]*[A-Za-z0-9])$`)
+
+// requirementPattern matches a package name with optional version
+// specifiers, such as pandas, numpy==1.26.4 or scipy>=1.11,<1.13. Extras,
+// URLs, markers and pip options are not accepted.
+var requirementPattern = regexp.MustCompile(`^([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9._-]*[A-Za-z0-9])((===|==|!=|<=|>=|~=|<|>)[A-Za-z0-9.*+!_-]+(,(===|==|!=|<=|>=|~=|<|>)[A-Za-z0-9.*+!_-]+)*)?$`)
+
+// nameSeparators are the runs of characters PEP 503 treats as equal
+var nameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// Requirement is a validated package requirement
+type Requirement struct {
+	Name      string // normalized package name
+	Specifier string // version specifiers without spaces, possibly empty
+}
+
+// String returns the requirement as pip takes it
+func (r Requirement) String() string {
+	return r.Name + r.Specifier
+}
+
+// Normalize returns the PEP 503 form of a package name, under which names
+// that pip treats as the same package are equal
+func Normalize(name string) string {
+	return nameSeparators.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "-")
+}
+
+// ValidName reports whether name is a package name, without version specifiers
+func ValidName(name string) bool {
+	return namePattern.MatchString(strings.TrimSpace(name))
+}
+
+// Parse validates requirements and returns them normalized and sorted by name
+func Parse(requirements []string) ([]Requirement, error) {
+	if len(requirements) > MaxRequirements {
+		return nil, fmt.Errorf("at most %d requirements can be listed", MaxRequirements)
+	}
+
+	parsed := make([]Requirement, 0, len(requirements))
+	seen := make(map[string]bool, len(requirements))
+	for _, requirement := range requirements {
+		compact := strings.Join(strings.Fields(requirement), "")
+		match := requirementPattern.FindStringSubmatch(compact)
+		if match == nil {
+			return nil, fmt.Errorf("invalid requirement %q: use a package name with optional version specifiers, such as pandas==2.1.4", requirement)
+		}
+
+		name := Normalize(match[1])
+		if seen[name] {
+			return nil, fmt.Errorf("package %s is listed more than once", name)
+		}
+		seen[name] = true
+		parsed = append(parsed, Requirement{Name: name, Specifier: match[2]})
+	}
+
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Name < parsed[j].Name })
+	return parsed, nil
+}
+
+// Strings returns requirements in the form pip takes them
+func Strings(requirements []Requirement) []string {
+	values := make([]string, len(requirements))
+	for i, requirement := range requirements {
+		values[i] = requirement.String()
+	}
+	return values
+}
+
+// Disallowed returns the names of the requirements that are not on the allowlist
+func Disallowed(requirements []Requirement, allowlist []string) []string {
+	allowed := make(map[string]bool, len(allowlist))
+	for _, name := range allowlist {
+		allowed[Normalize(name)] = true
+	}
+
+	var names []string
+	for _, requirement := range requirements {
+		if !allowed[requirement.Name] {
+			names = append(names, requirement.Name)
+		}
+	}
+	return names
+}
+
+// Hash identifies an environment: the requirements installed for one runtime.
+// Requirements are expected in the normalized, sorted form Parse returns.
+func Hash(runtime string, requirements []string) string {
+	sum := sha256.Sum256([]byte(runtime + "\n" + strings.Join(requirements, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Allowlist returns the packages executions may require: the admin-set
+// package policy, or defaults when no policy has been set
+func Allowlist(database *gorm.DB, defaults []string) ([]string, error) {
+	var policy models.PackagePolicy
+	err := database.Where("id = ?", models.PackagePolicyID).First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy.Allowlist, nil
+}
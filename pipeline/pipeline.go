@@ -0,0 +1,362 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/middleware"
+	"go-deepsandbox/models"
+)
+
+// MaxSteps caps the number of steps in a pipeline
+const MaxSteps = 50
+
+// stepNamePattern matches valid step names; a step's outputs are mounted in
+// a directory named after it
+var stepNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Errors returned when a pipeline cannot change status
+var (
+	ErrNotRunning   = errors.New("pipeline is not running")
+	ErrNotRetryable = errors.New("only failed or cancelled pipelines can be retried")
+	ErrStepsActive  = errors.New("pipeline still has steps running")
+)
+
+// ValidateSteps checks that step names are valid and unique, that every
+// dependency names another step and that the dependencies have no cycles
+func ValidateSteps(steps []models.PipelineStepCreate) error {
+	if len(steps) > MaxSteps {
+		return fmt.Errorf("a pipeline can have at most %d steps", MaxSteps)
+	}
+
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if !stepNamePattern.MatchString(step.Name) {
+			return fmt.Errorf("invalid step name %q: use letters, digits, _ and -", step.Name)
+		}
+		if _, dup := index[step.Name]; dup {
+			return fmt.Errorf("duplicate step name %q", step.Name)
+		}
+		index[step.Name] = i
+	}
+
+	// Kahn's algorithm: repeatedly remove steps with no pending dependencies
+	pending := make([]int, len(steps))
+	dependents := make(map[string][]int, len(steps))
+	for i, step := range steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("step %q depends on unknown step %q", step.Name, dep)
+			}
+			if dep == step.Name {
+				return fmt.Errorf("step %q depends on itself", step.Name)
+			}
+			pending[i]++
+			dependents[dep] = append(dependents[dep], i)
+		}
+	}
+
+	var ready []int
+	for i := range steps {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	visited := 0
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, j := range dependents[steps[i].Name] {
+			pending[j]--
+			if pending[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+	if visited != len(steps) {
+		return errors.New("step dependencies contain a cycle")
+	}
+	return nil
+}
+
+// Advance submits every waiting step whose dependencies have all completed
+// and updates the pipeline's status from its steps. No new steps start once
+// a step has failed or the pipeline was cancelled.
+func Advance(database *gorm.DB, taskQueue *db.TaskQueue, cfg *config.Config, pipelineID string) error {
+	var pipeline models.Pipeline
+	if err := database.Preload("Steps").Where("id = ?", pipelineID).First(&pipeline).Error; err != nil {
+		return fmt.Errorf("pipeline %s not found: %w", pipelineID, err)
+	}
+	if pipeline.Status != models.PipelineRunning {
+		return nil
+	}
+
+	if !hasFailure(pipeline.Steps) {
+		status := make(map[string]string, len(pipeline.Steps))
+		for _, step := range pipeline.Steps {
+			status[step.Name] = step.Status
+		}
+		for i := range pipeline.Steps {
+			step := &pipeline.Steps[i]
+			if step.Status == models.StepWaiting && dependenciesCompleted(step, status) {
+				submitStep(database, taskQueue, cfg, &pipeline, step)
+			}
+		}
+	}
+
+	// Steps may have been submitted or failed to submit above
+	var steps []models.PipelineStep
+	if err := database.Where("pipeline_id = ?", pipelineID).Find(&steps).Error; err != nil {
+		return err
+	}
+	status, reason := pipelineStatus(steps)
+	if status == models.PipelineRunning {
+		return nil
+	}
+
+	finished := database.Model(&models.Pipeline{}).
+		Where("id = ? AND status = ?", pipelineID, models.PipelineRunning).
+		Updates(map[string]interface{}{"status": status, "error": reason})
+	if finished.Error == nil && finished.RowsAffected > 0 {
+		log.Printf("Pipeline %s %s\n", pipelineID, status)
+	}
+	return finished.Error
+}
+
+// RecordOutcome records the final status of an execution that ran a
+// pipeline step and advances the pipeline
+func RecordOutcome(database *gorm.DB, taskQueue *db.TaskQueue, cfg *config.Config, execution *models.CodeExecution) {
+	if execution.PipelineID == "" {
+		return
+	}
+
+	database.Model(&models.PipelineStep{}).
+		Where("pipeline_id = ? AND execution_id = ?", execution.PipelineID, execution.ID).
+		Updates(map[string]interface{}{"status": execution.Status, "error": execution.Error})
+
+	if err := Advance(database, taskQueue, cfg, execution.PipelineID); err != nil {
+		log.Printf("Failed to advance pipeline %s: %v\n", execution.PipelineID, err)
+	}
+}
+
+// Cancel stops a running pipeline: waiting steps are cancelled and the
+// executions of queued and running steps are cancelled like DELETE
+// /tasks/:task_id does
+func Cancel(database *gorm.DB, taskQueue *db.TaskQueue, pipelineID, requestedBy string) error {
+	reason := "Cancelled by " + requestedBy
+	cancelled := database.Model(&models.Pipeline{}).
+		Where("id = ? AND status = ?", pipelineID, models.PipelineRunning).
+		Updates(map[string]interface{}{"status": models.PipelineCancelled, "error": reason})
+	if cancelled.Error != nil {
+		return cancelled.Error
+	}
+	if cancelled.RowsAffected == 0 {
+		return ErrNotRunning
+	}
+
+	database.Model(&models.PipelineStep{}).
+		Where("pipeline_id = ? AND status = ?", pipelineID, models.StepWaiting).
+		Updates(map[string]interface{}{"status": models.StatusCancelled, "error": reason})
+
+	// No step is submitted once the pipeline is no longer running
+	var active []models.PipelineStep
+	err := database.Where("pipeline_id = ? AND status IN ?", pipelineID, []string{models.StatusQueued, models.StatusRunning}).
+		Find(&active).Error
+	if err != nil {
+		return err
+	}
+
+	for _, step := range active {
+		outcome, err := taskQueue.CancelTask(step.ExecutionID, requestedBy)
+		if err != nil || outcome != db.CancelRemoved {
+			// Running steps are stopped by their worker, which records the outcome
+			continue
+		}
+
+		// The execution never started
+		endTime := db.CurrentTimestamp()
+		database.Model(&models.CodeExecution{}).Where("id = ?", step.ExecutionID).Updates(map[string]interface{}{
+			"status":   models.StatusCancelled,
+			"end_time": endTime,
+			"error":    reason,
+		})
+		taskQueue.PublishFinalStatus(step.ExecutionID)
+		database.Model(&models.PipelineStep{}).
+			Where("pipeline_id = ? AND name = ?", pipelineID, step.Name).
+			Updates(map[string]interface{}{"status": models.StatusCancelled, "error": reason})
+	}
+	return nil
+}
+
+// Retry restarts a failed or cancelled pipeline from its unfinished steps.
+// Completed steps are kept and their outputs reused.
+func Retry(database *gorm.DB, taskQueue *db.TaskQueue, cfg *config.Config, pipeline *models.Pipeline) error {
+	if pipeline.Status != models.PipelineFailed && pipeline.Status != models.PipelineCancelled {
+		return ErrNotRetryable
+	}
+	for _, step := range pipeline.Steps {
+		if step.Status == models.StatusQueued || step.Status == models.StatusRunning {
+			return ErrStepsActive
+		}
+	}
+
+	restarted := database.Model(&models.Pipeline{}).
+		Where("id = ? AND status = ?", pipeline.ID, pipeline.Status).
+		Updates(map[string]interface{}{"status": models.PipelineRunning, "error": ""})
+	if restarted.Error != nil {
+		return restarted.Error
+	}
+	if restarted.RowsAffected == 0 {
+		return ErrNotRetryable
+	}
+
+	database.Model(&models.PipelineStep{}).
+		Where("pipeline_id = ? AND status IN ?", pipeline.ID, []string{models.StatusFailed, models.StatusTimedOut, models.StatusCancelled}).
+		Updates(map[string]interface{}{"status": models.StepWaiting, "error": ""})
+
+	return Advance(database, taskQueue, cfg, pipeline.ID)
+}
+
+// StepInputs returns the execution IDs of the steps the step run by an
+// execution depends on, keyed by step name. It returns nil for executions
+// that are not pipeline steps.
+func StepInputs(database *gorm.DB, executionID string) (map[string]string, error) {
+	var step models.PipelineStep
+	err := database.Where("execution_id = ?", executionID).First(&step).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(step.DependsOn) == 0 {
+		return nil, nil
+	}
+
+	var dependencies []models.PipelineStep
+	if err := database.Where("pipeline_id = ? AND name IN ?", step.PipelineID, []string(step.DependsOn)).Find(&dependencies).Error; err != nil {
+		return nil, err
+	}
+
+	inputs := make(map[string]string, len(dependencies))
+	for _, dependency := range dependencies {
+		inputs[dependency.Name] = dependency.ExecutionID
+	}
+	return inputs, nil
+}
+
+// submitStep claims a waiting step and queues an execution for it. A step
+// that cannot be queued, or would exceed its owner's daily execution quota,
+// is marked failed.
+func submitStep(database *gorm.DB, taskQueue *db.TaskQueue, cfg *config.Config, pipeline *models.Pipeline, step *models.PipelineStep) {
+	executionID := uuid.New().String()
+
+	// Only one caller may submit the step
+	claimed := database.Model(&models.PipelineStep{}).
+		Where("pipeline_id = ? AND name = ? AND status = ?", pipeline.ID, step.Name, models.StepWaiting).
+		Updates(map[string]interface{}{
+			"status":       models.StatusQueued,
+			"execution_id": executionID,
+			"attempts":     gorm.Expr("attempts + 1"),
+		})
+	if claimed.Error != nil || claimed.RowsAffected == 0 {
+		return
+	}
+	failStep := func(reason string) {
+		database.Model(&models.PipelineStep{}).
+			Where("pipeline_id = ? AND name = ?", pipeline.ID, step.Name).
+			Updates(map[string]interface{}{"status": models.StatusFailed, "error": reason})
+	}
+
+	var owner models.User
+	if err := database.Where("id = ?", pipeline.UserID).First(&owner).Error; err != nil {
+		failStep("Pipeline owner not found")
+		return
+	}
+	reservation, err := middleware.ReserveExecution(taskQueue.Redis, owner.ID, middleware.ExecutionLimit(cfg, &owner))
+	if err == nil && reservation == "" {
+		failStep("Daily execution quota exceeded")
+		return
+	}
+
+	execution := &models.CodeExecution{
+		ID:         executionID,
+		UserID:     pipeline.UserID,
+		DatasetID:  pipeline.DatasetID,
+		Code:       step.Code,
+		Kind:       models.KindCode,
+		Timeout:    step.Timeout,
+		Priority:   pipeline.Priority,
+		PipelineID: pipeline.ID,
+		Datasets:   []models.ExecutionDataset{{Alias: models.PrimaryDatasetAlias, DatasetID: pipeline.DatasetID}},
+	}
+	if err := db.SubmitExecution(database, taskQueue, execution); err != nil {
+		log.Printf("Failed to submit step %s of pipeline %s: %v\n", step.Name, pipeline.ID, err)
+		if reservation != "" {
+			middleware.ReleaseExecution(taskQueue.Redis, reservation)
+		}
+		failStep("Failed to submit step")
+	}
+}
+
+// dependenciesCompleted reports whether every step a step depends on has completed
+func dependenciesCompleted(step *models.PipelineStep, status map[string]string) bool {
+	for _, dep := range step.DependsOn {
+		if status[dep] != models.StatusCompleted {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFailure reports whether any step failed, timed out or was cancelled
+func hasFailure(steps []models.PipelineStep) bool {
+	for _, step := range steps {
+		switch step.Status {
+		case models.StatusFailed, models.StatusTimedOut, models.StatusCancelled:
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineStatus derives a pipeline's status from its steps. A pipeline
+// stays running while any step is queued or running, or could still start.
+func pipelineStatus(steps []models.PipelineStep) (string, string) {
+	var failed, cancelled string
+	for _, step := range steps {
+		switch step.Status {
+		case models.StatusQueued, models.StatusRunning:
+			return models.PipelineRunning, ""
+		case models.StatusFailed, models.StatusTimedOut:
+			if failed == "" {
+				failed = step.Name
+			}
+		case models.StatusCancelled:
+			if cancelled == "" {
+				cancelled = step.Name
+			}
+		}
+	}
+
+	switch {
+	case failed != "":
+		return models.PipelineFailed, "Step " + failed + " failed"
+	case cancelled != "":
+		return models.PipelineCancelled, "Step " + cancelled + " was cancelled"
+	}
+	for _, step := range steps {
+		if step.Status != models.StatusCompleted {
+			return models.PipelineRunning, ""
+		}
+	}
+	return models.PipelineCompleted, ""
+}
@@ -50,6 +50,7 @@ func RegisterDatasetRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config)
 		datasetGroup.POST("/datasets/upload", datasetController.UploadDataset)
 		datasetGroup.GET("/datasets", datasetController.ListDatasets)
 		datasetGroup.GET("/datasets/:dataset_id", datasetController.GetDataset)
+		datasetGroup.PUT("/datasets/:dataset_id", datasetController.ReplaceDataset)
 		datasetGroup.DELETE("/datasets/:dataset_id", datasetController.DeleteDataset)
 	}
 }
@@ -70,8 +71,14 @@ func RegisterExecutionRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis
 			execQuotaGroup.POST("/execute", executionController.ExecuteCode)
 		}
 
+		// Execution history
+		executionGroup.GET("/executions", executionController.GetUserExecutions)
+
 		// Task management routes
 		executionGroup.GET("/tasks/:task_id", executionController.GetTaskStatus)
+		executionGroup.GET("/tasks/:task_id/logs", executionController.StreamTaskLogs)
+		executionGroup.GET("/tasks/:task_id/artifacts", executionController.ListTaskArtifacts)
+		executionGroup.GET("/tasks/:task_id/artifacts/*name", executionController.DownloadTaskArtifact)
 		executionGroup.DELETE("/tasks/:task_id", executionController.CancelTask)
 
 		// Admin routes
@@ -79,6 +86,119 @@ func RegisterExecutionRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis
 		adminGroup.Use(auth.AdminMiddleware())
 		{
 			adminGroup.GET("/admin/queue-status", executionController.GetQueueStatus)
+			adminGroup.GET("/admin/queue", executionController.GetQueuePositions)
+			adminGroup.GET("/admin/code-policy", executionController.GetCodePolicy)
+			adminGroup.PUT("/admin/code-policy", executionController.UpdateCodePolicy)
+			adminGroup.GET("/admin/package-policy", executionController.GetPackagePolicy)
+			adminGroup.PUT("/admin/package-policy", executionController.UpdatePackagePolicy)
+		}
+	}
+} 
+
+// RegisterSessionRoutes registers interactive session routes
+func RegisterSessionRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis.Client, cfg *config.Config) {
+	auth := middleware.NewAuth(db, cfg)
+	sessionController := controllers.NewSessionController(db, redisClient, cfg)
+
+	// All session routes require authentication
+	sessionGroup := router.Group("/api/v1/sessions")
+	sessionGroup.Use(auth.AuthMiddleware())
+	{
+		sessionGroup.POST("", sessionController.CreateSession)
+		sessionGroup.GET("", sessionController.ListSessions)
+		sessionGroup.GET("/:session_id", sessionController.GetSession)
+		sessionGroup.DELETE("/:session_id", sessionController.CloseSession)
+		sessionGroup.GET("/:session_id/cells/:cell_id", sessionController.GetCell)
+
+		// Every cell counts towards the execution quota
+		quotaGroup := sessionGroup.Group("")
+		quotaGroup.Use(auth.ExecutionQuotaMiddleware(redisClient))
+		{
+			quotaGroup.POST("/:session_id/cells", sessionController.RunCell)
 		}
 	}
-} 
\ No newline at end of file
+}
+
+// RegisterScheduleRoutes registers scheduled execution routes
+func RegisterScheduleRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
+	auth := middleware.NewAuth(db, cfg)
+	scheduleController := controllers.NewScheduleController(db, cfg)
+
+	// All schedule routes require authentication
+	scheduleGroup := router.Group("/api/v1/schedules")
+	scheduleGroup.Use(auth.AuthMiddleware())
+	{
+		scheduleGroup.POST("", scheduleController.CreateSchedule)
+		scheduleGroup.GET("", scheduleController.ListSchedules)
+		scheduleGroup.GET("/:schedule_id", scheduleController.GetSchedule)
+		scheduleGroup.PATCH("/:schedule_id", scheduleController.UpdateSchedule)
+		scheduleGroup.DELETE("/:schedule_id", scheduleController.DeleteSchedule)
+		scheduleGroup.GET("/:schedule_id/runs", scheduleController.GetScheduleRuns)
+	}
+}
+
+// RegisterPipelineRoutes registers multi-step pipeline routes
+func RegisterPipelineRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis.Client, cfg *config.Config) {
+	auth := middleware.NewAuth(db, cfg)
+	pipelineController := controllers.NewPipelineController(db, redisClient, cfg)
+
+	// All pipeline routes require authentication
+	pipelineGroup := router.Group("/api/v1/pipelines")
+	pipelineGroup.Use(auth.AuthMiddleware())
+	{
+		// Starting steps counts towards the execution quota
+		quotaGroup := pipelineGroup.Group("")
+		quotaGroup.Use(auth.ExecutionQuotaMiddleware(redisClient))
+		{
+			quotaGroup.POST("", pipelineController.CreatePipeline)
+			quotaGroup.POST("/:pipeline_id/retry", pipelineController.RetryPipeline)
+		}
+
+		pipelineGroup.GET("", pipelineController.ListPipelines)
+		pipelineGroup.GET("/:pipeline_id", pipelineController.GetPipeline)
+		pipelineGroup.DELETE("/:pipeline_id", pipelineController.CancelPipeline)
+	}
+}
+
+// RegisterQueryRoutes registers SQL query routes
+func RegisterQueryRoutes(router *gin.Engine, db *gorm.DB, redisClient *redis.Client, cfg *config.Config) {
+	auth := middleware.NewAuth(db, cfg)
+	queryController := controllers.NewQueryController(db, redisClient, cfg)
+
+	// All query routes require authentication
+	queryGroup := router.Group("/api/v1")
+	queryGroup.Use(auth.AuthMiddleware())
+	{
+		// Queries count towards the execution quota
+		quotaGroup := queryGroup.Group("")
+		quotaGroup.Use(auth.ExecutionQuotaMiddleware(redisClient))
+		{
+			quotaGroup.POST("/datasets/:dataset_id/query", queryController.RunQuery)
+			quotaGroup.POST("/query", queryController.RunQuery)
+		}
+
+		queryGroup.GET("/query/:task_id", queryController.GetQueryResult)
+	}
+}
+
+// RegisterRuntimeRoutes registers runtime registry routes
+func RegisterRuntimeRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
+	auth := middleware.NewAuth(db, cfg)
+	runtimeController := controllers.NewRuntimeController(db, cfg)
+
+	// All runtime routes require authentication
+	runtimeGroup := router.Group("/api/v1")
+	runtimeGroup.Use(auth.AuthMiddleware())
+	{
+		runtimeGroup.GET("/runtimes", runtimeController.ListRuntimes)
+
+		// Admin routes
+		adminGroup := runtimeGroup.Group("")
+		adminGroup.Use(auth.AdminMiddleware())
+		{
+			adminGroup.POST("/admin/runtimes", runtimeController.CreateRuntime)
+			adminGroup.PATCH("/admin/runtimes/:name", runtimeController.UpdateRuntime)
+			adminGroup.DELETE("/admin/runtimes/:name", runtimeController.DeleteRuntime)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go-deepsandbox/models"
+)
+
+// ArtifactLimits bounds what is kept of the files a job writes to its output
+// directory. Zero values mean no limit.
+type ArtifactLimits struct {
+	MaxFiles      int
+	MaxFileBytes  int64
+	MaxTotalBytes int64
+}
+
+// collectArtifacts copies the regular files the job wrote to its output
+// directory into job.ArtifactsDir and replaces the artifacts reported by the
+// harness with the ones that were kept. Files that would exceed the limits
+// are skipped. Symlinks and other special files are ignored so the sandbox
+// cannot make the worker copy files from the host.
+func collectArtifacts(workDir string, job *Job, result *Result) {
+	if job.ArtifactsDir == "" {
+		return
+	}
+
+	limits := job.ArtifactLimits
+	root := filepath.Join(workDir, outputDir)
+	var kept []models.Artifact
+	var total int64
+	skipped := 0
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if (limits.MaxFiles > 0 && len(kept) >= limits.MaxFiles) ||
+			(limits.MaxFileBytes > 0 && info.Size() > limits.MaxFileBytes) ||
+			(limits.MaxTotalBytes > 0 && total+info.Size() > limits.MaxTotalBytes) {
+			skipped++
+			return nil
+		}
+
+		artifact, err := copyArtifact(path, filepath.Join(job.ArtifactsDir, filepath.FromSlash(name)), name, info)
+		if err != nil {
+			log.Printf("Failed to keep artifact %s of job %s: %v\n", name, job.ID, err)
+			skipped++
+			return nil
+		}
+		kept = append(kept, *artifact)
+		total += artifact.Size
+		return nil
+	})
+
+	result.Artifacts = kept
+	result.ArtifactsSkipped = skipped
+}
+
+// copyArtifact copies one output file. The opened file must be the one that
+// was walked, so a file swapped for a symlink is rejected, and at most its
+// walked size is read.
+func copyArtifact(src, dst, name string, walked fs.FileInfo) (*models.Artifact, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	if opened, err := in.Stat(); err != nil || !os.SameFile(walked, opened) {
+		return nil, fmt.Errorf("file changed while being collected")
+	}
+	size := walked.Size()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	// Sniff the content type from the first bytes when the extension is unknown
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(io.LimitReader(in, size), head)
+	head = head[:n]
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+
+	if _, err := out.Write(head); err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(out, io.LimitReader(in, size-int64(n)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Artifact{Name: name, Size: int64(n) + written, ContentType: contentType}, nil
+}
@@ -0,0 +1,135 @@
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the cpu.max period in microseconds
+const cpuPeriod = 100000
+
+// cgroup is a cgroup v2 group holding a single sandbox
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a cgroup under parent with the given memory and CPU limits
+func newCgroup(parent, name string, memory int64, cpus float64) (*cgroup, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil || st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+
+	enableControllers(parent)
+
+	path := filepath.Join(cgroupRoot, parent, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", path, err)
+	}
+	cg := &cgroup{path: path}
+
+	limits := map[string]string{"pids.max": "256"}
+	if memory > 0 {
+		limits["memory.max"] = strconv.FormatInt(memory, 10)
+		limits["memory.swap.max"] = "0"
+	}
+	if cpus > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(cpus*cpuPeriod), cpuPeriod)
+	}
+
+	for file, value := range limits {
+		if err := cg.write(file, value); err != nil {
+			// memory.swap.max is missing when swap accounting is disabled
+			if file == "memory.swap.max" && os.IsNotExist(err) {
+				continue
+			}
+			cg.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	return cg, nil
+}
+
+// enableControllers turns on the memory, cpu and pids controllers on every
+// level from the hierarchy root down to parent. Levels that are already
+// enabled or not writable are left alone; missing controllers surface when
+// the limits are written.
+func enableControllers(parent string) {
+	dir := cgroupRoot
+	for _, part := range append([]string{""}, strings.Split(filepath.Clean(parent), "/")...) {
+		dir = filepath.Join(dir, part)
+		os.MkdirAll(dir, 0755)
+		writeCgroupFile(filepath.Join(dir, "cgroup.subtree_control"), "+memory +cpu +pids")
+	}
+}
+
+// writeCgroupFile writes an existing cgroup interface file
+func writeCgroupFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(value)
+	return err
+}
+
+// write sets a cgroup interface file
+func (cg *cgroup) write(file, value string) error {
+	return writeCgroupFile(filepath.Join(cg.path, file), value)
+}
+
+// addProcess moves a process into the cgroup
+func (cg *cgroup) addProcess(pid int) error {
+	if err := cg.write("cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return fmt.Errorf("failed to add process to cgroup: %w", err)
+	}
+	return nil
+}
+
+// kill kills every process in the cgroup
+func (cg *cgroup) kill() {
+	cg.write("cgroup.kill", "1")
+}
+
+// oomKilled reports whether the memory limit killed a process in the cgroup
+func (cg *cgroup) oomKilled() bool {
+	f, err := os.Open(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, _ := strconv.Atoi(fields[1])
+			return count > 0
+		}
+	}
+	return false
+}
+
+// remove deletes the cgroup, waiting briefly for its processes to be reaped
+func (cg *cgroup) remove() {
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		cg.kill()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
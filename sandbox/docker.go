@@ -0,0 +1,501 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-deepsandbox/config"
+)
+
+// dockerAPIVersion is the Docker Engine API version the runner speaks
+const dockerAPIVersion = "v1.41"
+
+// DockerRunner runs each job in a throwaway container through the Docker Engine API
+type DockerRunner struct {
+	Image       string
+	MemoryLimit int64   // bytes
+	CPULimit    float64 // CPUs
+	Network     string
+	Timeout     time.Duration
+	WorkDir     string
+
+	client  *http.Client
+	baseURL string
+	jobTracker
+}
+
+// NewDockerRunner creates a Docker runner from the Container* settings. The
+// daemon address comes from Config.DockerHost and may be a unix:// socket or a
+// tcp:// / http:// address, which lets the runner be pointed at a fake server.
+func NewDockerRunner(cfg *config.Config) (*DockerRunner, error) {
+	memory, err := ParseMemoryLimit(cfg.ContainerMemoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := ParseCPULimit(cfg.ContainerCPULimit)
+	if err != nil {
+		return nil, err
+	}
+
+	client, baseURL, err := newDockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DockerRunner{
+		Image:       cfg.ContainerImage,
+		MemoryLimit: memory,
+		CPULimit:    cpus,
+		Network:     cfg.ContainerNetwork,
+		Timeout:     time.Duration(cfg.ContainerTimeout) * time.Second,
+		WorkDir:     cfg.SandboxWorkDir,
+		client:      client,
+		baseURL:     baseURL,
+	}, nil
+}
+
+// newDockerClient builds an HTTP client for the given Docker host address
+func newDockerClient(host string) (*http.Client, string, error) {
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp", "http":
+		return &http.Client{}, "http://" + u.Host, nil
+	case "https":
+		return &http.Client{}, "https://" + u.Host, nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported docker host scheme %q", u.Scheme)
+}
+
+// dockerContainerConfig is the subset of the container create body the runner uses
+type dockerContainerConfig struct {
+	Image           string            `json:"Image"`
+	Cmd             []string          `json:"Cmd"`
+	Env             []string          `json:"Env"`
+	WorkingDir      string            `json:"WorkingDir"`
+	User            string            `json:"User"`
+	NetworkDisabled bool              `json:"NetworkDisabled"`
+	Labels          map[string]string `json:"Labels"`
+	HostConfig      dockerHostConfig  `json:"HostConfig"`
+}
+
+// dockerHostConfig holds the resource limits and mounts of a container
+type dockerHostConfig struct {
+	Binds          []string          `json:"Binds"`
+	NetworkMode    string            `json:"NetworkMode,omitempty"`
+	Memory         int64             `json:"Memory,omitempty"`
+	MemorySwap     int64             `json:"MemorySwap,omitempty"`
+	NanoCPUs       int64             `json:"NanoCpus,omitempty"`
+	PidsLimit      int64             `json:"PidsLimit,omitempty"`
+	CapDrop        []string          `json:"CapDrop"`
+	SecurityOpt    []string          `json:"SecurityOpt"`
+	ReadonlyRootfs bool              `json:"ReadonlyRootfs"`
+	Tmpfs          map[string]string `json:"Tmpfs"`
+}
+
+// Run creates a container for the job, waits for it to exit and returns its
+// output. The container is always removed, even when the run fails.
+func (r *DockerRunner) Run(ctx context.Context, job *Job) (*Result, error) {
+	entered := time.Now()
+	ctx, tracked, done := r.start(ctx, job.ID)
+	defer done()
+
+	workDir, err := prepareWorkDir(r.WorkDir, job)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	containerID, err := r.createContainer(ctx, r.containerConfig(job, workDir))
+	if err != nil {
+		return nil, err
+	}
+	defer r.removeContainer(containerID)
+
+	started := time.Now()
+	if err := r.do(ctx, http.MethodPost, "/containers/"+containerID+"/start", nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	return r.await(ctx, tracked, job, containerID, workDir, started, time.Since(entered))
+}
+
+// await follows a started container running the job until it exits, is
+// cancelled or times out, and returns the job's result. started is when the
+// container was started for the job and startup how long that took.
+func (r *DockerRunner) await(ctx context.Context, tracked *trackedJob, job *Job, containerID, workDir string, started time.Time, startup time.Duration) (*Result, error) {
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = r.Timeout
+	}
+
+	// Follow the logs while the container runs so output can be streamed
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- r.followLogs(containerID, tracked)
+	}()
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	exitCode, waitErr := r.waitContainer(runCtx, containerID)
+	if waitErr != nil {
+		// Stop the container before collecting whatever output it produced
+		r.killContainer(containerID)
+	}
+
+	var logsErr error
+	select {
+	case logsErr = <-logsDone:
+	case <-time.After(30 * time.Second):
+		logsErr = fmt.Errorf("timed out reading container logs")
+	}
+
+	result := tracked.result(exitCode, started)
+	result.Startup = startup
+	if logsErr != nil {
+		result.LogError = logsErr.Error()
+	}
+	readHarnessResult(workDir, result)
+	collectArtifacts(workDir, job, result)
+	if waitErr != nil {
+		switch {
+		case tracked.wasCancelled():
+			return result, ErrCancelled
+		case runCtx.Err() == context.DeadlineExceeded:
+			return result, ErrTimedOut
+		}
+		return result, waitErr
+	}
+
+	return result, nil
+}
+
+// containerConfig builds the container definition for a job
+func (r *DockerRunner) containerConfig(job *Job, workDir string) *dockerContainerConfig {
+	binds := []string{workDir + ":" + sandboxDir}
+	env := []string{
+		"HOME=/tmp",
+		"PYTHONUNBUFFERED=1",
+	}
+	env = append(env, codeEnv(job, sandboxDir)...)
+	for _, datasetPath := range datasetFiles(job) {
+		binds = append(binds, datasetPath+":"+datasetDir+"/"+filepath.Base(datasetPath)+":ro")
+	}
+	env = append(env, datasetEnv(job, datasetDir)...)
+	for name, dir := range job.Inputs {
+		dir, _ = filepath.Abs(dir)
+		binds = append(binds, dir+":"+inputsDir+"/"+name+":ro")
+	}
+	env = append(env, inputsEnv(job, inputsDir)...)
+	if job.Packages != "" {
+		binds = append(binds, job.Packages+":"+packagesDir+":ro")
+	}
+	env = append(env, packagesEnv(job, packagesDir)...)
+	env = append(env, modeEnv(job)...)
+
+	return &dockerContainerConfig{
+		Image:           r.jobImage(job),
+		Cmd:             entryCommand(job, []string{"python3"}, sandboxDir),
+		Env:             env,
+		WorkingDir:      sandboxDir,
+		User:            "65534:65534",
+		NetworkDisabled: r.Network == "none",
+		Labels:          map[string]string{"deepsandbox.task": job.ID},
+		HostConfig: dockerHostConfig{
+			Binds:          binds,
+			NetworkMode:    r.Network,
+			Memory:         r.MemoryLimit,
+			MemorySwap:     r.MemoryLimit,
+			NanoCPUs:       int64(r.CPULimit * 1e9),
+			PidsLimit:      256,
+			CapDrop:        []string{"ALL"},
+			SecurityOpt:    []string{"no-new-privileges"},
+			ReadonlyRootfs: true,
+			Tmpfs:          map[string]string{"/tmp": "rw,size=64m"},
+		},
+	}
+}
+
+// jobImage returns the image the job runs in
+func (r *DockerRunner) jobImage(job *Job) string {
+	if job.Image != "" {
+		return job.Image
+	}
+	return r.Image
+}
+
+// packageRuntime identifies the image and interpreter the job runs with
+func (r *DockerRunner) packageRuntime(job *Job) string {
+	return r.jobImage(job) + " " + strings.Join(runtimeCommand(job, []string{"python3"}), " ")
+}
+
+// installPackages runs pip in a throwaway container of the job's image, with
+// the network disabled, the wheelhouse mounted read-only and target mounted
+// as the install directory
+func (r *DockerRunner) installPackages(ctx context.Context, job *Job, wheelhouse, target string, requirements []string) (string, error) {
+	command := runtimeCommand(job, []string{"python3"})
+	containerConfig := &dockerContainerConfig{
+		Image:           r.jobImage(job),
+		Cmd:             append(command, pipInstallArgs(wheelhouseDir, installDir, requirements)...),
+		Env:             []string{"HOME=/tmp"},
+		WorkingDir:      "/tmp",
+		User:            "65534:65534",
+		NetworkDisabled: true,
+		Labels:          map[string]string{"deepsandbox.task": job.ID},
+		HostConfig: dockerHostConfig{
+			Binds:          []string{wheelhouse + ":" + wheelhouseDir + ":ro", target + ":" + installDir},
+			NetworkMode:    "none",
+			Memory:         r.MemoryLimit,
+			MemorySwap:     r.MemoryLimit,
+			NanoCPUs:       int64(r.CPULimit * 1e9),
+			PidsLimit:      256,
+			CapDrop:        []string{"ALL"},
+			SecurityOpt:    []string{"no-new-privileges"},
+			ReadonlyRootfs: true,
+			Tmpfs:          map[string]string{"/tmp": "rw,size=256m"},
+		},
+	}
+
+	containerID, err := r.createContainer(ctx, containerConfig)
+	if err != nil {
+		return "", err
+	}
+	defer r.removeContainer(containerID)
+
+	if err := r.do(ctx, http.MethodPost, "/containers/"+containerID+"/start", nil, nil); err != nil {
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+	exitCode, err := r.waitContainer(ctx, containerID)
+	if err != nil {
+		r.killContainer(containerID)
+		return "", err
+	}
+
+	var output bytes.Buffer
+	resp, err := r.request(context.Background(), http.MethodGet, "/containers/"+containerID+"/logs?stdout=true&stderr=true", nil)
+	if err == nil {
+		demuxDockerStream(resp.Body, &output, &output)
+		resp.Body.Close()
+	}
+	if exitCode != 0 {
+		return output.String(), fmt.Errorf("pip exited with code %d", exitCode)
+	}
+	return output.String(), nil
+}
+
+// createContainer creates the container, pulling the image once if it is missing
+func (r *DockerRunner) createContainer(ctx context.Context, containerConfig *dockerContainerConfig) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	err := r.do(ctx, http.MethodPost, "/containers/create", containerConfig, &created)
+	if isDockerNotFound(err) {
+		if pullErr := r.pullImage(ctx, containerConfig.Image); pullErr != nil {
+			return "", fmt.Errorf("failed to pull image %s: %w", containerConfig.Image, pullErr)
+		}
+		err = r.do(ctx, http.MethodPost, "/containers/create", containerConfig, &created)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+// pullImage pulls an image and waits for the pull to finish
+func (r *DockerRunner) pullImage(ctx context.Context, image string) error {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+
+	query := url.Values{"fromImage": {name}, "tag": {tag}}
+	resp, err := r.request(ctx, http.MethodPost, "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The pull only completes once the progress stream has been consumed
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// waitContainer blocks until the container exits and returns its exit code
+func (r *DockerRunner) waitContainer(ctx context.Context, containerID string) (int, error) {
+	var waited struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+
+	if err := r.do(ctx, http.MethodPost, "/containers/"+containerID+"/wait", nil, &waited); err != nil {
+		return -1, err
+	}
+	if waited.Error != nil && waited.Error.Message != "" {
+		return waited.StatusCode, fmt.Errorf("container wait failed: %s", waited.Error.Message)
+	}
+
+	return waited.StatusCode, nil
+}
+
+// killContainer sends SIGKILL to a container
+func (r *DockerRunner) killContainer(containerID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.do(ctx, http.MethodPost, "/containers/"+containerID+"/kill", nil, nil)
+}
+
+// removeContainer force-removes a container and its anonymous volumes
+func (r *DockerRunner) removeContainer(containerID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return r.do(ctx, http.MethodDelete, "/containers/"+containerID+"?force=true&v=true", nil, nil)
+}
+
+// followLogs streams the container's stdout and stderr into the tracked job
+// until the container stops
+func (r *DockerRunner) followLogs(containerID string, tracked *trackedJob) error {
+	resp, err := r.request(context.Background(), http.MethodGet, "/containers/"+containerID+"/logs?follow=true&stdout=true&stderr=true", nil)
+	if err != nil {
+		return fmt.Errorf("failed to read container logs: %w", err)
+	}
+	defer resp.Body.Close()
+
+	stdout, stderr := tracked.writer("stdout"), tracked.writer("stderr")
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	if err := demuxDockerStream(resp.Body, stdout, stderr); err != nil {
+		return fmt.Errorf("failed to read container logs: %w", err)
+	}
+	return nil
+}
+
+// demuxDockerStream splits Docker's multiplexed log stream into stdout and stderr.
+// Each frame starts with an 8 byte header: the stream type followed by the
+// big-endian payload size in the last four bytes.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		var dst io.Writer
+		switch header[0] {
+		case 1:
+			dst = stdout
+		case 2:
+			dst = stderr
+		default:
+			dst = io.Discard
+		}
+
+		if _, err := io.CopyN(dst, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// dockerError is returned for non-2xx responses from the Docker API
+type dockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// isDockerNotFound reports whether err is a 404 from the Docker API
+func isDockerNotFound(err error) bool {
+	dockerErr, ok := err.(*dockerError)
+	return ok && dockerErr.StatusCode == http.StatusNotFound
+}
+
+// request sends a request to the Docker API and returns the response when it succeeded
+func (r *DockerRunner) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+"/"+dockerAPIVersion+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, &dockerError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+
+	return resp, nil
+}
+
+// do sends a request to the Docker API and decodes the JSON response into out
+func (r *DockerRunner) do(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := r.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,320 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-deepsandbox/config"
+)
+
+// fakeContainer is a container of the fake Docker daemon
+type fakeContainer struct {
+	config  dockerContainerConfig
+	started bool
+	killed  bool
+	removed bool
+	exited  chan struct{}
+}
+
+// fakeDocker is a Docker Engine API server that runs no containers. Started
+// containers write stdout and stderr and exit with exitCode, or run until
+// they are killed when hang is set.
+type fakeDocker struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	hang     bool
+	// brokenLogs makes the log stream end in the middle of a frame
+	brokenLogs bool
+
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	server     *httptest.Server
+}
+
+// newFakeDocker starts a fake Docker daemon listening on a unix socket, like
+// the real one, that is stopped with the test
+func newFakeDocker(t *testing.T) *fakeDocker {
+	// Socket paths are limited to about 100 bytes, too short for t.TempDir
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDocker{containers: map[string]*fakeContainer{}}
+	d.server = httptest.NewUnstartedServer(http.HandlerFunc(d.serve))
+	d.server.Listener = listener
+	d.server.Start()
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+// runner returns a DockerRunner talking to the fake daemon
+func (d *fakeDocker) runner(t *testing.T) *DockerRunner {
+	runner, err := NewDockerRunner(&config.Config{
+		DockerHost:           "unix://" + d.server.Listener.Addr().String(),
+		ContainerImage:       "python:3.11-slim",
+		ContainerMemoryLimit: "512m",
+		ContainerCPULimit:    "1",
+		ContainerNetwork:     "none",
+		ContainerTimeout:     30,
+		SandboxWorkDir:       t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewDockerRunner: %v", err)
+	}
+	return runner
+}
+
+// container returns the container with the given ID
+func (d *fakeDocker) container(id string) *fakeContainer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.containers[id]
+}
+
+// only returns the single container created so far
+func (d *fakeDocker) only(t *testing.T) *fakeContainer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.containers) != 1 {
+		t.Fatalf("created %d containers, want 1", len(d.containers))
+	}
+	for _, c := range d.containers {
+		return c
+	}
+	return nil
+}
+
+func (d *fakeDocker) serve(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/"+dockerAPIVersion)
+	if path == "/containers/create" && req.Method == http.MethodPost {
+		var config dockerContainerConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		id := "container" + string(rune('a'+len(d.containers)))
+		d.containers[id] = &fakeContainer{config: config, exited: make(chan struct{})}
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+		return
+	}
+
+	rest := strings.TrimPrefix(path, "/containers/")
+	id, action, _ := strings.Cut(rest, "/")
+	c := d.container(id)
+	if c == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + id})
+		return
+	}
+
+	switch {
+	case action == "start" && req.Method == http.MethodPost:
+		d.mu.Lock()
+		c.started = true
+		if !d.hang {
+			close(c.exited)
+		}
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "wait" && req.Method == http.MethodPost:
+		select {
+		case <-c.exited:
+		case <-req.Context().Done():
+			return
+		}
+		d.mu.Lock()
+		code := d.exitCode
+		if c.killed {
+			code = 137
+		}
+		d.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": code})
+	case action == "logs" && req.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		writeFrame(w, 1, d.stdout)
+		writeFrame(w, 2, d.stderr)
+		if d.brokenLogs {
+			// A frame header whose payload never arrives
+			header := make([]byte, 8)
+			header[0] = 1
+			binary.BigEndian.PutUint32(header[4:], 100)
+			w.Write(header)
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-c.exited
+	case action == "kill" && req.Method == http.MethodPost:
+		d.mu.Lock()
+		if !c.killed {
+			c.killed = true
+			select {
+			case <-c.exited:
+			default:
+				close(c.exited)
+			}
+		}
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && req.Method == http.MethodDelete:
+		d.mu.Lock()
+		c.removed = true
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// writeFrame writes a frame of Docker's multiplexed log stream
+func writeFrame(w http.ResponseWriter, stream byte, text string) {
+	if text == "" {
+		return
+	}
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(text)))
+	w.Write(append(header, text...))
+}
+
+func TestDockerRunnerRun(t *testing.T) {
+	d := newFakeDocker(t)
+	d.stdout = "hello\n"
+	d.stderr = "warning\n"
+	runner := d.runner(t)
+
+	result, err := runner.Run(context.Background(), &Job{ID: "job-1", Code: "print('hello')"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Stdout != "hello\n" || result.Stderr != "warning\n" || result.ExitCode != 0 {
+		t.Errorf("result = %q, %q, %d; want the container's output and exit code 0", result.Stdout, result.Stderr, result.ExitCode)
+	}
+	if result.LogError != "" {
+		t.Errorf("LogError = %q, want none", result.LogError)
+	}
+
+	c := d.only(t)
+	if !c.started || !c.removed {
+		t.Errorf("container started = %v, removed = %v; want both", c.started, c.removed)
+	}
+	host := c.config.HostConfig
+	if c.config.Image != "python:3.11-slim" || host.Memory != 512<<20 || host.NanoCPUs != 1e9 || host.NetworkMode != "none" {
+		t.Errorf("container config does not honor the Container* settings: %+v", c.config)
+	}
+	if !host.ReadonlyRootfs || c.config.User != "65534:65534" {
+		t.Errorf("container is not locked down: %+v", c.config)
+	}
+}
+
+func TestDockerRunnerTimeout(t *testing.T) {
+	d := newFakeDocker(t)
+	d.hang = true
+	d.stdout = "started\n"
+	runner := d.runner(t)
+
+	result, err := runner.Run(context.Background(), &Job{ID: "job-1", Code: "while True: pass", Timeout: 100 * time.Millisecond})
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("Run error = %v, want ErrTimedOut", err)
+	}
+	if result == nil || result.Stdout != "started\n" {
+		t.Errorf("result = %+v, want the output produced before the timeout", result)
+	}
+
+	c := d.only(t)
+	if !c.killed || !c.removed {
+		t.Errorf("container killed = %v, removed = %v; want both", c.killed, c.removed)
+	}
+}
+
+func TestDockerRunnerNonZeroExit(t *testing.T) {
+	d := newFakeDocker(t)
+	d.stderr = "Traceback (most recent call last):\n"
+	d.exitCode = 1
+	runner := d.runner(t)
+
+	result, err := runner.Run(context.Background(), &Job{ID: "job-1", Code: "raise ValueError()"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.ExitCode != 1 || result.Stderr != d.stderr {
+		t.Errorf("result = %d, %q; want exit code 1 and the traceback", result.ExitCode, result.Stderr)
+	}
+	if !d.only(t).removed {
+		t.Error("container was not removed")
+	}
+}
+
+func TestDockerRunnerLogReadFailure(t *testing.T) {
+	d := newFakeDocker(t)
+	d.stdout = "partial\n"
+	d.brokenLogs = true
+	runner := d.runner(t)
+
+	result, err := runner.Run(context.Background(), &Job{ID: "job-1", Code: "print('partial')"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.ExitCode != 0 || result.Stdout != "partial\n" {
+		t.Errorf("result = %d, %q; want the exit code and the output read", result.ExitCode, result.Stdout)
+	}
+	if !strings.Contains(result.LogError, "failed to read container logs") {
+		t.Errorf("LogError = %q, want the log read failure", result.LogError)
+	}
+	if !d.only(t).removed {
+		t.Error("container was not removed")
+	}
+}
+
+func TestDockerWarmSandboxMountsDatasetsReadOnly(t *testing.T) {
+	d := newFakeDocker(t)
+	runner := d.runner(t)
+
+	warm, err := runner.startWarm(&Job{})
+	if err != nil {
+		t.Fatalf("startWarm: %v", err)
+	}
+	sandbox := warm.(*dockerWarmSandbox)
+	binds := d.only(t).config.HostConfig.Binds
+	want := sandbox.dataDir + ":" + datasetDir + ":ro"
+	if len(binds) != 2 || binds[1] != want {
+		t.Errorf("binds = %v, want the work directory and %s", binds, want)
+	}
+
+	dataset := filepath.Join(t.TempDir(), "dataset.csv")
+	if err := os.WriteFile(dataset, []byte("a,b\n1,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	placed := filepath.Join(sandbox.dataDir, "dataset.csv")
+	if err := linkOrCopy(dataset, placed); err != nil {
+		t.Fatalf("linkOrCopy: %v", err)
+	}
+	if data, err := os.ReadFile(placed); err != nil || string(data) != "a,b\n1,2\n" {
+		t.Errorf("placed dataset = %q, %v; want the dataset", data, err)
+	}
+
+	sandbox.destroy()
+	if _, err := os.Stat(sandbox.dataDir); !os.IsNotExist(err) {
+		t.Errorf("dataset directory left behind: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dockerWarmSandbox is a started container whose harness waits for its job.
+// Datasets cannot be mounted once the container has started, so dataDir is
+// mounted read-only at /data up front and the job's datasets are placed in
+// it when the job arrives.
+type dockerWarmSandbox struct {
+	runner      *DockerRunner
+	containerID string
+	workDir     string
+	dataDir     string
+}
+
+// warmKey identifies the image and interpreter the job runs with. Pipeline
+// inputs and packages are mounted when the container is created, so jobs
+// that have them cannot use a warm container.
+func (r *DockerRunner) warmKey(job *Job) (string, bool) {
+	if !usesHarness(job) || job.Session || len(job.Inputs) > 0 || job.Packages != "" {
+		return "", false
+	}
+	return r.packageRuntime(job), true
+}
+
+// startWarm creates and starts a container of the job's runtime with its
+// work directory and an empty dataset directory mounted
+func (r *DockerRunner) startWarm(job *Job) (warmSandbox, error) {
+	workDir, err := prepareWarmDir(r.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+	// The dataset directory is kept out of the work directory, which the
+	// sandboxed process can write to
+	dataDir := workDir + "-data"
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		os.RemoveAll(workDir)
+		return nil, fmt.Errorf("failed to create dataset directory: %w", err)
+	}
+
+	containerConfig := r.containerConfig(&Job{Image: job.Image, Command: job.Command, Language: job.Language}, workDir)
+	containerConfig.Env = append(containerConfig.Env, warmEnv)
+	containerConfig.Labels = map[string]string{"deepsandbox.warm": filepath.Base(workDir)}
+	containerConfig.HostConfig.Binds = append(containerConfig.HostConfig.Binds, dataDir+":"+datasetDir+":ro")
+
+	ctx := context.Background()
+	sandbox := &dockerWarmSandbox{runner: r, workDir: workDir, dataDir: dataDir}
+	containerID, err := r.createContainer(ctx, containerConfig)
+	if err != nil {
+		sandbox.destroy()
+		return nil, err
+	}
+	sandbox.containerID = containerID
+	if err := r.do(ctx, http.MethodPost, "/containers/"+containerID+"/start", nil, nil); err != nil {
+		sandbox.destroy()
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+	return sandbox, nil
+}
+
+// runWarm places the job's datasets in the container's dataset directory,
+// hands the job to its harness and follows the container until it exits
+func (r *DockerRunner) runWarm(ctx context.Context, job *Job, warm warmSandbox, entered time.Time) (*Result, error) {
+	sandbox := warm.(*dockerWarmSandbox)
+	defer sandbox.destroy()
+
+	running, err := r.containerRunning(ctx, sandbox.containerID)
+	if err != nil || !running {
+		return nil, fmt.Errorf("%w: container is not running", errWarmUnusable)
+	}
+
+	for _, datasetPath := range datasetFiles(job) {
+		if err := linkOrCopy(datasetPath, filepath.Join(sandbox.dataDir, filepath.Base(datasetPath))); err != nil {
+			return nil, fmt.Errorf("%w: %v", errWarmUnusable, err)
+		}
+	}
+
+	env := codeEnv(job, sandboxDir)
+	env = append(env, datasetEnv(job, datasetDir)...)
+	env = append(env, modeEnv(job)...)
+	if err := assignWarmJob(sandbox.workDir, job, env); err != nil {
+		return nil, fmt.Errorf("%w: %v", errWarmUnusable, err)
+	}
+
+	ctx, tracked, done := r.start(ctx, job.ID)
+	defer done()
+
+	started := time.Now()
+	return r.await(ctx, tracked, job, sandbox.containerID, sandbox.workDir, started, started.Sub(entered))
+}
+
+// containerRunning reports whether the container is running
+func (r *DockerRunner) containerRunning(ctx context.Context, containerID string) (bool, error) {
+	var inspected struct {
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/containers/"+containerID+"/json", nil, &inspected); err != nil {
+		return false, err
+	}
+	return inspected.State.Running, nil
+}
+
+// destroy removes the container and its directories
+func (s *dockerWarmSandbox) destroy() {
+	if s.containerID != "" {
+		s.runner.removeContainer(s.containerID)
+	}
+	os.RemoveAll(s.workDir)
+	os.RemoveAll(s.dataDir)
+}
+
+// linkOrCopy hard links src to dst, or copies it when they are on different
+// filesystems, as with separate bind mounts. Copies are made read-only.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", filepath.Base(src), err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,260 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-deepsandbox/config"
+)
+
+// Executor backends selectable through Config.ExecutorBackend
+const (
+	BackendDocker    = "docker"
+	BackendLocal     = "local"
+	BackendNamespace = "namespace"
+	BackendFake      = "fake"
+)
+
+// ErrCancelled is returned when a job was stopped through Cancel
+var ErrCancelled = errors.New("execution cancelled")
+
+// maxReplayLines caps how many output lines are replayed to new Stream subscribers
+const maxReplayLines = 10000
+
+// maxLineBytes caps how long a published output line gets; longer lines are
+// published in pieces of this size
+const maxLineBytes = 64 << 10
+
+// ErrJobNotRunning is returned by Cancel and Stream for unknown or finished jobs
+var ErrJobNotRunning = errors.New("job is not running")
+
+// Executor runs jobs inside some kind of sandbox
+type Executor interface {
+	// Run executes the job and blocks until it finishes, is cancelled or times out
+	Run(ctx context.Context, job *Job) (*Result, error)
+	// Cancel stops a running job; its Run call returns ErrCancelled
+	Cancel(jobID string) error
+	// Stream returns the output lines of a running job, starting with the
+	// lines it has already produced. The channel is closed when the job ends.
+	Stream(jobID string) (<-chan OutputLine, error)
+}
+
+// OutputLine is a single line written by a job to stdout or stderr
+type OutputLine struct {
+	Stream string  `json:"stream"`
+	Text   string  `json:"text"`
+	Time   float64 `json:"time"`
+}
+
+// NewExecutor creates the executor selected by Config.ExecutorBackend
+func NewExecutor(cfg *config.Config) (Executor, error) {
+	switch cfg.ExecutorBackend {
+	case BackendDocker, "":
+		return NewDockerRunner(cfg)
+	case BackendLocal:
+		return NewLocalExecutor(cfg)
+	case BackendNamespace:
+		return NewNamespaceExecutor(cfg)
+	case BackendFake:
+		return NewFakeExecutor(), nil
+	}
+	return nil, fmt.Errorf("unknown executor backend %q", cfg.ExecutorBackend)
+}
+
+// jobTracker keeps the cancel function and stream subscribers of running jobs.
+// Executors embed it to get Cancel and Stream.
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*trackedJob
+}
+
+// trackedJob is the bookkeeping for one running job
+type trackedJob struct {
+	mu          sync.Mutex
+	cancel      context.CancelFunc
+	cancelled   bool
+	subscribers []chan OutputLine
+	lines       []OutputLine
+	stdout      limitedBuffer
+	stderr      limitedBuffer
+}
+
+// start registers a job and returns a context that is cancelled by Cancel.
+// The returned function must be called once the job has finished.
+func (t *jobTracker) start(ctx context.Context, jobID string) (context.Context, *trackedJob, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &trackedJob{cancel: cancel}
+
+	t.mu.Lock()
+	if t.jobs == nil {
+		t.jobs = make(map[string]*trackedJob)
+	}
+	t.jobs[jobID] = job
+	t.mu.Unlock()
+
+	return ctx, job, func() {
+		t.mu.Lock()
+		delete(t.jobs, jobID)
+		t.mu.Unlock()
+		cancel()
+		job.close()
+	}
+}
+
+// get returns a running job
+func (t *jobTracker) get(jobID string) (*trackedJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	job, ok := t.jobs[jobID]
+	if !ok {
+		return nil, ErrJobNotRunning
+	}
+	return job, nil
+}
+
+// Cancel stops a running job
+func (t *jobTracker) Cancel(jobID string) error {
+	job, err := t.get(jobID)
+	if err != nil {
+		return err
+	}
+
+	job.mu.Lock()
+	job.cancelled = true
+	job.mu.Unlock()
+	job.cancel()
+	return nil
+}
+
+// Stream subscribes to the output of a running job
+func (t *jobTracker) Stream(jobID string) (<-chan OutputLine, error) {
+	job, err := t.get(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	ch := make(chan OutputLine, len(job.lines)+256)
+	for _, line := range job.lines {
+		ch <- line
+	}
+	job.subscribers = append(job.subscribers, ch)
+	return ch, nil
+}
+
+// wasCancelled reports whether Cancel was called for the job
+func (j *trackedJob) wasCancelled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelled
+}
+
+// publish sends a line to every subscriber. Slow subscribers miss lines
+// rather than blocking the job.
+func (j *trackedJob) publish(line OutputLine) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.lines) < maxReplayLines {
+		j.lines = append(j.lines, line)
+	}
+	for _, ch := range j.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// close ends every subscription
+func (j *trackedJob) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// writer returns an io.Writer that captures a stream into the job's buffer
+// and publishes it line by line
+func (j *trackedJob) writer(stream string) *lineWriter {
+	buffer := &j.stdout
+	if stream == "stderr" {
+		buffer = &j.stderr
+	}
+	return &lineWriter{job: j, stream: stream, buffer: buffer}
+}
+
+// result builds a Result from the captured output
+func (j *trackedJob) result(exitCode int, started time.Time) *Result {
+	return &Result{
+		Stdout:   j.stdout.String(),
+		Stderr:   j.stderr.String(),
+		ExitCode: exitCode,
+		Duration: time.Since(started),
+	}
+}
+
+// lineWriter captures output and publishes every complete line. Like the
+// captured output, what is published stops at maxOutputBytes.
+type lineWriter struct {
+	job     *trackedJob
+	stream  string
+	buffer  *limitedBuffer
+	partial []byte
+	written int
+}
+
+// Write implements io.Writer
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+
+	n := len(p)
+	if remaining := maxOutputBytes - w.written; len(p) > remaining {
+		p = p[:remaining]
+	}
+	w.written += len(p)
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.publish(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	// Output without newlines is not buffered without bound
+	for len(w.partial) >= maxLineBytes {
+		w.publish(w.partial[:maxLineBytes])
+		w.partial = w.partial[maxLineBytes:]
+	}
+	return n, nil
+}
+
+// publish publishes a line of the stream
+func (w *lineWriter) publish(text []byte) {
+	w.job.publish(OutputLine{Stream: w.stream, Text: string(text), Time: now()})
+}
+
+// Flush publishes a trailing line that did not end with a newline
+func (w *lineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.publish(w.partial)
+		w.partial = nil
+	}
+}
+
+// now returns the current time in seconds
+func now() float64 {
+	return float64(time.Now().UnixNano()) / 1e9
+}
@@ -0,0 +1,51 @@
+package sandbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLineWriterLongOutputWithoutNewline(t *testing.T) {
+	job := &trackedJob{}
+	w := job.writer("stdout")
+
+	chunk := bytes.Repeat([]byte("x"), 100<<10)
+	for written := 0; written < 3*maxOutputBytes; written += len(chunk) {
+		if n, err := w.Write(chunk); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v; want the whole chunk accepted", n, err)
+		}
+		if len(w.partial) >= maxLineBytes {
+			t.Fatalf("%d bytes are buffered waiting for a newline, want less than %d", len(w.partial), maxLineBytes)
+		}
+	}
+	w.Flush()
+
+	published := 0
+	for _, line := range job.lines {
+		if len(line.Text) > maxLineBytes {
+			t.Errorf("published a %d byte line, want at most %d", len(line.Text), maxLineBytes)
+		}
+		published += len(line.Text)
+	}
+	if published != maxOutputBytes {
+		t.Errorf("published %d bytes, want the first %d", published, maxOutputBytes)
+	}
+}
+
+func TestLineWriterSplitsLines(t *testing.T) {
+	job := &trackedJob{}
+	w := job.writer("stderr")
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\nthird"))
+	w.Flush()
+
+	want := []string{"first", "second", "third"}
+	if len(job.lines) != len(want) {
+		t.Fatalf("published %+v, want %v", job.lines, want)
+	}
+	for i, line := range job.lines {
+		if line.Text != want[i] || line.Stream != "stderr" {
+			t.Errorf("line %d = %+v, want %q on stderr", i, line, want[i])
+		}
+	}
+}
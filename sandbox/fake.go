@@ -0,0 +1,93 @@
+package sandbox
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeExecutor is an in-memory executor for tests. It never runs the code:
+// Handler decides the result, and its output is streamed line by line.
+type FakeExecutor struct {
+	// Handler returns the result of a job. By default the code is echoed to stdout.
+	Handler func(job *Job) (*Result, error)
+	// Delay is how long each job pretends to run
+	Delay time.Duration
+
+	mu   sync.Mutex
+	jobs []*Job
+	jobTracker
+}
+
+// NewFakeExecutor creates a fake executor
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{}
+}
+
+// Run records the job and returns the handler's result, honoring cancellation and timeouts
+func (e *FakeExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	e.mu.Lock()
+	e.jobs = append(e.jobs, job)
+	e.mu.Unlock()
+
+	ctx, tracked, done := e.start(ctx, job.ID)
+	defer done()
+
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	select {
+	case <-time.After(e.Delay):
+	case <-ctx.Done():
+		result := tracked.result(-1, started)
+		if tracked.wasCancelled() {
+			return result, ErrCancelled
+		}
+		return result, ErrTimedOut
+	}
+
+	result := &Result{Stdout: job.Code}
+	var err error
+	if e.Handler != nil {
+		result, err = e.Handler(job)
+	}
+	if result != nil {
+		e.publish(tracked, "stdout", result.Stdout)
+		e.publish(tracked, "stderr", result.Stderr)
+		result.Duration = time.Since(started)
+	}
+
+	return result, err
+}
+
+// Jobs returns every job the executor has been asked to run
+func (e *FakeExecutor) Jobs() []*Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Job(nil), e.jobs...)
+}
+
+// packageRuntime identifies the interpreter the job runs with
+func (e *FakeExecutor) packageRuntime(job *Job) string {
+	return strings.Join(job.Command, " ")
+}
+
+// installPackages pretends to install requirements and leaves target empty
+func (e *FakeExecutor) installPackages(ctx context.Context, job *Job, wheelhouse, target string, requirements []string) (string, error) {
+	return "", nil
+}
+
+// publish streams the lines of a fake output
+func (e *FakeExecutor) publish(tracked *trackedJob, stream, output string) {
+	if output == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		tracked.publish(OutputLine{Stream: stream, Text: line, Time: now()})
+	}
+}
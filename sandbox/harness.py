@@ -0,0 +1,546 @@
+"""Bootstrap that loads the dataset and runs the submitted code inside a sandbox.
+
+The dataset in DEEPSANDBOX_DATASET is loaded as data. DEEPSANDBOX_DATASETS
+may name further datasets as a JSON object of alias to path; every dataset is
+available in the datasets dict under its alias, data included.
+
+For pipeline steps, DEEPSANDBOX_INPUTS maps the names of the steps this one
+depends on to the directories holding their output files. They are available
+as INPUTS, and load_input() loads one of the files like a dataset.
+
+Besides stdout and stderr, which the executor captures, the harness writes a
+JSON document to DEEPSANDBOX_RESULT with the value of the last expression,
+the DataFrames passed to show() and the files written to OUTPUT_DIR.
+
+When DEEPSANDBOX_SESSION is set the harness instead serves code cells: it
+loads the dataset once, then executes cells/<n>.py in order in the same
+namespace and answers each with cells/<n>.json.
+
+When DEEPSANDBOX_KIND is "notebook" the code file is a Jupyter notebook whose
+code cells are run in order; the executed notebook, with the outputs of each
+cell, is added to the result document as "notebook".
+
+When DEEPSANDBOX_KIND is "sql" the code file is a read-only SQL query. Each
+dataset is a table named after its alias, data included. The query runs in
+DuckDB when it is installed and in SQLite otherwise, and its typed rows are
+added to the result document as "query".
+
+When DEEPSANDBOX_WARM is set the sandbox was started before its job was
+known. The harness imports pandas ahead of time, then waits for the worker to
+write job.json next to it and adds the "env" it holds to the environment
+before running the job as usual.
+"""
+import ast
+import base64
+import contextlib
+import csv
+import io
+import json
+import math
+import os
+import sys
+import time
+import traceback
+
+MAX_TABLE_ROWS = 1000
+MAX_QUERY_ROWS = 10000
+MAX_VALUE_CHARS = 10000
+MAX_CELL_OUTPUT_CHARS = 1 << 20
+CELLS_DIR = "cells"
+CELL_POLL_SECONDS = 0.02
+WARM_JOB_FILE = "job.json"
+WARM_POLL_SECONDS = 0.005
+
+
+def load_dataset(path):
+    """Load the dataset as a DataFrame when pandas is available, else return its path."""
+    if not path:
+        return None
+    try:
+        import pandas as pd
+    except ImportError:
+        return path
+    if path.endswith(".parquet"):
+        return pd.read_parquet(path)
+    return pd.read_csv(path)
+
+
+def is_table(value):
+    """Report whether value is a pandas DataFrame or Series without importing pandas."""
+    return type(value).__module__.startswith("pandas") and hasattr(value, "to_json")
+
+
+def to_table(name, value):
+    """Convert a DataFrame or Series to a JSON table with at most MAX_TABLE_ROWS rows."""
+    if hasattr(value, "to_frame"):
+        value = value.to_frame()
+    total = len(value)
+    head = value.head(MAX_TABLE_ROWS)
+    split = json.loads(head.to_json(orient="split", date_format="iso", default_handler=str))
+    return {
+        "name": name,
+        "columns": [str(c) for c in split["columns"]],
+        "dtypes": {str(c): str(t) for c, t in value.dtypes.items()},
+        "index": split.get("index", []),
+        "data": split["data"],
+        "total_rows": total,
+        "truncated": total > MAX_TABLE_ROWS,
+    }
+
+
+def to_json_value(value):
+    """Return value if it survives a JSON round trip, else its truncated repr."""
+    try:
+        encoded = json.dumps(value, allow_nan=False)
+        if len(encoded) <= MAX_VALUE_CHARS:
+            return json.loads(encoded)
+    except (TypeError, ValueError):
+        pass
+    if isinstance(value, float) and not math.isfinite(value):
+        return str(value)
+    return repr(value)[:MAX_VALUE_CHARS]
+
+
+def list_artifacts(output_dir):
+    """List the files written to the output directory."""
+    artifacts = []
+    if not os.path.isdir(output_dir):
+        return artifacts
+    for root, _, files in os.walk(output_dir):
+        for filename in sorted(files):
+            path = os.path.join(root, filename)
+            artifacts.append({
+                "name": os.path.relpath(path, output_dir),
+                "size": os.path.getsize(path),
+            })
+    return artifacts
+
+
+def run(source, namespace):
+    """Execute source and return the value of its last expression, if any."""
+    tree = ast.parse(source, "<submitted code>")
+    last = None
+    if tree.body and isinstance(tree.body[-1], ast.Expr):
+        last = ast.Expression(tree.body.pop().value)
+
+    exec(compile(tree, "<submitted code>", "exec"), namespace)
+    if last is not None:
+        return eval(compile(last, "<submitted code>", "eval"), namespace)
+    return None
+
+
+class CappedStringIO(io.StringIO):
+    """StringIO that keeps at most MAX_CELL_OUTPUT_CHARS characters."""
+
+    truncated = False
+
+    def write(self, text):
+        remaining = MAX_CELL_OUTPUT_CHARS - self.tell()
+        if len(text) > remaining:
+            self.truncated = True
+            text = text[:max(remaining, 0)]
+        return super().write(text) if text else 0
+
+    def output(self):
+        value = self.getvalue()
+        return value + "\n[output truncated]" if self.truncated else value
+
+
+class Tee:
+    """Write to a capture buffer and to a real stream so output is still streamed."""
+
+    def __init__(self, capture, stream):
+        self.capture = capture
+        self.stream = stream
+
+    def write(self, text):
+        self.capture.write(text)
+        return self.stream.write(text)
+
+    def flush(self):
+        self.stream.flush()
+
+
+def write_json_atomic(path, document):
+    """Write a JSON document so that readers never see a partial file."""
+    tmp = path + ".tmp"
+    with open(tmp, "w") as f:
+        json.dump(document, f, default=str)
+    os.replace(tmp, path)
+
+
+def run_cell(source, namespace, tables, output_dir):
+    """Execute one cell and return its result document."""
+    del tables[:]
+    stdout, stderr = CappedStringIO(), CappedStringIO()
+    result = {"return_value": None, "exit_code": 0}
+    started = time.time()
+    with contextlib.redirect_stdout(stdout), contextlib.redirect_stderr(stderr):
+        try:
+            value = run(source, namespace)
+            if is_table(value):
+                tables.append(to_table("result", value))
+                result["return_value"] = {"type": type(value).__name__, "table": "result"}
+            elif value is not None:
+                result["return_value"] = to_json_value(value)
+        except BaseException:
+            etype, evalue, tb = sys.exc_info()
+            while tb is not None and tb.tb_frame.f_code.co_filename != "<submitted code>":
+                tb = tb.tb_next
+            traceback.print_exception(etype, evalue, tb)
+            result["exit_code"] = 1
+    result.update({
+        "stdout": stdout.output(),
+        "stderr": stderr.output(),
+        "dataframes": list(tables),
+        "artifacts": list_artifacts(output_dir),
+        "duration": time.time() - started,
+    })
+    return result
+
+
+def serve_session(namespace, tables, output_dir):
+    """Execute cells as they appear until the sandbox is stopped."""
+    os.makedirs(CELLS_DIR, exist_ok=True)
+    # The host writes cells here, possibly as a different user
+    os.chmod(CELLS_DIR, 0o777)
+    write_json_atomic(os.path.join(CELLS_DIR, "ready.json"), {"pid": os.getpid()})
+
+    seq = 1
+    while True:
+        path = os.path.join(CELLS_DIR, "%d.py" % seq)
+        if not os.path.exists(path):
+            time.sleep(CELL_POLL_SECONDS)
+            continue
+        with open(path) as f:
+            source = f.read()
+        result = run_cell(source, namespace, tables, output_dir)
+        write_json_atomic(os.path.join(CELLS_DIR, "%d.json" % seq), result)
+        seq += 1
+
+
+def cell_source(cell):
+    """Return the source of a notebook cell with IPython magics and shell
+    commands replaced by pass, since they are not Python."""
+    source = cell.get("source", "")
+    if isinstance(source, list):
+        source = "".join(source)
+    lines = []
+    for line in source.splitlines():
+        stripped = line.lstrip()
+        if stripped.startswith(("%", "!")):
+            line = line[:len(line) - len(stripped)] + "pass"
+        lines.append(line)
+    return "\n".join(lines)
+
+
+def run_notebook(notebook, namespace, tables, result, result_path):
+    """Run the code cells of a notebook in order, recording their outputs in
+    the notebook. Execution stops at the first cell that raises; later cells
+    are left without outputs. Returns the exit code."""
+    exit_code = 0
+    count = 0
+    for cell in notebook.get("cells", []):
+        if cell.get("cell_type") != "code":
+            continue
+        cell["outputs"] = []
+        cell["execution_count"] = None
+        if exit_code:
+            continue
+
+        count += 1
+        cell["execution_count"] = count
+        stdout, stderr = CappedStringIO(), CappedStringIO()
+        value, error = None, None
+        with contextlib.redirect_stdout(Tee(stdout, sys.stdout)), \
+                contextlib.redirect_stderr(Tee(stderr, sys.stderr)):
+            try:
+                value = run(cell_source(cell), namespace)
+            except BaseException:
+                etype, evalue, tb = sys.exc_info()
+                while tb is not None and tb.tb_frame.f_code.co_filename != "<submitted code>":
+                    tb = tb.tb_next
+                error = {
+                    "output_type": "error",
+                    "ename": etype.__name__,
+                    "evalue": str(evalue),
+                    "traceback": traceback.format_exception(etype, evalue, tb),
+                }
+
+        for name, buffer in (("stdout", stdout), ("stderr", stderr)):
+            if buffer.tell():
+                cell["outputs"].append({"output_type": "stream", "name": name, "text": buffer.output()})
+        if value is not None:
+            data = {"text/plain": repr(value)[:MAX_VALUE_CHARS]}
+            if is_table(value):
+                table = to_table("cell_%d" % count, value)
+                tables.append(table)
+                data["text/plain"] = "<%s: table %s>" % (type(value).__name__, table["name"])
+            cell["outputs"].append({
+                "output_type": "execute_result",
+                "execution_count": count,
+                "data": data,
+                "metadata": {},
+            })
+        if error is not None:
+            # Log the traceback without repeating it in the cell's stream output
+            sys.stderr.write("".join(error["traceback"]))
+            cell["outputs"].append(error)
+            exit_code = 1
+
+        # Keep the progress so far in case the run is killed by its timeout
+        write_json_atomic(result_path, result)
+    return exit_code
+
+
+def to_sql_value(value):
+    """Convert a value from a query row to JSON, keeping numbers and strings."""
+    if value is None or isinstance(value, (bool, int, str)):
+        return value
+    if isinstance(value, float):
+        return value if math.isfinite(value) else None
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return base64.b64encode(bytes(value)).decode("ascii")
+    if isinstance(value, (list, tuple)):
+        return [to_sql_value(v) for v in value]
+    if isinstance(value, dict):
+        return {str(k): to_sql_value(v) for k, v in value.items()}
+    if hasattr(value, "isoformat"):
+        return value.isoformat()
+    # Decimals, UUIDs and intervals keep their exact text
+    return str(value)
+
+
+def fetch_rows(cursor):
+    """Fetch up to MAX_QUERY_ROWS rows and count the rest."""
+    rows = [[to_sql_value(v) for v in row] for row in cursor.fetchmany(MAX_QUERY_ROWS)]
+    total = len(rows)
+    while True:
+        batch = cursor.fetchmany(MAX_QUERY_ROWS)
+        if not batch:
+            return rows, total
+        total += len(batch)
+
+
+def duckdb_query(duckdb, sql, dataset_paths):
+    """Run a query in DuckDB over in-memory copies of the datasets."""
+    con = duckdb.connect(":memory:")
+    for alias, path in sorted(dataset_paths.items()):
+        reader = "read_parquet" if path.endswith(".parquet") else "read_csv_auto"
+        literal = "'" + path.replace("'", "''") + "'"
+        con.execute('CREATE TABLE "%s" AS SELECT * FROM %s(%s)' % (alias, reader, literal))
+    # The query cannot read or write files, nor undo these settings
+    con.execute("SET enable_external_access = false")
+    con.execute("SET lock_configuration = true")
+
+    if hasattr(con, "extract_statements"):
+        statements = con.extract_statements(sql)
+        if len(statements) != 1:
+            raise ValueError("exactly one SQL statement is allowed")
+        if statements[0].type != duckdb.StatementType.SELECT:
+            raise ValueError("only SELECT queries are allowed")
+
+    cursor = con.execute(sql)
+    columns = [{"name": d[0], "type": str(d[1])} for d in cursor.description or []]
+    rows, total = fetch_rows(cursor)
+    return columns, rows, total
+
+
+# SQLite authorizer actions a read-only query needs
+SQLITE_READ_ACTIONS = {
+    getattr(__import__("sqlite3"), name, code)
+    for name, code in (("SQLITE_SELECT", 21), ("SQLITE_READ", 20), ("SQLITE_FUNCTION", 31), ("SQLITE_RECURSIVE", 33))
+}
+
+
+def sqlite_column_type(values):
+    """Name the SQLite type of a column from the values it holds."""
+    types = {type(v) for v in values if v is not None}
+    if not types:
+        return "NULL"
+    if types <= {int}:
+        return "INTEGER"
+    if types <= {int, float}:
+        return "REAL"
+    if types <= {bytes}:
+        return "BLOB"
+    return "TEXT"
+
+
+def parse_csv_value(text):
+    if text == "":
+        return None
+    for convert in (int, float):
+        try:
+            return convert(text)
+        except ValueError:
+            pass
+    return text
+
+
+def sqlite_query(sql, dataset_paths):
+    """Run a query in SQLite over in-memory copies of the datasets."""
+    import sqlite3
+
+    con = sqlite3.connect(":memory:")
+    for alias, path in sorted(dataset_paths.items()):
+        if path.endswith(".parquet"):
+            # Parquet needs pandas; its types are kept by to_sql
+            load_dataset(path).to_sql(alias, con, index=False)
+            continue
+        with open(path, newline="") as f:
+            reader = csv.reader(f)
+            header = next(reader, [])
+            values = [[parse_csv_value(v) for v in row] for row in reader]
+        con.execute('CREATE TABLE "%s" (%s)' % (alias, ", ".join('"%s"' % h.replace('"', '""') for h in header)))
+        con.executemany('INSERT INTO "%s" VALUES (%s)' % (alias, ", ".join("?" * len(header))),
+                        [row[:len(header)] + [None] * (len(header) - len(row)) for row in values])
+
+    # Deny everything but reading; execute() also refuses several statements
+    con.set_authorizer(lambda action, *args: sqlite3.SQLITE_OK if action in SQLITE_READ_ACTIONS else sqlite3.SQLITE_DENY)
+    cursor = con.execute(sql)
+    rows, total = fetch_rows(cursor)
+    names = [d[0] for d in cursor.description or []]
+    columns = [{"name": name, "type": sqlite_column_type([row[i] for row in rows])} for i, name in enumerate(names)]
+    return columns, rows, total
+
+
+def run_query(sql, dataset_paths, result_path):
+    """Run a SQL query over the datasets and write its rows to the result
+    document. Return the exit code."""
+    result = {"return_value": None, "dataframes": [], "artifacts": []}
+    exit_code = 0
+    try:
+        try:
+            import duckdb
+        except ImportError:
+            engine, (columns, rows, total) = "sqlite", sqlite_query(sql, dataset_paths)
+        else:
+            engine, (columns, rows, total) = "duckdb", duckdb_query(duckdb, sql, dataset_paths)
+        result["query"] = {
+            "engine": engine,
+            "columns": columns,
+            "rows": rows,
+            "total_rows": total,
+            "truncated": total > len(rows),
+        }
+    except Exception as e:
+        print("%s: %s" % (type(e).__name__, e), file=sys.stderr)
+        exit_code = 1
+    finally:
+        with open(result_path, "w") as f:
+            json.dump(result, f, default=str)
+        sys.stdout.flush()
+    return exit_code
+
+
+def wait_for_job():
+    """Preload modules, then block until the worker assigns a job to this warm sandbox."""
+    with contextlib.redirect_stdout(io.StringIO()), contextlib.redirect_stderr(io.StringIO()):
+        try:
+            import pandas  # noqa: F401
+        except Exception:
+            pass
+
+    path = os.path.join(os.path.dirname(os.path.abspath(__file__)), WARM_JOB_FILE)
+    while not os.path.exists(path):
+        time.sleep(WARM_POLL_SECONDS)
+    with open(path) as f:
+        job = json.load(f)
+    os.environ.update(job["env"])
+
+
+def main():
+    if os.environ.get("DEEPSANDBOX_WARM"):
+        wait_for_job()
+
+    dataset_path = os.environ.get("DEEPSANDBOX_DATASET", "")
+    code_path = os.environ.get("DEEPSANDBOX_CODE", "main.py")
+    result_path = os.environ.get("DEEPSANDBOX_RESULT", "result.json")
+    output_dir = os.environ.get("DEEPSANDBOX_OUTPUT", "output")
+    os.makedirs(output_dir, exist_ok=True)
+
+    with open(code_path) as f:
+        source = f.read()
+
+    if os.environ.get("DEEPSANDBOX_KIND") == "sql":
+        paths = json.loads(os.environ.get("DEEPSANDBOX_DATASETS") or "{}")
+        if dataset_path:
+            paths["data"] = dataset_path
+        sys.exit(run_query(source, paths, result_path))
+
+    tables = []
+
+    def show(value, name=None):
+        """Record a DataFrame or Series as a table in the execution results."""
+        if not is_table(value):
+            raise TypeError("show() expects a pandas DataFrame or Series")
+        tables.append(to_table(name or "table_%d" % (len(tables) + 1), value))
+
+    data = load_dataset(dataset_path)
+    dataset_paths = json.loads(os.environ.get("DEEPSANDBOX_DATASETS") or "{}")
+    datasets = {alias: load_dataset(path) for alias, path in sorted(dataset_paths.items())}
+    if dataset_path:
+        dataset_paths["data"] = dataset_path
+        datasets["data"] = data
+
+    inputs = json.loads(os.environ.get("DEEPSANDBOX_INPUTS") or "{}")
+
+    def load_input(step, name):
+        """Load a file written to OUTPUT_DIR by an earlier pipeline step."""
+        if step not in inputs:
+            raise KeyError("no outputs from step %r; it must be listed in depends_on" % step)
+        path = os.path.join(inputs[step], name)
+        if not os.path.isfile(path):
+            raise FileNotFoundError("step %r did not write %r" % (step, name))
+        return load_dataset(path)
+
+    namespace = {
+        "__name__": "__main__",
+        "DATASET_PATH": dataset_path,
+        "DATASET_PATHS": dataset_paths,
+        "OUTPUT_DIR": output_dir,
+        "data": data,
+        "datasets": datasets,
+        "INPUTS": inputs,
+        "load_input": load_input,
+        "show": show,
+    }
+
+    if os.environ.get("DEEPSANDBOX_SESSION"):
+        serve_session(namespace, tables, output_dir)
+        return
+
+    result = {"return_value": None, "dataframes": tables, "artifacts": []}
+    exit_code = 0
+    try:
+        if os.environ.get("DEEPSANDBOX_KIND") == "notebook":
+            result["notebook"] = json.loads(source)
+            exit_code = run_notebook(result["notebook"], namespace, tables, result, result_path)
+        else:
+            value = run(source, namespace)
+            if is_table(value):
+                tables.append(to_table("result", value))
+                result["return_value"] = {"type": type(value).__name__, "table": "result"}
+            elif value is not None:
+                result["return_value"] = to_json_value(value)
+    except SystemExit:
+        raise
+    except BaseException:
+        etype, evalue, tb = sys.exc_info()
+        # Hide the harness frames so the traceback starts at the submitted code
+        while tb is not None and tb.tb_frame.f_code.co_filename != "<submitted code>":
+            tb = tb.tb_next
+        traceback.print_exception(etype, evalue, tb)
+        exit_code = 1
+    finally:
+        result["artifacts"] = list_artifacts(output_dir)
+        with open(result_path, "w") as f:
+            json.dump(result, f, default=str)
+        sys.stdout.flush()
+
+    sys.exit(exit_code)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,164 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go-deepsandbox/config"
+)
+
+// LocalExecutor runs jobs as plain python3 subprocesses with rlimits and a
+// scratch directory. It offers no isolation and is meant for development.
+type LocalExecutor struct {
+	Python      string
+	MemoryLimit int64 // bytes
+	Timeout     time.Duration
+	WorkDir     string
+	jobTracker
+}
+
+// NewLocalExecutor creates a local process executor
+func NewLocalExecutor(cfg *config.Config) (*LocalExecutor, error) {
+	memory, err := ParseMemoryLimit(cfg.ContainerMemoryLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalExecutor{
+		Python:      cfg.LocalPython,
+		MemoryLimit: memory,
+		Timeout:     time.Duration(cfg.ContainerTimeout) * time.Second,
+		WorkDir:     cfg.SandboxWorkDir,
+	}, nil
+}
+
+// Run executes the job in a python3 subprocess
+func (e *LocalExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	entered := time.Now()
+	ctx, tracked, done := e.start(ctx, job.ID)
+	defer done()
+
+	workDir, err := prepareWorkDir(e.WorkDir, job)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	// The shell applies the rlimits and then replaces itself with the interpreter
+	command := entryCommand(job, []string{e.Python}, workDir)
+	cmd := exec.Command("/bin/sh", append([]string{"-c", e.rlimitScript(e.jobTimeout(job)) + `exec "$0" "$@"`}, command...)...)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + workDir,
+		"PYTHONUNBUFFERED=1",
+	}
+	cmd.Env = append(cmd.Env, codeEnv(job, workDir)...)
+	cmd.Env = append(cmd.Env, datasetEnv(job, "")...)
+	cmd.Env = append(cmd.Env, inputsEnv(job, "")...)
+	cmd.Env = append(cmd.Env, packagesEnv(job, job.Packages)...)
+	cmd.Env = append(cmd.Env, modeEnv(job)...)
+
+	stdout, stderr := tracked.writer("stdout"), tracked.writer("stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", command[0], err)
+	}
+
+	return e.await(ctx, tracked, job, cmd, cmd.Wait, workDir, started, time.Since(entered))
+}
+
+// await waits for the started process running the job to exit, killing it
+// when the job is cancelled or times out, and returns the job's result. wait
+// blocks until the process exits. started is when the process was started
+// for the job and startup how long that took.
+func (e *LocalExecutor) await(ctx context.Context, tracked *trackedJob, job *Job, cmd *exec.Cmd, wait func() error, workDir string, started time.Time, startup time.Duration) (*Result, error) {
+	runCtx, cancel := context.WithTimeout(ctx, e.jobTimeout(job))
+	defer cancel()
+
+	// Kill the whole process group when the job is cancelled or times out
+	waitDone := make(chan struct{})
+	go func() {
+		select {
+		case <-runCtx.Done():
+			killProcessGroup(cmd)
+		case <-waitDone:
+		}
+	}()
+
+	waitErr := wait()
+	close(waitDone)
+	flushOutput(cmd)
+
+	exitCode := 0
+	if waitErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(waitErr, &exitErr) {
+			return nil, waitErr
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	result := tracked.result(exitCode, started)
+	result.Startup = startup
+	readHarnessResult(workDir, result)
+	collectArtifacts(workDir, job, result)
+	switch {
+	case tracked.wasCancelled():
+		return result, ErrCancelled
+	case runCtx.Err() == context.DeadlineExceeded:
+		return result, ErrTimedOut
+	}
+
+	return result, nil
+}
+
+// packageRuntime identifies the interpreter the job runs with
+func (e *LocalExecutor) packageRuntime(job *Job) string {
+	return strings.Join(runtimeCommand(job, []string{e.Python}), " ")
+}
+
+// installPackages installs requirements with the job's interpreter
+func (e *LocalExecutor) installPackages(ctx context.Context, job *Job, wheelhouse, target string, requirements []string) (string, error) {
+	return installOnHost(ctx, runtimeCommand(job, []string{e.Python}), wheelhouse, target, requirements)
+}
+
+// jobTimeout returns the time limit applied to the job
+func (e *LocalExecutor) jobTimeout(job *Job) time.Duration {
+	if job.Timeout > 0 {
+		return job.Timeout
+	}
+	return e.Timeout
+}
+
+// rlimitScript returns the ulimit commands applied before the interpreter
+// starts. A zero timeout leaves CPU time unlimited.
+func (e *LocalExecutor) rlimitScript(timeout time.Duration) string {
+	script := fmt.Sprintf("ulimit -f %d; ulimit -n 256; ", 1<<20)
+	if timeout > 0 {
+		script = fmt.Sprintf("ulimit -t %d; ", int(timeout.Seconds())+1) + script
+	}
+	if e.MemoryLimit > 0 {
+		script += fmt.Sprintf("ulimit -v %d; ", e.MemoryLimit/1024)
+	}
+	return script
+}
+
+// flushOutput publishes the trailing partial lines of the process's output
+func flushOutput(cmd *exec.Cmd) {
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if flusher, ok := w.(interface{ Flush() }); ok {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// localWarmSandbox is an interpreter started by the LocalExecutor that
+// waits for its job. Its wall clock time is limited once it gets one.
+type localWarmSandbox struct {
+	cmd     *exec.Cmd
+	workDir string
+	stdout  *switchWriter
+	stderr  *switchWriter
+	exited  chan struct{} // closed when the process has exited
+	waitErr error
+}
+
+// warmKey identifies the interpreter the job runs with. Jobs with packages
+// need them on the Python path before the interpreter starts.
+func (e *LocalExecutor) warmKey(job *Job) (string, bool) {
+	if !usesHarness(job) || job.Session || job.Packages != "" {
+		return "", false
+	}
+	return e.packageRuntime(job), true
+}
+
+// startWarm starts the job's interpreter on the harness, which waits for a job
+func (e *LocalExecutor) startWarm(job *Job) (warmSandbox, error) {
+	workDir, err := prepareWarmDir(e.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// CPU time is not limited while the interpreter waits for its job
+	command := entryCommand(job, []string{e.Python}, workDir)
+	cmd := exec.Command("/bin/sh", append([]string{"-c", e.rlimitScript(0) + `exec "$0" "$@"`}, command...)...)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + workDir,
+		"PYTHONUNBUFFERED=1",
+		warmEnv,
+	}
+
+	sandbox := &localWarmSandbox{
+		cmd:     cmd,
+		workDir: workDir,
+		stdout:  &switchWriter{},
+		stderr:  &switchWriter{},
+		exited:  make(chan struct{}),
+	}
+	cmd.Stdout = sandbox.stdout
+	cmd.Stderr = sandbox.stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(workDir)
+		return nil, fmt.Errorf("failed to start %s: %w", command[0], err)
+	}
+	go func() {
+		sandbox.waitErr = cmd.Wait()
+		close(sandbox.exited)
+	}()
+	return sandbox, nil
+}
+
+// runWarm hands the job to the waiting interpreter and waits for it to finish
+func (e *LocalExecutor) runWarm(ctx context.Context, job *Job, warm warmSandbox, entered time.Time) (*Result, error) {
+	sandbox := warm.(*localWarmSandbox)
+	defer sandbox.destroy()
+
+	select {
+	case <-sandbox.exited:
+		return nil, fmt.Errorf("%w: interpreter exited", errWarmUnusable)
+	default:
+	}
+
+	env := codeEnv(job, sandbox.workDir)
+	env = append(env, datasetEnv(job, "")...)
+	env = append(env, inputsEnv(job, "")...)
+	env = append(env, modeEnv(job)...)
+	if err := assignWarmJob(sandbox.workDir, job, env); err != nil {
+		return nil, fmt.Errorf("%w: %v", errWarmUnusable, err)
+	}
+
+	ctx, tracked, done := e.start(ctx, job.ID)
+	defer done()
+	sandbox.stdout.set(tracked.writer("stdout"))
+	sandbox.stderr.set(tracked.writer("stderr"))
+
+	started := time.Now()
+	return e.await(ctx, tracked, job, sandbox.cmd, sandbox.wait, sandbox.workDir, started, started.Sub(entered))
+}
+
+// wait blocks until the interpreter has exited and returns how it exited
+func (s *localWarmSandbox) wait() error {
+	<-s.exited
+	return s.waitErr
+}
+
+// destroy kills the interpreter and removes its work directory
+func (s *localWarmSandbox) destroy() {
+	killProcessGroup(s.cmd)
+	<-s.exited
+	os.RemoveAll(s.workDir)
+}
+
+// switchWriter forwards output to a writer set once the sandbox has a job.
+// Output written before that is discarded.
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements io.Writer
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+// set starts forwarding output to w
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	s.w = w
+	s.mu.Unlock()
+}
+
+// Flush flushes the writer output is forwarded to, if it buffers lines
+func (s *switchWriter) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if flusher, ok := s.w.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,441 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"go-deepsandbox/config"
+)
+
+// nsInitArg0 is the argv[0] the executor uses when re-executing the current
+// binary as the init process of a new sandbox
+const nsInitArg0 = "deepsandbox-nsinit"
+
+// nsInitConfigEnv carries the nsInitConfig from the executor to the init process
+const nsInitConfigEnv = "DEEPSANDBOX_NSINIT_CONFIG"
+
+// nsInitConfig tells the init process how to build the sandbox
+type nsInitConfig struct {
+	RootDir  string            `json:"root_dir"` // empty directory that becomes the sandbox root
+	WorkDir  string            `json:"work_dir"` // scratch directory mounted at /sandbox
+	Datasets []string          `json:"datasets"` // dataset files mounted read-only under /data
+	Inputs   map[string]string `json:"inputs"`   // directories mounted read-only under /inputs, by name
+	Packages string            `json:"packages"` // installed requirements mounted read-only at /packages
+	Binds    []string          `json:"binds"`    // host directories mounted read-only at the same path
+	Command  []string          `json:"command"`  // interpreter and script to run
+	Env      []string          `json:"env"`
+}
+
+func init() {
+	// When re-executed by NamespaceExecutor the binary never reaches main
+	if len(os.Args) > 0 && os.Args[0] == nsInitArg0 {
+		runtime.LockOSThread()
+		if err := nsInit(); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox init failed: %v\n", err)
+		}
+		os.Exit(125)
+	}
+}
+
+// NamespaceExecutor isolates jobs with Linux user, mount, PID, IPC, UTS and
+// network namespaces, cgroup v2 limits and a seccomp filter, without Docker
+type NamespaceExecutor struct {
+	Python       string
+	MemoryLimit  int64   // bytes
+	CPULimit     float64 // CPUs
+	Timeout      time.Duration
+	WorkDir      string
+	CgroupParent string
+	RootfsBinds  []string
+	jobTracker
+}
+
+// NewNamespaceExecutor creates a namespace executor. ContainerMemoryLimit and
+// ContainerCPULimit are applied through cgroups so limits match the Docker backend.
+func NewNamespaceExecutor(cfg *config.Config) (*NamespaceExecutor, error) {
+	memory, err := ParseMemoryLimit(cfg.ContainerMemoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := ParseCPULimit(cfg.ContainerCPULimit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NamespaceExecutor{
+		Python:       cfg.LocalPython,
+		MemoryLimit:  memory,
+		CPULimit:     cpus,
+		Timeout:      time.Duration(cfg.ContainerTimeout) * time.Second,
+		WorkDir:      cfg.SandboxWorkDir,
+		CgroupParent: cfg.CgroupParent,
+		RootfsBinds:  cfg.SandboxRootfsBinds,
+	}, nil
+}
+
+// Run executes the job inside fresh namespaces
+func (e *NamespaceExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	entered := time.Now()
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = e.Timeout
+	}
+
+	ctx, tracked, done := e.start(ctx, job.ID)
+	defer done()
+
+	workDir, err := prepareWorkDir(e.WorkDir, job)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	rootDir := workDir + ".root"
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sandbox root: %w", err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	cg, err := newCgroup(e.CgroupParent, job.ID, e.MemoryLimit, e.CPULimit)
+	if err != nil {
+		return nil, err
+	}
+	defer cg.remove()
+
+	initConfig := nsInitConfig{
+		RootDir: rootDir,
+		WorkDir: workDir,
+		Binds:   e.RootfsBinds,
+		Command: entryCommand(job, []string{e.Python}, sandboxDir),
+		Env: []string{
+			"PATH=/usr/local/bin:/usr/bin:/bin",
+			"HOME=/tmp",
+			"PYTHONUNBUFFERED=1",
+		},
+	}
+	initConfig.Env = append(initConfig.Env, codeEnv(job, sandboxDir)...)
+	initConfig.Datasets = datasetFiles(job)
+	initConfig.Env = append(initConfig.Env, datasetEnv(job, datasetDir)...)
+	initConfig.Inputs = make(map[string]string, len(job.Inputs))
+	for name, dir := range job.Inputs {
+		initConfig.Inputs[name], _ = filepath.Abs(dir)
+	}
+	initConfig.Env = append(initConfig.Env, inputsEnv(job, inputsDir)...)
+	initConfig.Packages = job.Packages
+	initConfig.Env = append(initConfig.Env, packagesEnv(job, packagesDir)...)
+	initConfig.Env = append(initConfig.Env, modeEnv(job)...)
+	encoded, err := json.Marshal(initConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// The init process blocks on this pipe until it has been moved into the cgroup
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer syncWrite.Close()
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{nsInitArg0},
+		Env:        []string{nsInitConfigEnv + "=" + string(encoded)},
+		ExtraFiles: []*os.File{syncRead},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+				syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: sandboxHostID(os.Getuid()), Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: sandboxHostID(os.Getgid()), Size: 1}},
+			GidMappingsEnableSetgroups: false,
+			// Become root of the new user namespace so the init keeps its
+			// capabilities there across exec
+			Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+
+	stdout, stderr := tracked.writer("stdout"), tracked.writer("stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	started := time.Now()
+	err = cmd.Start()
+	syncRead.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sandbox: %w", err)
+	}
+
+	if err := cg.addProcess(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	syncWrite.Write([]byte{0})
+	syncWrite.Close()
+	startup := time.Since(entered)
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Killing the namespace's init takes down every process inside it; the
+	// cgroup kill covers anything that escaped the PID namespace
+	waitDone := make(chan struct{})
+	go func() {
+		select {
+		case <-runCtx.Done():
+			cmd.Process.Kill()
+			cg.kill()
+		case <-waitDone:
+		}
+	}()
+
+	waitErr := cmd.Wait()
+	close(waitDone)
+	stdout.Flush()
+	stderr.Flush()
+
+	exitCode := 0
+	if waitErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(waitErr, &exitErr) {
+			return nil, waitErr
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	result := tracked.result(exitCode, started)
+	result.Startup = startup
+	readHarnessResult(workDir, result)
+	collectArtifacts(workDir, job, result)
+	if cg.oomKilled() {
+		result.Stderr += "\nProcess was killed for exceeding the memory limit"
+	}
+
+	switch {
+	case tracked.wasCancelled():
+		return result, ErrCancelled
+	case runCtx.Err() == context.DeadlineExceeded:
+		return result, ErrTimedOut
+	}
+
+	return result, nil
+}
+
+// packageRuntime identifies the interpreter the job runs with
+func (e *NamespaceExecutor) packageRuntime(job *Job) string {
+	return strings.Join(runtimeCommand(job, []string{e.Python}), " ")
+}
+
+// installPackages installs requirements with the job's interpreter on the
+// host, which the sandbox shares through RootfsBinds. Only wheels are
+// installed, so no package code runs outside the sandbox.
+func (e *NamespaceExecutor) installPackages(ctx context.Context, job *Job, wheelhouse, target string, requirements []string) (string, error) {
+	return installOnHost(ctx, runtimeCommand(job, []string{e.Python}), wheelhouse, target, requirements)
+}
+
+// sandboxHostID picks the host ID that root inside the sandbox maps to. An
+// unprivileged worker can only map itself; a root worker maps to nobody.
+func sandboxHostID(id int) int {
+	if id == 0 {
+		return 65534
+	}
+	return id
+}
+
+// nsInit runs inside the new namespaces: it waits until the executor has
+// placed it in the cgroup, builds the root filesystem, drops privileges,
+// installs the seccomp filter and finally replaces itself with the interpreter
+func nsInit() error {
+	syncPipe := os.NewFile(3, "sync")
+	buf := make([]byte, 1)
+	if _, err := syncPipe.Read(buf); err != nil {
+		return fmt.Errorf("executor went away: %w", err)
+	}
+	syncPipe.Close()
+
+	var cfg nsInitConfig
+	if err := json.Unmarshal([]byte(os.Getenv(nsInitConfigEnv)), &cfg); err != nil {
+		return fmt.Errorf("invalid init config: %w", err)
+	}
+
+	if err := setupRootfs(&cfg); err != nil {
+		return err
+	}
+	if err := unix.Sethostname([]byte("sandbox")); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+
+	// Resolve the interpreter before privileges are dropped
+	os.Setenv("PATH", "/usr/local/bin:/usr/bin:/bin")
+	interpreter, err := exec.LookPath(cfg.Command[0])
+	if err != nil {
+		return fmt.Errorf("interpreter %s not found in sandbox: %w", cfg.Command[0], err)
+	}
+
+	if err := dropCapabilities(); err != nil {
+		return err
+	}
+	if err := installSeccompFilter(); err != nil {
+		return err
+	}
+
+	return syscall.Exec(interpreter, cfg.Command, cfg.Env)
+}
+
+// setupRootfs builds a minimal read-only root with the configured host
+// directories, the scratch directory and the dataset, then pivots into it
+func setupRootfs(cfg *nsInitConfig) error {
+	// Keep every mount below private to this namespace
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	root := cfg.RootDir
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "size=16m,mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount sandbox root: %w", err)
+	}
+
+	for _, dir := range cfg.Binds {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if err := bindMount(dir, filepath.Join(root, dir), true, true); err != nil {
+			return err
+		}
+	}
+
+	if err := bindMount(cfg.WorkDir, filepath.Join(root, sandboxDir), true, false); err != nil {
+		return err
+	}
+	for _, dataset := range cfg.Datasets {
+		if err := bindMount(dataset, filepath.Join(root, datasetDir, filepath.Base(dataset)), false, true); err != nil {
+			return err
+		}
+	}
+	for name, dir := range cfg.Inputs {
+		if err := bindMount(dir, filepath.Join(root, inputsDir, name), true, true); err != nil {
+			return err
+		}
+	}
+	if cfg.Packages != "" {
+		if err := bindMount(cfg.Packages, filepath.Join(root, packagesDir), true, true); err != nil {
+			return err
+		}
+	}
+
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "size=64m,mode=1777"},
+		{"proc", "/proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+		{"tmpfs", "/dev", "tmpfs", unix.MS_NOSUID | unix.MS_NOEXEC, "size=64k,mode=0755"},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(root, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := unix.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+	for _, device := range []string{"null", "zero", "random", "urandom"} {
+		if err := bindMount("/dev/"+device, filepath.Join(root, "dev", device), false, false); err != nil {
+			return err
+		}
+	}
+
+	if err := pivotRoot(root); err != nil {
+		return err
+	}
+
+	// Nothing may be added to the root itself once it is in place
+	if err := unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("failed to make sandbox root read-only: %w", err)
+	}
+
+	return os.Chdir(sandboxDir)
+}
+
+// bindMount bind-mounts source onto target, creating the mount point, and
+// optionally makes the mount read-only
+func bindMount(source, target string, isDir, readOnly bool) error {
+	if isDir {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %w", source, err)
+	}
+	if !readOnly {
+		return nil
+	}
+
+	// A remount must keep the flags the kernel locked on the original mount
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return err
+	}
+	locked := uintptr(st.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|locked, ""); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", source, err)
+	}
+	return nil
+}
+
+// pivotRoot makes root the new filesystem root and detaches the old one
+func pivotRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(".oldroot", 0700); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(".", ".oldroot"); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := unix.Unmount("/.oldroot", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach old root: %w", err)
+	}
+	return os.Remove("/.oldroot")
+}
+
+// dropCapabilities empties the bounding and ambient sets so the interpreter,
+// although root inside the user namespace, starts without any capability
+func dropCapabilities() error {
+	for capability := 0; capability <= unix.CAP_LAST_CAP; capability++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d: %w", capability, err)
+		}
+	}
+	unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0)
+	return nil
+}
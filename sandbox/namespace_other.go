@@ -0,0 +1,28 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+
+	"go-deepsandbox/config"
+)
+
+// errNamespaceUnsupported is returned on platforms without Linux namespaces
+var errNamespaceUnsupported = errors.New("the namespace executor requires Linux")
+
+// NamespaceExecutor is only available on Linux
+type NamespaceExecutor struct {
+	jobTracker
+}
+
+// NewNamespaceExecutor fails on platforms other than Linux
+func NewNamespaceExecutor(cfg *config.Config) (*NamespaceExecutor, error) {
+	return nil, errNamespaceUnsupported
+}
+
+// Run always fails on platforms other than Linux
+func (e *NamespaceExecutor) Run(ctx context.Context, job *Job) (*Result, error) {
+	return nil, errNamespaceUnsupported
+}
@@ -0,0 +1,205 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/packages"
+)
+
+// Paths the installer sees the wheelhouse and the environment being
+// installed at, when it runs in a container
+const (
+	wheelhouseDir = "/wheelhouse"
+	installDir    = "/target"
+)
+
+// maxInstallOutput caps how much pip output is kept in install errors
+const maxInstallOutput = 4096
+
+// packageInstaller is implemented by executors that can install packages
+// for the jobs they run
+type packageInstaller interface {
+	// packageRuntime identifies the interpreter the job runs with, so that
+	// environments are only shared by jobs that can load them
+	packageRuntime(job *Job) string
+	// installPackages installs requirements for the job's interpreter into
+	// target from the wheels in wheelhouse, and returns pip's output
+	installPackages(ctx context.Context, job *Job, wheelhouse, target string, requirements []string) (string, error)
+}
+
+// PackageCache keeps the environments installed for execution requirements.
+// An environment is a directory of packages installed with pip --target from
+// the wheelhouse only. It is named after the hash of its requirements and
+// runtime, so later executions with the same requirements reuse it.
+type PackageCache struct {
+	Dir        string
+	Wheelhouse string
+	Timeout    time.Duration
+
+	mu       sync.Mutex
+	installs map[string]*sync.Mutex
+}
+
+// NewPackageCache creates a package cache from the Package* settings. It
+// returns nil when no wheelhouse is configured.
+func NewPackageCache(cfg *config.Config) *PackageCache {
+	if cfg.PackageWheelhouse == "" {
+		return nil
+	}
+	return &PackageCache{
+		Dir:        cfg.PackageCacheDir,
+		Wheelhouse: cfg.PackageWheelhouse,
+		Timeout:    time.Duration(cfg.PackageInstallTimeout) * time.Second,
+		installs:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Environment returns the host directory holding requirements installed for
+// the job's runtime, installing them with the executor on first use.
+// Requirements are expected normalized and sorted, as packages.Parse returns
+// them.
+func (p *PackageCache) Environment(ctx context.Context, executor Executor, job *Job, requirements []string) (string, error) {
+	if pool, ok := executor.(*WarmPool); ok {
+		executor = pool.Unwrap()
+	}
+	installer, ok := executor.(packageInstaller)
+	if !ok {
+		return "", errors.New("the executor backend cannot install packages")
+	}
+
+	cacheDir, err := filepath.Abs(p.Dir)
+	if err != nil {
+		return "", err
+	}
+	wheelhouse, err := filepath.Abs(p.Wheelhouse)
+	if err != nil {
+		return "", err
+	}
+	hash := packages.Hash(installer.packageRuntime(job), requirements)
+	envDir := filepath.Join(cacheDir, hash)
+
+	// Slots of this worker wait for an install already in progress
+	lock := p.installLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(envDir); err == nil {
+		// The modification time tells when an environment was last used
+		now := time.Now()
+		os.Chtimes(envDir, now, now)
+		return envDir, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create package cache: %w", err)
+	}
+	// Install next to the environment and rename it into place, so that a
+	// directory named after a hash is always complete
+	target, err := os.MkdirTemp(cacheDir, "."+hash+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(target)
+	// The installer may run as the sandbox's unprivileged user
+	if err := os.Chmod(target, 0777); err != nil {
+		return "", err
+	}
+
+	installCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	output, err := installer.installPackages(installCtx, job, wheelhouse, target, requirements)
+	if err != nil {
+		if errors.Is(installCtx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("installing requirements timed out after %s", p.Timeout)
+		}
+		return "", fmt.Errorf("failed to install requirements: %w\n%s", err, tail(output, maxInstallOutput))
+	}
+	if err := os.Chmod(target, 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(target, envDir); err != nil {
+		// Another worker sharing the cache installed it first
+		if _, statErr := os.Stat(envDir); statErr == nil {
+			return envDir, nil
+		}
+		return "", fmt.Errorf("failed to save environment: %w", err)
+	}
+	return envDir, nil
+}
+
+// installLock returns the lock serializing installs of one environment
+func (p *PackageCache) installLock(hash string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lock, ok := p.installs[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.installs[hash] = lock
+	}
+	return lock
+}
+
+// pipInstallArgs returns the arguments after the interpreter that install
+// requirements into target. Only wheels from wheelhouse are used: no index
+// is contacted and no package build code runs.
+func pipInstallArgs(wheelhouse, target string, requirements []string) []string {
+	args := []string{
+		"-m", "pip", "install",
+		"--no-index",
+		"--find-links", wheelhouse,
+		"--only-binary", ":all:",
+		"--no-cache-dir",
+		"--disable-pip-version-check",
+		"--no-warn-script-location",
+		"--target", target,
+		"--",
+	}
+	return append(args, requirements...)
+}
+
+// installOnHost installs requirements with an interpreter on the worker host
+func installOnHost(ctx context.Context, python []string, wheelhouse, target string, requirements []string) (string, error) {
+	args := append(append([]string{}, python[1:]...), pipInstallArgs(wheelhouse, target, requirements)...)
+	cmd := exec.CommandContext(ctx, python[0], args...)
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + os.TempDir(),
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}
+
+// packagesEnv returns the environment that puts the job's installed
+// requirements on the Python path, with dir as the environment directory
+// seen from the sandbox
+func packagesEnv(job *Job, dir string) []string {
+	if job.Packages == "" {
+		return nil
+	}
+	return []string{"PYTHONPATH=" + dir}
+}
+
+// tail returns the last n bytes of s
+func tail(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
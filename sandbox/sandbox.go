@@ -0,0 +1,394 @@
+package sandbox
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-deepsandbox/models"
+)
+
+// Paths of the sandbox layout as seen by the submitted code
+const (
+	sandboxDir  = "/sandbox"
+	datasetDir  = "/data"
+	inputsDir   = "/inputs"
+	packagesDir = "/packages"
+	harnessFile = "harness.py"
+	codeFile    = "main.py"
+	resultFile  = "result.json"
+	outputDir   = "output"
+	cellsDir    = "cells"
+)
+
+// sessionEnv switches the harness to serving cells for a Session
+const sessionEnv = "DEEPSANDBOX_SESSION=1"
+
+// modeEnv returns the environment variables that tell the harness how to
+// treat the job's code
+func modeEnv(job *Job) []string {
+	var env []string
+	if job.Session {
+		env = append(env, sessionEnv)
+	}
+	if job.Kind != "" {
+		env = append(env, "DEEPSANDBOX_KIND="+job.Kind)
+	}
+	return env
+}
+
+// codeFiles names the file submitted code is written to, by runtime language
+var codeFiles = map[string]string{
+	models.LanguagePython: codeFile,
+	models.LanguageR:      "main.R",
+}
+
+// usesHarness reports whether the job runs through the Python harness. Code
+// in other languages is run directly and only produces output and files.
+func usesHarness(job *Job) bool {
+	return job.Language == "" || job.Language == models.LanguagePython
+}
+
+// jobCodeFile returns the name of the file the job's code is written to
+func jobCodeFile(job *Job) string {
+	if name, ok := codeFiles[job.Language]; ok {
+		return name
+	}
+	return codeFile
+}
+
+// entryCommand returns the command that runs the job: the runtime's command,
+// or defaultCommand, followed by the path of the harness, or of the code
+// itself when the job does not use the harness. dir is where the work
+// directory is seen from the command.
+func entryCommand(job *Job, defaultCommand []string, dir string) []string {
+	script := harnessFile
+	if !usesHarness(job) {
+		script = jobCodeFile(job)
+	}
+	return append(runtimeCommand(job, defaultCommand), dir+"/"+script)
+}
+
+// runtimeCommand returns a copy of the runtime's command, or of
+// defaultCommand when the job keeps the executor's Python
+func runtimeCommand(job *Job, defaultCommand []string) []string {
+	if len(job.Command) > 0 {
+		return append([]string{}, job.Command...)
+	}
+	return append([]string{}, defaultCommand...)
+}
+
+// codeEnv returns the environment telling the job where its code is, with
+// dir as the work directory seen from the sandbox. Code that does not run
+// through the harness is told where to write files with OUTPUT_DIR.
+func codeEnv(job *Job, dir string) []string {
+	env := []string{"DEEPSANDBOX_CODE=" + dir + "/" + jobCodeFile(job)}
+	if !usesHarness(job) {
+		env = append(env, "OUTPUT_DIR="+dir+"/"+outputDir)
+	}
+	return env
+}
+
+// maxOutputBytes caps how much of each output stream is kept per execution
+const maxOutputBytes = 1 << 20
+
+// ErrTimedOut is returned when an execution was killed for exceeding its timeout
+var ErrTimedOut = errors.New("execution timed out")
+
+// datasetFiles returns the absolute host paths of the job's dataset files,
+// without duplicates
+func datasetFiles(job *Job) []string {
+	var files []string
+	seen := map[string]bool{}
+	add := func(path string) {
+		path, _ = filepath.Abs(path)
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	if job.DatasetPath != "" {
+		add(job.DatasetPath)
+	}
+	aliases := make([]string, 0, len(job.Datasets))
+	for alias := range job.Datasets {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		add(job.Datasets[alias])
+	}
+	return files
+}
+
+// datasetEnv returns the environment telling the harness where the job's
+// datasets are. Dataset files are expected under mountDir in the sandbox, or
+// at their host paths when mountDir is empty.
+func datasetEnv(job *Job, mountDir string) []string {
+	location := func(path string) string {
+		path, _ = filepath.Abs(path)
+		if mountDir == "" {
+			return path
+		}
+		return mountDir + "/" + filepath.Base(path)
+	}
+
+	var env []string
+	if job.DatasetPath != "" {
+		env = append(env, "DEEPSANDBOX_DATASET="+location(job.DatasetPath))
+	}
+	if len(job.Datasets) > 0 {
+		paths := make(map[string]string, len(job.Datasets))
+		for alias, path := range job.Datasets {
+			paths[alias] = location(path)
+		}
+		encoded, _ := json.Marshal(paths)
+		env = append(env, "DEEPSANDBOX_DATASETS="+string(encoded))
+	}
+	return env
+}
+
+// inputsEnv returns the environment telling the harness where the outputs of
+// earlier pipeline steps are. Each directory is expected under mountDir in
+// the sandbox, named after its step, or at its host path when mountDir is
+// empty.
+func inputsEnv(job *Job, mountDir string) []string {
+	if len(job.Inputs) == 0 {
+		return nil
+	}
+
+	paths := make(map[string]string, len(job.Inputs))
+	for name, dir := range job.Inputs {
+		if mountDir == "" {
+			paths[name], _ = filepath.Abs(dir)
+		} else {
+			paths[name] = mountDir + "/" + name
+		}
+	}
+	encoded, _ := json.Marshal(paths)
+	return []string{"DEEPSANDBOX_INPUTS=" + string(encoded)}
+}
+
+//go:embed harness.py
+var harnessSource []byte
+
+// Job describes a single code execution
+type Job struct {
+	ID          string
+	Code        string
+	Kind        string            // models.KindCode, KindNotebook or KindSQL; empty means code
+	DatasetPath string            // path of the dataset file on the host
+	Datasets    map[string]string // paths of further dataset files on the host, by alias
+	Inputs      map[string]string // host directories with outputs of earlier pipeline steps, by step name
+	Timeout     time.Duration
+
+	// Runtime the job runs with; empty values keep the executor's Python
+	Image    string   // container image, for the Docker backend
+	Command  []string // entry command the script path is appended to
+	Language string   // models.LanguagePython or another runtime language
+
+	// Packages is the host directory with the job's requirements installed,
+	// from PackageCache; it is put on the Python path
+	Packages string
+
+	// ArtifactsDir is where files written to the output directory are kept;
+	// they are discarded when it is empty
+	ArtifactsDir   string
+	ArtifactLimits ArtifactLimits
+
+	// Session makes the harness serve cells until the job is stopped
+	// instead of running Code once; see StartSession
+	Session bool
+}
+
+// Result holds the captured output of an execution
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+	Startup  time.Duration // from the job being handed to the executor until its code started
+
+	// LogError is set when the output could not be read in full; what was
+	// read is kept
+	LogError string
+
+	// Reported by the harness; empty when the code never got to run
+	ReturnValue interface{}
+	DataFrames  []models.DataFrameOutput
+	Artifacts   []models.Artifact
+
+	// Output files dropped for exceeding ArtifactLimits
+	ArtifactsSkipped int
+
+	// The executed notebook, for notebook jobs
+	Notebook json.RawMessage
+
+	// The rows of the query, for SQL jobs
+	Query *models.QueryResult
+}
+
+// harnessResult is the document the harness writes to result.json
+type harnessResult struct {
+	ReturnValue interface{}              `json:"return_value"`
+	DataFrames  []models.DataFrameOutput `json:"dataframes"`
+	Artifacts   []models.Artifact        `json:"artifacts"`
+	Notebook    json.RawMessage          `json:"notebook"`
+	Query       *models.QueryResult      `json:"query"`
+}
+
+// readHarnessResult adds what the harness reported in the work directory to
+// the result. A missing or malformed file leaves the result untouched.
+func readHarnessResult(workDir string, result *Result) {
+	data, err := os.ReadFile(filepath.Join(workDir, resultFile))
+	if err != nil {
+		return
+	}
+
+	var reported harnessResult
+	if err := json.Unmarshal(data, &reported); err != nil {
+		return
+	}
+	result.ReturnValue = reported.ReturnValue
+	result.DataFrames = reported.DataFrames
+	result.Artifacts = reported.Artifacts
+	result.Notebook = reported.Notebook
+	result.Query = reported.Query
+}
+
+// ExecutionResult converts the result to the schema stored on CodeExecution
+func (r *Result) ExecutionResult() *models.ExecutionResult {
+	return &models.ExecutionResult{
+		Stdout:      r.Stdout,
+		Stderr:      r.Stderr,
+		ExitCode:    r.ExitCode,
+		ReturnValue: r.ReturnValue,
+		DataFrames:  r.DataFrames,
+		Artifacts:   r.Artifacts,
+		Notebook:    r.Notebook,
+		Query:       r.Query,
+		Duration:    r.Duration.Seconds(),
+
+		ArtifactsSkipped: r.ArtifactsSkipped,
+		LogError:         r.LogError,
+	}
+}
+
+// prepareWorkDir creates the scratch directory for a job and writes the
+// harness and the submitted code into it
+func prepareWorkDir(baseDir string, job *Job) (string, error) {
+	workDir, err := filepath.Abs(filepath.Join(baseDir, job.ID))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create work directory: %w", err)
+	}
+	// The sandboxed process runs as an unprivileged user and must be able to write here
+	if err := os.Chmod(workDir, 0777); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(workDir, harnessFile), harnessSource, 0644); err != nil {
+		return "", fmt.Errorf("failed to write harness: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, jobCodeFile(job)), []byte(job.Code), 0644); err != nil {
+		return "", fmt.Errorf("failed to write code: %w", err)
+	}
+	if !usesHarness(job) {
+		// The harness creates the output directory for Python code
+		if err := os.Mkdir(filepath.Join(workDir, outputDir), 0777); err != nil {
+			return "", fmt.Errorf("failed to create output directory: %w", err)
+		}
+		if err := os.Chmod(filepath.Join(workDir, outputDir), 0777); err != nil {
+			return "", err
+		}
+	}
+
+	return workDir, nil
+}
+
+// ParseMemoryLimit converts a Docker style memory limit such as "512m" or "2g" to bytes
+func ParseMemoryLimit(limit string) (int64, error) {
+	limit = strings.ToLower(strings.TrimSpace(limit))
+	if limit == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch limit[len(limit)-1] {
+	case 'k':
+		multiplier = 1 << 10
+	case 'm':
+		multiplier = 1 << 20
+	case 'g':
+		multiplier = 1 << 30
+	case 'b':
+	default:
+		return strconv.ParseInt(limit, 10, 64)
+	}
+
+	value, err := strconv.ParseFloat(limit[:len(limit)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit %q", limit)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// ParseCPULimit converts a CPU limit such as "1" or "0.5" to a number of CPUs
+func ParseCPULimit(limit string) (float64, error) {
+	limit = strings.TrimSpace(limit)
+	if limit == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(limit, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid CPU limit %q", limit)
+	}
+	return value, nil
+}
+
+// limitedBuffer keeps the first maxOutputBytes written to it and drops the rest
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+// Write implements io.Writer
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	remaining := maxOutputBytes - len(b.buf)
+	if remaining <= 0 {
+		b.truncated = len(p) > 0 || b.truncated
+		return len(p), nil
+	}
+	if len(p) > remaining {
+		b.buf = append(b.buf, p[:remaining]...)
+		b.truncated = true
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// String returns the captured output
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.truncated {
+		return string(b.buf) + "\n[output truncated]"
+	}
+	return string(b.buf)
+}
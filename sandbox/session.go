@@ -0,0 +1,166 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-deepsandbox/models"
+)
+
+// cellPollInterval is how often the host checks for a cell's result
+const cellPollInterval = 20 * time.Millisecond
+
+// ErrSessionEnded is returned when a session's sandbox is no longer running
+var ErrSessionEnded = errors.New("session has ended")
+
+// Session keeps a sandboxed interpreter alive between code cells so that
+// variables and the loaded dataset survive from one cell to the next. It runs
+// as a regular job on any executor that uses the shared work directory
+// layout; cells are exchanged through files in that directory.
+type Session struct {
+	cellsDir string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// Set by Run once the sandbox has exited
+	result *Result
+	err    error
+
+	mu  sync.Mutex
+	seq int
+}
+
+// StartSession starts the job as a session on the executor. workBaseDir must
+// be the executor's work directory (SANDBOX_WORK_DIR). The job's Timeout
+// bounds the lifetime of the whole session.
+func StartSession(ctx context.Context, executor Executor, workBaseDir string, job *Job) (*Session, error) {
+	workDir, err := filepath.Abs(filepath.Join(workBaseDir, job.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Session{
+		cellsDir: filepath.Join(workDir, cellsDir),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	job.Session = true
+	go func() {
+		defer close(s.done)
+		s.result, s.err = executor.Run(ctx, job)
+	}()
+
+	return s, nil
+}
+
+// WaitReady blocks until the dataset has been loaded and the session accepts
+// cells
+func (s *Session) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(filepath.Join(s.cellsDir, "ready.json")); err == nil {
+			return nil
+		}
+
+		select {
+		case <-s.done:
+			return s.exitError()
+		case <-time.After(cellPollInterval):
+		}
+		if time.Now().After(deadline) {
+			s.Close()
+			return fmt.Errorf("session did not start within %s", timeout)
+		}
+	}
+}
+
+// Execute runs a cell in the session and returns its result. A cell that
+// runs longer than timeout cannot be interrupted on its own, so the whole
+// session is stopped and ErrTimedOut is returned.
+func (s *Session) Execute(code string, timeout time.Duration) (*models.ExecutionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil, s.exitError()
+	default:
+	}
+
+	s.seq++
+	name := strconv.Itoa(s.seq)
+	cellPath := filepath.Join(s.cellsDir, name+".py")
+	if err := os.WriteFile(cellPath+".tmp", []byte(code), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write cell: %w", err)
+	}
+	if err := os.Rename(cellPath+".tmp", cellPath); err != nil {
+		return nil, fmt.Errorf("failed to write cell: %w", err)
+	}
+
+	resultPath := filepath.Join(s.cellsDir, name+".json")
+	deadline := time.Now().Add(timeout)
+	for {
+		if data, err := os.ReadFile(resultPath); err == nil {
+			var result models.ExecutionResult
+			if err := json.Unmarshal(data, &result); err != nil {
+				return nil, fmt.Errorf("malformed cell result: %w", err)
+			}
+			// The session keeps running, so its files are not needed any more
+			os.Remove(cellPath)
+			os.Remove(resultPath)
+			return &result, nil
+		}
+
+		select {
+		case <-s.done:
+			return nil, s.exitError()
+		case <-time.After(cellPollInterval):
+		}
+		if time.Now().After(deadline) {
+			s.Close()
+			return nil, ErrTimedOut
+		}
+	}
+}
+
+// Close stops the session's sandbox and waits for it to exit
+func (s *Session) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Done is closed once the session's sandbox has exited
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// exitError describes why the sandbox exited, including the end of its
+// stderr when the harness failed
+func (s *Session) exitError() error {
+	if s.ctx.Err() != nil {
+		return ErrSessionEnded
+	}
+	if s.err != nil && !errors.Is(s.err, ErrCancelled) {
+		return fmt.Errorf("%w: %v", ErrSessionEnded, s.err)
+	}
+	if s.result != nil && s.result.ExitCode != 0 {
+		stderr := strings.TrimSpace(s.result.Stderr)
+		if len(stderr) > 2000 {
+			stderr = stderr[len(stderr)-2000:]
+		}
+		return fmt.Errorf("%w: exited with code %d: %s", ErrSessionEnded, s.result.ExitCode, stderr)
+	}
+	return ErrSessionEnded
+}
@@ -0,0 +1,335 @@
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-deepsandbox/models"
+)
+
+// Settings of the warm pool
+const (
+	// warmIdleTimeout is how long a runtime's sandboxes are kept once no
+	// job has asked for one, unless the runtime was prepared
+	warmIdleTimeout = 10 * time.Minute
+	// warmRetryDelay is how long a runtime is not refilled after a sandbox
+	// failed to start
+	warmRetryDelay = 30 * time.Second
+	// warmJobFile is where the job assigned to a warm sandbox is written,
+	// next to the harness
+	warmJobFile = "job.json"
+	// warmEnv makes the harness wait for warmJobFile before running
+	warmEnv = "DEEPSANDBOX_WARM=1"
+)
+
+// errWarmUnusable is returned by runWarm when the sandbox cannot take the
+// job, before the job started; the job is then run in a new sandbox
+var errWarmUnusable = errors.New("warm sandbox cannot be used")
+
+// ErrWarmPoolUnsupported is returned by NewWarmPool for executors that
+// cannot start sandboxes ahead of their jobs
+var ErrWarmPoolUnsupported = errors.New("executor does not support warm sandboxes")
+
+// warmExecutor is implemented by executors that can start a sandbox before
+// its job is known and hand the job to it later
+type warmExecutor interface {
+	Executor
+	// warmKey identifies the runtime the job needs a sandbox for. It
+	// returns false when the job cannot run in a warm sandbox.
+	warmKey(job *Job) (string, bool)
+	// startWarm starts an idle sandbox for the runtime of job
+	startWarm(job *Job) (warmSandbox, error)
+	// runWarm runs the job in the sandbox and destroys it afterwards.
+	// entered is when the job was handed to the executor.
+	runWarm(ctx context.Context, job *Job, sandbox warmSandbox, entered time.Time) (*Result, error)
+}
+
+// warmSandbox is a started sandbox waiting for a job
+type warmSandbox interface {
+	// destroy stops the sandbox and removes its files
+	destroy()
+}
+
+// WarmPool is an Executor that keeps idle sandboxes started for each runtime
+// jobs have asked for, so that a job only has to hand its code to one
+// instead of waiting for a sandbox to start. Every sandbox runs a single job
+// and is destroyed afterwards; a replacement is started in the background.
+// Jobs that cannot use a warm sandbox, and jobs arriving while none is idle,
+// run in a new sandbox as usual.
+type WarmPool struct {
+	Executor
+	Size int // idle sandboxes kept per runtime
+
+	warm     warmExecutor
+	mu       sync.Mutex
+	runtimes map[string]*warmRuntime
+	closed   bool
+	stats    models.WarmPoolStats
+}
+
+// warmRuntime holds the idle sandboxes of one runtime
+type warmRuntime struct {
+	template *Job // the runtime's Image, Command and Language
+	idle     []warmSandbox
+	starting int
+	pinned   bool // kept even when unused, see Prepare
+	lastUsed time.Time
+	failedAt time.Time
+}
+
+// NewWarmPool wraps executor in a pool keeping size idle sandboxes per
+// runtime. It returns ErrWarmPoolUnsupported when the executor cannot run
+// jobs in pre-started sandboxes.
+func NewWarmPool(executor Executor, size int) (*WarmPool, error) {
+	warm, ok := executor.(warmExecutor)
+	if !ok {
+		return nil, ErrWarmPoolUnsupported
+	}
+	return &WarmPool{
+		Executor: executor,
+		Size:     size,
+		warm:     warm,
+		runtimes: make(map[string]*warmRuntime),
+	}, nil
+}
+
+// Prepare starts filling the pool for the runtime of job and keeps it filled
+// even while no job asks for it
+func (p *WarmPool) Prepare(job *Job) error {
+	key, ok := p.warm.warmKey(job)
+	if !ok {
+		return fmt.Errorf("jobs of runtime %s cannot run in warm sandboxes", job.Language)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.runtime(key, job).pinned = true
+	p.fill(key)
+	return nil
+}
+
+// Run executes the job in an idle sandbox of its runtime when there is one
+// and in a new sandbox otherwise
+func (p *WarmPool) Run(ctx context.Context, job *Job) (*Result, error) {
+	entered := time.Now()
+
+	key, ok := p.warm.warmKey(job)
+	if !ok {
+		p.count(&p.stats.Bypassed)
+		return p.runCold(ctx, job)
+	}
+
+	if sandbox := p.take(key, job); sandbox != nil {
+		result, err := p.warm.runWarm(ctx, job, sandbox, entered)
+		if !errors.Is(err, errWarmUnusable) {
+			p.count(&p.stats.Hits)
+			if result != nil {
+				p.recordStartup(true, result.Startup)
+			}
+			return result, err
+		}
+		log.Printf("Warm sandbox for job %s was unusable, starting a new one\n", job.ID)
+	}
+
+	p.count(&p.stats.Misses)
+	return p.runCold(ctx, job)
+}
+
+// runCold runs the job in a sandbox started for it
+func (p *WarmPool) runCold(ctx context.Context, job *Job) (*Result, error) {
+	result, err := p.Executor.Run(ctx, job)
+	if result != nil {
+		p.recordStartup(false, result.Startup)
+	}
+	return result, err
+}
+
+// Unwrap returns the executor the pool starts sandboxes with
+func (p *WarmPool) Unwrap() Executor {
+	return p.Executor
+}
+
+// Stats returns the pool's size, hit rate and startup times. It is expected
+// to be called periodically: runtimes no job has asked for within
+// warmIdleTimeout are dropped from the pool and the others are refilled.
+func (p *WarmPool) Stats() models.WarmPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire()
+	// Retry runtimes that failed to start sandboxes and have seen no job since
+	for key := range p.runtimes {
+		p.fill(key)
+	}
+
+	stats := p.stats
+	stats.Size = p.Size
+	stats.Runtimes = len(p.runtimes)
+	for _, rt := range p.runtimes {
+		stats.Idle += len(rt.idle)
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+	return stats
+}
+
+// Close destroys the idle sandboxes and stops refilling the pool. Jobs
+// still running keep their sandboxes until they finish.
+func (p *WarmPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	var idle []warmSandbox
+	for key, rt := range p.runtimes {
+		idle = append(idle, rt.idle...)
+		delete(p.runtimes, key)
+	}
+	p.mu.Unlock()
+
+	for _, sandbox := range idle {
+		sandbox.destroy()
+	}
+}
+
+// take removes an idle sandbox of the runtime from the pool and starts its
+// replacement. It returns nil when none is idle.
+func (p *WarmPool) take(key string, job *Job) warmSandbox {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rt := p.runtime(key, job)
+	rt.lastUsed = time.Now()
+	var sandbox warmSandbox
+	if n := len(rt.idle); n > 0 {
+		sandbox = rt.idle[n-1]
+		rt.idle = rt.idle[:n-1]
+	}
+	p.fill(key)
+	return sandbox
+}
+
+// runtime returns the pool of a runtime, creating it for job's runtime.
+// p.mu must be held.
+func (p *WarmPool) runtime(key string, job *Job) *warmRuntime {
+	rt, ok := p.runtimes[key]
+	if !ok {
+		rt = &warmRuntime{
+			template: &Job{Image: job.Image, Command: job.Command, Language: job.Language},
+			lastUsed: time.Now(),
+		}
+		p.runtimes[key] = rt
+	}
+	return rt
+}
+
+// fill starts sandboxes in the background until the runtime has Size of
+// them idle or starting. p.mu must be held.
+func (p *WarmPool) fill(key string) {
+	rt := p.runtimes[key]
+	if p.closed || rt == nil || time.Since(rt.failedAt) < warmRetryDelay {
+		return
+	}
+	for len(rt.idle)+rt.starting < p.Size {
+		rt.starting++
+		go p.startOne(key, rt)
+	}
+}
+
+// startOne starts a sandbox for the runtime and adds it to the pool
+func (p *WarmPool) startOne(key string, rt *warmRuntime) {
+	sandbox, err := p.warm.startWarm(rt.template)
+
+	p.mu.Lock()
+	rt.starting--
+	if err != nil {
+		rt.failedAt = time.Now()
+		p.mu.Unlock()
+		log.Printf("Failed to start warm sandbox for runtime %s: %v\n", key, err)
+		return
+	}
+	// The runtime may have been dropped or the pool closed in the meantime
+	if p.closed || p.runtimes[key] != rt {
+		p.mu.Unlock()
+		sandbox.destroy()
+		return
+	}
+	rt.idle = append(rt.idle, sandbox)
+	p.mu.Unlock()
+}
+
+// expire drops the runtimes no job has asked for within warmIdleTimeout,
+// except prepared ones. p.mu must be held.
+func (p *WarmPool) expire() {
+	for key, rt := range p.runtimes {
+		if rt.pinned || time.Since(rt.lastUsed) < warmIdleTimeout {
+			continue
+		}
+		delete(p.runtimes, key)
+		for _, sandbox := range rt.idle {
+			go sandbox.destroy()
+		}
+	}
+}
+
+// count increments one of the pool's counters
+func (p *WarmPool) count(counter *int64) {
+	p.mu.Lock()
+	*counter++
+	p.mu.Unlock()
+}
+
+// recordStartup adds a job's startup time to the warm or cold average
+func (p *WarmPool) recordStartup(warm bool, startup time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ms := float64(startup) / float64(time.Millisecond)
+	if warm {
+		p.stats.WarmStarts++
+		p.stats.AvgWarmStartMs += (ms - p.stats.AvgWarmStartMs) / float64(p.stats.WarmStarts)
+	} else {
+		p.stats.ColdStarts++
+		p.stats.AvgColdStartMs += (ms - p.stats.AvgColdStartMs) / float64(p.stats.ColdStarts)
+	}
+}
+
+// prepareWarmDir creates the scratch directory of a warm sandbox and writes
+// the harness into it. The job's code is written once it is assigned.
+func prepareWarmDir(baseDir string) (string, error) {
+	return prepareWorkDir(baseDir, &Job{ID: "warm-" + uuid.New().String()})
+}
+
+// assignWarmJob writes the job's code into the work directory of a warm
+// sandbox and then the job file the harness is waiting for. The job file is
+// renamed into place so the harness never reads it half written.
+func assignWarmJob(workDir string, job *Job, env []string) error {
+	if err := os.WriteFile(filepath.Join(workDir, jobCodeFile(job)), []byte(job.Code), 0644); err != nil {
+		return fmt.Errorf("failed to write code: %w", err)
+	}
+
+	values := make(map[string]string, len(env))
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		values[name] = value
+	}
+	data, err := json.Marshal(map[string]interface{}{"env": values})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(workDir, warmJobFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write job file: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(workDir, warmJobFile))
+}
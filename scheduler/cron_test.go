@@ -0,0 +1,136 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		{"*/15 * * * *", "2024-01-01 00:00", "2024-01-01 00:15"},
+		{"0-30/10 9 * * *", "2024-01-01 09:25", "2024-01-01 09:30"},
+		{"0-30/10 9 * * *", "2024-01-01 09:30", "2024-01-02 09:00"},
+		{"5/20 * * * *", "2024-01-01 00:06", "2024-01-01 00:25"},
+		{"0 8,17 * * 1-5", "2024-01-05 17:00", "2024-01-08 08:00"},
+		{"0 12 * JAN-MAR MON", "2024-01-01 12:00", "2024-01-08 12:00"},
+		{"0 12 * jan-mar mon", "2024-03-25 12:00", "2025-01-06 12:00"},
+		{"@hourly", "2024-01-01 00:30", "2024-01-01 01:00"},
+		{"@monthly", "2024-01-15 00:00", "2024-02-01 00:00"},
+
+		// 7 and SUN both mean Sunday
+		{"0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 * * SUN", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 * * 5-7", "2024-01-01 00:00", "2024-01-05 00:00"},
+
+		// With both day fields restricted, either one matching is enough
+		{"0 0 13 * FRI", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"0 0 13 * FRI", "2024-01-12 00:00", "2024-01-13 00:00"},
+		// With only one restricted, that one decides
+		{"0 0 13 * *", "2024-01-01 00:00", "2024-01-13 00:00"},
+		{"0 0 * * FRI", "2024-01-01 00:00", "2024-01-05 00:00"},
+
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+	}
+
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		got := cron.Next(parseTime(t, tt.after, time.UTC), time.UTC)
+		if want := parseTime(t, tt.want, time.UTC); !got.Equal(want) {
+			t.Errorf("%q after %s = %v, want %v", tt.expr, tt.after, got, want)
+		}
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	for _, expr := range []string{"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		cron, err := ParseCron(expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", expr, err)
+		}
+		if got := cron.Next(parseTime(t, "2024-01-01 00:00", time.UTC), time.UTC); !got.IsZero() {
+			t.Errorf("%q = %v, want the zero time", expr, got)
+		}
+	}
+
+	next, err := NextRun("0 0 30 2 *", "UTC", time.Now())
+	if err != nil || next != nil {
+		t.Errorf("NextRun = %v, %v; want no upcoming run", next, err)
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clocks go from 02:00 EST to 03:00 EDT on 2024-03-10 and from 02:00 EDT
+	// back to 01:00 EST on 2024-11-03. Times are in UTC.
+	tests := []struct {
+		name  string
+		expr  string
+		after string
+		want  string
+	}{
+		{"hourly over the skipped hour", "0 * * * *", "2024-03-10 06:30", "2024-03-10 07:00"},
+		{"time in the skipped hour", "30 2 * * *", "2024-03-09 08:00", "2024-03-11 06:30"},
+		{"daily after the gap", "0 9 * * *", "2024-03-09 15:00", "2024-03-10 13:00"},
+		{"first of a repeated time", "30 1 * * *", "2024-11-03 04:00", "2024-11-03 05:30"},
+		{"repeated time runs once", "30 1 * * *", "2024-11-03 05:30", "2024-11-04 06:30"},
+		{"hourly over the repeated hour", "0 * * * *", "2024-11-03 05:00", "2024-11-03 07:00"},
+		{"daily after the change", "0 9 * * *", "2024-11-02 14:00", "2024-11-03 14:00"},
+	}
+
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+		got := cron.Next(parseTime(t, tt.after, time.UTC), loc)
+		if want := parseTime(t, tt.want, time.UTC); !got.Equal(want) {
+			t.Errorf("%s: %q after %s UTC = %v, want %v", tt.name, tt.expr, tt.after, got.UTC(), want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@often",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+// parseTime parses a "2006-01-02 15:04" time in loc
+func parseTime(t *testing.T, value string, loc *time.Location) time.Time {
+	t.Helper()
+
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
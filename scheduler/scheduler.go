@@ -0,0 +1,305 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	// Timezones must resolve even on images without tzdata
+	_ "time/tzdata"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/middleware"
+	"go-deepsandbox/models"
+)
+
+// lockKey is held by the one replica that fires schedules
+const lockKey = "deepsandbox:scheduler:lock"
+
+// dueBatchSize caps how many due schedules are fired per tick
+const dueBatchSize = 100
+
+// lockScript takes the scheduler lock, or extends it when the caller already
+// holds it. It returns 1 when the caller holds the lock.
+var lockScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// unlockScript releases the scheduler lock if the caller holds it
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Scheduler queues an execution for each schedule that is due. Every worker
+// runs one, but only the replica holding the Redis lock fires schedules.
+type Scheduler struct {
+	ID        string
+	DB        *gorm.DB
+	Redis     *redis.Client
+	Config    *config.Config
+	TaskQueue *db.TaskQueue
+}
+
+// NewScheduler creates a new scheduler; id identifies the replica holding the lock
+func NewScheduler(database *gorm.DB, redisClient *redis.Client, cfg *config.Config, id string) *Scheduler {
+	return &Scheduler{
+		ID:        id,
+		DB:        database,
+		Redis:     redisClient,
+		Config:    cfg,
+		TaskQueue: db.GetTaskQueue(redisClient),
+	}
+}
+
+// Run fires due schedules every Config.SchedulerInterval seconds until ctx
+// is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	interval := time.Duration(s.Config.SchedulerInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer unlockScript.Run(context.Background(), s.Redis, []string{lockKey}, s.ID)
+
+	for {
+		// The lock outlives a few missed ticks so a busy leader keeps it
+		leader, err := lockScript.Run(ctx, s.Redis, []string{lockKey}, s.ID, (3 * interval).Milliseconds()).Int()
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to take the scheduler lock: %v\n", err)
+		}
+		if leader == 1 {
+			s.fireDue(time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fireDue queues a run of every enabled schedule whose next run is due
+func (s *Scheduler) fireDue(now time.Time) {
+	var due []models.Schedule
+	err := s.DB.Where("enabled = ? AND next_run_at <= ?", true, now).
+		Order("next_run_at").
+		Limit(dueBatchSize).
+		Find(&due).Error
+	if err != nil {
+		log.Printf("Failed to load due schedules: %v\n", err)
+		return
+	}
+
+	for i := range due {
+		s.fire(&due[i], now)
+	}
+}
+
+// fire queues one run of a schedule and moves it to its next run. Runs
+// missed while no scheduler was running are not caught up on.
+func (s *Scheduler) fire(schedule *models.Schedule, now time.Time) {
+	next, err := NextRun(schedule.Cron, schedule.Timezone, now)
+	if err != nil {
+		disable(s.DB, schedule.ID, "Invalid schedule: "+err.Error())
+		return
+	}
+
+	// Claim this run; a replica that already fired it has moved next_run_at
+	updates := map[string]interface{}{"next_run_at": next, "last_run_at": now}
+	if next == nil {
+		updates["enabled"] = false
+		updates["disabled_reason"] = "Cron expression has no upcoming runs"
+	}
+	claimed := s.DB.Model(&models.Schedule{}).
+		Where("id = ? AND enabled = ? AND next_run_at = ?", schedule.ID, true, schedule.NextRunAt).
+		Updates(updates)
+	if claimed.Error != nil || claimed.RowsAffected == 0 {
+		return
+	}
+
+	execution := &models.CodeExecution{
+		UserID:     schedule.UserID,
+		DatasetID:  schedule.DatasetID,
+		Code:       schedule.Code,
+		Kind:       models.KindCode,
+		Timeout:    schedule.Timeout,
+		Priority:   schedule.Priority,
+		ScheduleID: schedule.ID,
+		Datasets:   []models.ExecutionDataset{{Alias: models.PrimaryDatasetAlias, DatasetID: schedule.DatasetID}},
+	}
+
+	reservation := ""
+	err = s.checkAccess(schedule, execution)
+	if err == nil {
+		reservation, err = s.reserveRun(schedule)
+	}
+	if err != nil {
+		// Keep the refused run in the schedule's history
+		execution.Status = models.StatusFailed
+		execution.EndTime = db.CurrentTimestamp()
+		execution.Error = err.Error()
+		execution.Datasets = nil
+		if err := s.DB.Create(execution).Error; err != nil {
+			log.Printf("Failed to record run of schedule %s: %v\n", schedule.ID, err)
+			return
+		}
+	} else if err := db.SubmitExecution(s.DB, s.TaskQueue, execution); err != nil {
+		log.Printf("Failed to queue run of schedule %s: %v\n", schedule.ID, err)
+		if reservation != "" {
+			middleware.ReleaseExecution(s.Redis, reservation)
+		}
+		if execution.Status != models.StatusFailed {
+			return
+		}
+	}
+
+	s.DB.Model(&models.Schedule{}).Where("id = ?", schedule.ID).Updates(map[string]interface{}{
+		"last_execution_id": execution.ID,
+		"last_status":       execution.Status,
+	})
+	if models.IsTerminalStatus(execution.Status) {
+		RecordOutcome(s.DB, execution, s.Config.ScheduleMaxFailures)
+	}
+	log.Printf("Schedule %s fired execution %s\n", schedule.ID, execution.ID)
+}
+
+// reserveRun counts a run against the schedule owner's daily execution
+// quota and returns the reservation. It returns an empty reservation without
+// an error when the quota could not be checked, in which case the run is not
+// counted.
+func (s *Scheduler) reserveRun(schedule *models.Schedule) (string, error) {
+	var user models.User
+	if err := s.DB.Where("id = ?", schedule.UserID).First(&user).Error; err != nil {
+		return "", errors.New("Schedule owner not found")
+	}
+	reservation, err := middleware.ReserveExecution(s.Redis, user.ID, middleware.ExecutionLimit(s.Config, &user))
+	if err != nil {
+		log.Printf("Failed to reserve a run of schedule %s: %v\n", schedule.ID, err)
+		return "", nil
+	}
+	if reservation == "" {
+		return "", errors.New("Schedule owner has exceeded their daily execution quota")
+	}
+	return reservation, nil
+}
+
+// checkAccess verifies that the schedule's owner can still run code against
+// its dataset at the schedule's priority, and caps the run's timeout by the
+// owner's current quota
+func (s *Scheduler) checkAccess(schedule *models.Schedule, execution *models.CodeExecution) error {
+	var user models.User
+	if err := s.DB.Where("id = ?", schedule.UserID).First(&user).Error; err != nil {
+		return errors.New("Schedule owner not found")
+	}
+	if user.Disabled {
+		return errors.New("Schedule owner is disabled")
+	}
+
+	var dataset models.Dataset
+	if err := s.DB.Where("id = ?", schedule.DatasetID).First(&dataset).Error; err != nil {
+		return errors.New("Dataset not found")
+	}
+
+	isAdmin := false
+	for _, role := range user.Roles {
+		if role == "admin" {
+			isAdmin = true
+			break
+		}
+	}
+	if dataset.UserID != user.ID && !isAdmin {
+		return errors.New("Schedule owner no longer has access to the dataset")
+	}
+
+	if !models.PriorityAllowed(execution.Priority, models.MaxPriority(user.Roles)) {
+		return errors.New("Schedule owner's role no longer allows " + execution.Priority + " priority")
+	}
+	maxExecutionTime := user.QuotaLimit("max_execution_time", s.Config.ContainerTimeout)
+	if execution.Timeout <= 0 || execution.Timeout > maxExecutionTime {
+		execution.Timeout = maxExecutionTime
+	}
+	return nil
+}
+
+// NextRun returns the first time after t matching a cron expression in a
+// timezone, or nil when it never matches again
+func NextRun(expr, timezone string, t time.Time) (*time.Time, error) {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", timezone)
+	}
+
+	next := cron.Next(t, loc)
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// RecordOutcome updates the schedule a finished execution ran for. Failed
+// and timed out runs count towards maxFailures consecutive failures, after
+// which the schedule is disabled; a completed run resets the count.
+func RecordOutcome(database *gorm.DB, execution *models.CodeExecution, maxFailures int) {
+	if execution.ScheduleID == "" {
+		return
+	}
+
+	database.Model(&models.Schedule{}).
+		Where("id = ? AND last_execution_id = ?", execution.ScheduleID, execution.ID).
+		Update("last_status", execution.Status)
+
+	switch execution.Status {
+	case models.StatusCompleted:
+		database.Model(&models.Schedule{}).Where("id = ?", execution.ScheduleID).
+			Update("consecutive_failures", 0)
+		return
+	case models.StatusFailed, models.StatusTimedOut:
+		database.Model(&models.Schedule{}).Where("id = ?", execution.ScheduleID).
+			Update("consecutive_failures", gorm.Expr("consecutive_failures + 1"))
+	default:
+		return
+	}
+
+	if maxFailures <= 0 {
+		return
+	}
+	disabled := database.Model(&models.Schedule{}).
+		Where("id = ? AND enabled = ? AND consecutive_failures >= ?", execution.ScheduleID, true, maxFailures).
+		Updates(map[string]interface{}{
+			"enabled":         false,
+			"next_run_at":     nil,
+			"disabled_reason": fmt.Sprintf("Disabled after %d consecutive failed runs", maxFailures),
+		})
+	if disabled.Error == nil && disabled.RowsAffected > 0 {
+		log.Printf("Schedule %s disabled after %d consecutive failed runs\n", execution.ScheduleID, maxFailures)
+	}
+}
+
+// disable turns a schedule off, recording why
+func disable(database *gorm.DB, scheduleID, reason string) {
+	database.Model(&models.Schedule{}).Where("id = ?", scheduleID).Updates(map[string]interface{}{
+		"enabled":         false,
+		"next_run_at":     nil,
+		"disabled_reason": reason,
+	})
+	log.Printf("Schedule %s disabled: %s\n", scheduleID, reason)
+}
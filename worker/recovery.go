@@ -0,0 +1,231 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go-deepsandbox/db"
+	"go-deepsandbox/models"
+)
+
+// reapBatchSize caps how many expired leases one reaper pass claims
+const reapBatchSize = 100
+
+// reconcileLockTTL bounds how long a crashed worker can keep others from
+// reconciling at startup
+const reconcileLockTTL = 5 * time.Minute
+
+// reconcileGrace is how old a queued execution must be before startup
+// reconciliation looks for it in the queue, so that executions being
+// submitted right now are left alone
+const reconcileGrace = time.Minute
+
+// leaseTimeout returns how long a worker may go without renewing a lease
+func (w *Worker) leaseTimeout() time.Duration {
+	if w.Config.TaskLeaseTimeout < 1 {
+		return time.Second
+	}
+	return time.Duration(w.Config.TaskLeaseTimeout) * time.Second
+}
+
+// heartbeatInterval returns how often leases are renewed: often enough that
+// a renewal can fail twice before the lease expires
+func (w *Worker) heartbeatInterval() time.Duration {
+	interval := w.leaseTimeout() / 3
+	if interval > statusInterval {
+		interval = statusInterval
+	}
+	return interval
+}
+
+// renewLeases extends the leases on the tasks this worker holds. Tasks
+// whose lease was lost have been recovered by another worker and are
+// stopped without recording their outcome.
+func (w *Worker) renewLeases() {
+	w.mu.Lock()
+	var taskIDs []string
+	for taskID, active := range w.active {
+		if active.leased && !active.leaseLost {
+			taskIDs = append(taskIDs, taskID)
+		}
+	}
+	w.mu.Unlock()
+
+	lost, err := w.TaskQueue.RenewLeases(w.ID, taskIDs, w.leaseTimeout())
+	if err != nil {
+		log.Printf("Failed to renew task leases: %v\n", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, taskID := range lost {
+		if active, ok := w.active[taskID]; ok {
+			log.Printf("Lease on task %s expired, stopping it\n", taskID)
+			active.leaseLost = true
+			active.cancel()
+		}
+	}
+}
+
+// runReaper recovers the tasks whose lease expired every heartbeatInterval
+// until ctx is cancelled
+func (w *Worker) runReaper(ctx context.Context) {
+	ticker := time.NewTicker(w.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		w.reap()
+		w.failOrphanedSessions()
+	}
+}
+
+// reap recovers a batch of the tasks whose lease expired
+func (w *Worker) reap() {
+	expired, err := w.TaskQueue.ClaimExpiredLeases(reapBatchSize)
+	if err != nil {
+		log.Printf("Failed to claim expired task leases: %v\n", err)
+	}
+	for taskID, workerID := range expired {
+		w.recoverTask(taskID, fmt.Sprintf("Worker %s stopped responding", workerID))
+	}
+}
+
+// failOrphanedSessions ends the sessions hosted by workers that are no
+// longer live, which would otherwise stay active and count towards their
+// user's limit forever
+func (w *Worker) failOrphanedSessions() {
+	var sessions []models.Session
+	err := w.DB.Where("status IN ? AND worker_id <> ''", []string{models.SessionStarting, models.SessionReady}).
+		Find(&sessions).Error
+	if err != nil || len(sessions) == 0 {
+		return
+	}
+	live, err := w.TaskQueue.GetWorkerStatuses()
+	if err != nil {
+		log.Printf("Failed to read worker statuses: %v\n", err)
+		return
+	}
+
+	for i := range sessions {
+		session := &sessions[i]
+		if _, ok := live[session.WorkerID]; ok || session.WorkerID == w.ID {
+			continue
+		}
+		w.endSession(session, models.SessionFailed, fmt.Sprintf("Worker %s stopped responding", session.WorkerID))
+	}
+}
+
+// reconcile recovers the executions a previous crash left queued or running
+// without a worker or a place in the queue, and ends the sessions of workers
+// that are gone. One worker at a time reconciles.
+func (w *Worker) reconcile() {
+	locked, err := w.TaskQueue.LockReconcile(w.ID, reconcileLockTTL)
+	if err != nil || !locked {
+		return
+	}
+	defer w.TaskQueue.UnlockReconcile(w.ID)
+
+	// Tasks dequeued by workers that died without a lease
+	unleased, err := w.TaskQueue.UnleasedProcessing()
+	if err != nil {
+		log.Printf("Failed to read the processing list: %v\n", err)
+		return
+	}
+	for _, taskID := range unleased {
+		w.recoverTask(taskID, "The worker stopped")
+	}
+	w.failOrphanedSessions()
+
+	var executions []models.CodeExecution
+	err = w.DB.Preload("Datasets").
+		Where("status = ? OR (status = ? AND created_at < ?)",
+			models.StatusRunning, models.StatusQueued, time.Now().Add(-reconcileGrace)).
+		Find(&executions).Error
+	if err != nil {
+		log.Printf("Failed to load unfinished executions: %v\n", err)
+		return
+	}
+
+	recovered := 0
+	for i := range executions {
+		execution := &executions[i]
+		pending, err := w.TaskQueue.IsPending(execution.ID, execution.Priority, execution.UserID)
+		if err != nil {
+			log.Printf("Failed to look up task %s: %v\n", execution.ID, err)
+			continue
+		}
+		if pending {
+			continue
+		}
+
+		recovered++
+		if execution.Status == models.StatusRunning {
+			w.recoverTask(execution.ID, "The worker stopped")
+			continue
+		}
+		// Queued executions never started, so queueing them again is no retry
+		if err := w.TaskQueue.Requeue(db.TaskForExecution(execution)); err != nil {
+			log.Printf("Failed to requeue task %s: %v\n", execution.ID, err)
+		}
+	}
+	if recovered > 0 {
+		log.Printf("Reconciled %d executions missing from the queue\n", recovered)
+	}
+}
+
+// recoverTask handles a task its worker stopped working on: it is queued
+// again until it has been retried Config.TaskMaxRetries times, and failed
+// with reason after that. Finished and cancelled tasks are only released.
+func (w *Worker) recoverTask(taskID, reason string) {
+	var execution models.CodeExecution
+	if err := w.DB.Preload("Datasets").Where("id = ?", taskID).First(&execution).Error; err != nil {
+		log.Printf("Execution %s not found, dropping task: %v\n", taskID, err)
+		w.TaskQueue.Release(taskID)
+		return
+	}
+	if models.IsTerminalStatus(execution.Status) {
+		w.TaskQueue.Release(taskID)
+		return
+	}
+
+	execution.EndTime = db.CurrentTimestamp()
+	switch cancelledBy := w.TaskQueue.CancelRequestedBy(taskID); {
+	case cancelledBy != "":
+		execution.Status = models.StatusCancelled
+		execution.Error = "Cancelled by " + cancelledBy
+	case execution.Retries < w.Config.TaskMaxRetries:
+		execution.Retries++
+		execution.Status = models.StatusQueued
+		execution.StartTime = 0
+		execution.EndTime = 0
+		execution.WorkerID = ""
+		if err := w.DB.Save(&execution).Error; err != nil {
+			log.Printf("Failed to requeue task %s: %v\n", taskID, err)
+			return
+		}
+		if err := w.TaskQueue.Requeue(db.TaskForExecution(&execution)); err != nil {
+			log.Printf("Failed to requeue task %s: %v\n", taskID, err)
+			return
+		}
+		log.Printf("%s; requeued task %s (retry %d of %d)\n", reason, taskID, execution.Retries, w.Config.TaskMaxRetries)
+		return
+	default:
+		execution.Status = models.StatusFailed
+		execution.Error = fmt.Sprintf("%s while running the task; gave up after %d retries", reason, execution.Retries)
+	}
+
+	log.Printf("%s; marked task %s %s\n", reason, taskID, execution.Status)
+	w.DB.Save(&execution)
+	w.TaskQueue.MarkFinished(taskID, execution.Status, execution.EndTime, execution.Results, execution.Error)
+	w.TaskQueue.PublishFinalStatus(taskID)
+	w.TaskQueue.Release(taskID)
+	w.recordOutcome(&execution)
+}
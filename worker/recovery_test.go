@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go-deepsandbox/db"
+	"go-deepsandbox/models"
+)
+
+// leaseExpired has another worker dequeue the execution and stop renewing
+// its lease, as a worker that died would
+func (w *testWorker) leaseExpired(t *testing.T, execution *models.CodeExecution) {
+	t.Helper()
+
+	task, err := w.TaskQueue.Dequeue(context.Background(), "worker-2", -time.Second, time.Second)
+	if err != nil || task == nil || task.ID != execution.ID {
+		t.Fatalf("Dequeue = %v, %v; want the execution", task, err)
+	}
+	if _, err := w.TaskQueue.MarkRunning(task.ID, "worker-2", 1); err != nil {
+		t.Fatal(err)
+	}
+	execution.Status = models.StatusRunning
+	execution.WorkerID = "worker-2"
+	if err := w.DB.Save(execution).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapRequeuesExpiredLease(t *testing.T) {
+	w := newTestWorker(t)
+	execution := w.submit(t, "user-1", "print(1)", 0)
+	w.leaseExpired(t, execution)
+
+	w.reap()
+
+	got := w.execution(t, execution.ID)
+	if got.Status != models.StatusQueued || got.Retries != 1 || got.WorkerID != "" {
+		t.Errorf("execution = %s, retries %d, worker %q; want queued again for its first retry", got.Status, got.Retries, got.WorkerID)
+	}
+	if task := w.dequeue(t); task.ID != execution.ID {
+		t.Errorf("dequeued %s, want the recovered task", task.ID)
+	}
+}
+
+func TestReapFailsTaskOutOfRetries(t *testing.T) {
+	w := newTestWorker(t)
+	execution := w.submit(t, "user-1", "print(1)", 0)
+	execution.Retries = w.Config.TaskMaxRetries
+	w.leaseExpired(t, execution)
+
+	w.reap()
+
+	status := w.assertFinished(t, execution.ID, models.StatusFailed)
+	if !strings.Contains(status.Error, "Worker worker-2 stopped responding") || !strings.Contains(status.Error, "gave up after 2 retries") {
+		t.Errorf("error = %q, want the dead worker and the retries given up on", status.Error)
+	}
+}
+
+func TestLostLeaseDiscardsResult(t *testing.T) {
+	w := newTestWorker(t)
+	w.executor.Delay = time.Minute
+	execution := w.submit(t, "user-1", "print(1)", 0)
+	task := w.dequeue(t)
+
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		w.process(task)
+	}()
+	w.waitForStatus(t, task.ID, models.StatusRunning)
+
+	// Another worker recovers the task while this one is unresponsive
+	if err := w.TaskQueue.Release(task.ID); err != nil {
+		t.Fatal(err)
+	}
+	w.renewLeases()
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task was not stopped after its lease was lost")
+	}
+
+	if got := w.execution(t, execution.ID); got.Status != models.StatusRunning || got.EndTime != 0 {
+		t.Errorf("execution = %s, ended %v; want it left to the worker that recovered it", got.Status, got.EndTime)
+	}
+	if status, err := w.TaskQueue.GetTaskStatus(execution.ID); err != nil || status.Status != models.StatusRunning {
+		t.Errorf("task status = %+v, %v; want no outcome recorded", status, err)
+	}
+}
+
+func TestFailOrphanedSessions(t *testing.T) {
+	w := newTestWorker(t)
+	if err := w.TaskQueue.PublishWorkerStatus(&db.WorkerStatus{WorkerID: "worker-live"}); err != nil {
+		t.Fatal(err)
+	}
+	sessions := []models.Session{
+		{ID: "orphaned", UserID: "user-1", Status: models.SessionReady, WorkerID: "worker-dead"},
+		{ID: "hosted", UserID: "user-1", Status: models.SessionReady, WorkerID: "worker-live"},
+		{ID: "own", UserID: "user-1", Status: models.SessionStarting, WorkerID: w.ID},
+		{ID: "pending", UserID: "user-1", Status: models.SessionStarting},
+	}
+	if err := w.DB.Create(&sessions).Error; err != nil {
+		t.Fatal(err)
+	}
+	cell := &models.SessionCell{ID: "cell-1", SessionID: "orphaned", Code: "print(1)", Status: models.StatusQueued}
+	if err := w.Sessions.SubmitCell(cell); err != nil {
+		t.Fatal(err)
+	}
+
+	w.failOrphanedSessions()
+
+	want := map[string]string{
+		"orphaned": models.SessionFailed,
+		"hosted":   models.SessionReady,
+		"own":      models.SessionStarting,
+		"pending":  models.SessionStarting,
+	}
+	for id, status := range want {
+		var session models.Session
+		if err := w.DB.Where("id = ?", id).First(&session).Error; err != nil {
+			t.Fatal(err)
+		}
+		if session.Status != status {
+			t.Errorf("session %s = %s, want %s", id, session.Status, status)
+		}
+	}
+	if got, err := w.Sessions.GetCell("orphaned", "cell-1"); err != nil || got.Status != models.StatusFailed {
+		t.Errorf("cell = %+v, %v; want the waiting cell failed", got, err)
+	}
+}
+
+func TestReapedTaskFinishingDiscardsResult(t *testing.T) {
+	w := newTestWorker(t)
+	w.Config.TaskLeaseTimeout = 1
+	w.executor.Delay = 2500 * time.Millisecond
+	execution := w.submit(t, "user-1", "print(1)", 0)
+	task := w.dequeue(t)
+
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		w.process(task)
+	}()
+	w.waitForStatus(t, task.ID, models.StatusRunning)
+
+	// No heartbeat runs, so the lease expires and is reaped while the task
+	// is still running, and the worker never learns it lost the lease
+	time.Sleep(1500 * time.Millisecond)
+	w.reap()
+	if got := w.execution(t, execution.ID); got.Status != models.StatusQueued || got.Retries != 1 {
+		t.Fatalf("execution = %s, retries %d; want it requeued by the reaper", got.Status, got.Retries)
+	}
+
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task did not finish")
+	}
+	if got := w.execution(t, execution.ID); got.Status != models.StatusQueued || got.EndTime != 0 {
+		t.Errorf("execution = %s, ended %v; want the requeued task left alone", got.Status, got.EndTime)
+	}
+	if status, err := w.TaskQueue.GetTaskStatus(execution.ID); err != nil || status.Status != models.StatusQueued {
+		t.Errorf("task status = %+v, %v; want the requeued task left alone", status, err)
+	}
+	if task := w.dequeue(t); task.ID != execution.ID {
+		t.Errorf("dequeued %s, want the requeued task", task.ID)
+	}
+}
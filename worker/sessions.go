@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go-deepsandbox/db"
+	"go-deepsandbox/models"
+	"go-deepsandbox/sandbox"
+)
+
+// sessionStartTimeout bounds how long a session may take to load its dataset,
+// including pulling the sandbox image
+const sessionStartTimeout = 5 * time.Minute
+
+// cellPollTimeout is how long a session waits for a cell before re-checking
+// its idle timeout
+const cellPollTimeout = time.Second
+
+// runSessionHost starts sessions while this worker has free session slots,
+// until ctx is cancelled. Hosted sessions are added to wg.
+func (w *Worker) runSessionHost(ctx context.Context, wg *sync.WaitGroup) {
+	slots := make(chan struct{}, w.Config.SessionsPerWorker)
+	for ctx.Err() == nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		sessionID, err := w.Sessions.NextSession(ctx, dequeueTimeout)
+		if err != nil || sessionID == "" {
+			<-slots
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to dequeue session: %v\n", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			w.hostSession(ctx, sessionID)
+		}()
+	}
+}
+
+// hostSession runs a session's sandbox and its cells until the session is
+// closed, idles out, fails or the worker shuts down
+func (w *Worker) hostSession(ctx context.Context, sessionID string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	active := w.track(sessionID, cancel, false)
+	defer w.untrack(sessionID)
+
+	// Claim the session; a session closed before it was picked up is dropped
+	claimed := w.DB.Model(&models.Session{}).
+		Where("id = ? AND status = ?", sessionID, models.SessionStarting).
+		Update("worker_id", w.ID)
+	if claimed.Error != nil || claimed.RowsAffected == 0 {
+		return
+	}
+
+	var session models.Session
+	if err := w.DB.Where("id = ?", sessionID).First(&session).Error; err != nil {
+		return
+	}
+
+	var dataset models.Dataset
+	if err := w.DB.Where("id = ?", session.DatasetID).First(&dataset).Error; err != nil {
+		w.endSession(&session, models.SessionFailed, "Dataset not found")
+		return
+	}
+
+	sess, err := sandbox.StartSession(ctx, w.Executor, w.Config.SandboxWorkDir, &sandbox.Job{
+		ID:          sessionID,
+		DatasetPath: dataset.FilePath(w.Config.DatasetsDir),
+		Timeout:     time.Duration(w.Config.SessionMaxLifetime) * time.Second,
+	})
+	if err != nil {
+		w.endSession(&session, models.SessionFailed, err.Error())
+		return
+	}
+	defer sess.Close()
+
+	if err := sess.WaitReady(sessionStartTimeout); err != nil {
+		w.endSession(&session, w.closedStatus(ctx, active), w.closeReason(ctx, active, err.Error()))
+		return
+	}
+
+	ready := w.DB.Model(&models.Session{}).
+		Where("id = ? AND status = ?", sessionID, models.SessionStarting).
+		Updates(map[string]interface{}{"status": models.SessionReady, "last_activity": db.CurrentTimestamp()})
+	if ready.Error != nil || ready.RowsAffected == 0 {
+		// Closed while the sandbox was starting
+		w.Sessions.FailPendingCells(sessionID, "Session closed")
+		return
+	}
+	session.Status = models.SessionReady
+	session.LastActivity = db.CurrentTimestamp()
+	log.Printf("Session %s ready\n", sessionID)
+
+	for {
+		if ctx.Err() != nil {
+			w.endSession(&session, w.closedStatus(ctx, active), w.closeReason(ctx, active, ""))
+			return
+		}
+		select {
+		case <-sess.Done():
+			w.endSession(&session, models.SessionFailed, "Session sandbox exited")
+			return
+		default:
+		}
+
+		idle := db.CurrentTimestamp() - session.LastActivity
+		if session.IdleTimeout > 0 && idle > float64(session.IdleTimeout) {
+			w.endSession(&session, models.SessionClosed, "Idle timeout")
+			return
+		}
+
+		cell, err := w.Sessions.NextCell(ctx, sessionID, cellPollTimeout)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to read cells of session %s: %v\n", sessionID, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if cell == nil {
+			continue
+		}
+
+		if err := w.runCell(sess, cell); err != nil {
+			w.endSession(&session, models.SessionFailed, err.Error())
+			return
+		}
+
+		session.CellCount++
+		session.LastActivity = db.CurrentTimestamp()
+		w.DB.Model(&models.Session{}).Where("id = ?", sessionID).Updates(map[string]interface{}{
+			"cell_count":    session.CellCount,
+			"last_activity": session.LastActivity,
+		})
+	}
+}
+
+// runCell executes one cell and records its result. It returns an error when
+// the session cannot continue after the cell.
+func (w *Worker) runCell(sess *sandbox.Session, cell *models.SessionCell) error {
+	cell.Status = models.StatusRunning
+	cell.StartTime = db.CurrentTimestamp()
+	w.Sessions.SaveCell(cell)
+
+	result, err := sess.Execute(cell.Code, time.Duration(cell.Timeout)*time.Second)
+	cell.EndTime = db.CurrentTimestamp()
+	cell.Results = result
+
+	var sessionErr error
+	switch {
+	case errors.Is(err, sandbox.ErrTimedOut):
+		cell.Status = models.StatusTimedOut
+		cell.Error = fmt.Sprintf("Cell timed out after %d seconds; the session was stopped", cell.Timeout)
+		sessionErr = errors.New(cell.Error)
+	case err != nil:
+		cell.Status = models.StatusFailed
+		cell.Error = err.Error()
+		sessionErr = err
+	case result.ExitCode != 0:
+		cell.Status = models.StatusFailed
+		cell.Error = "Cell raised an exception"
+	default:
+		cell.Status = models.StatusCompleted
+	}
+	w.Sessions.SaveCell(cell)
+
+	return sessionErr
+}
+
+// endSession records that a session has ended and fails the cells it did not run
+func (w *Worker) endSession(session *models.Session, status, reason string) {
+	w.DB.Model(&models.Session{}).
+		Where("id = ? AND status IN ?", session.ID, []string{models.SessionStarting, models.SessionReady}).
+		Updates(map[string]interface{}{
+			"status":    status,
+			"error":     reason,
+			"closed_at": db.CurrentTimestamp(),
+		})
+	w.Sessions.FailPendingCells(session.ID, "Session ended: "+reason)
+	log.Printf("Session %s %s: %s\n", session.ID, status, reason)
+}
+
+// closedStatus returns the status of a session whose context was cancelled:
+// closed when a user asked for it, failed otherwise
+func (w *Worker) closedStatus(ctx context.Context, active *activeTask) string {
+	if w.cancelledBy(active) != "" {
+		return models.SessionClosed
+	}
+	if ctx.Err() != nil {
+		return models.SessionClosed
+	}
+	return models.SessionFailed
+}
+
+// closeReason explains why a session ended, preferring who closed it
+func (w *Worker) closeReason(ctx context.Context, active *activeTask, fallback string) string {
+	if by := w.cancelledBy(active); by != "" {
+		return "Closed by " + by
+	}
+	if ctx.Err() != nil {
+		return "Worker shutting down"
+	}
+	return fallback
+}
@@ -0,0 +1,565 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/models"
+	"go-deepsandbox/pipeline"
+	"go-deepsandbox/sandbox"
+	"go-deepsandbox/scheduler"
+)
+
+// dequeueTimeout bounds how long a slot blocks on Redis before re-checking for shutdown
+const dequeueTimeout = 5 * time.Second
+
+// statusInterval is how often the worker publishes its status and the warm
+// pool's statistics, unless leases must be renewed more often
+const statusInterval = 10 * time.Second
+
+// Worker pulls code execution tasks from the queue and runs them
+type Worker struct {
+	ID        string
+	DB        *gorm.DB
+	Config    *config.Config
+	TaskQueue *db.TaskQueue
+	Sessions  *db.SessionQueue
+	Scheduler *scheduler.Scheduler
+	Executor  sandbox.Executor
+	Packages  *sandbox.PackageCache
+	WarmPool  *sandbox.WarmPool // wraps the executor when warm sandboxes are enabled
+
+	mu     sync.Mutex
+	active map[string]*activeTask
+}
+
+// activeTask is a task or session this worker is currently processing
+type activeTask struct {
+	cancel      context.CancelFunc
+	cancelledBy string
+	leased      bool // a task leased from the queue, renewed by the heartbeat
+	leaseLost   bool // the lease expired and the task was handed back to the queue
+}
+
+// NewWorker creates a new worker
+func NewWorker(database *gorm.DB, redisClient *redis.Client, executor sandbox.Executor, cfg *config.Config) *Worker {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+
+	id := fmt.Sprintf("%s-%s", hostname, uuid.New().String()[:8])
+	w := &Worker{
+		ID:        id,
+		DB:        database,
+		Config:    cfg,
+		TaskQueue: db.GetTaskQueue(redisClient),
+		Sessions:  db.NewSessionQueue(redisClient),
+		Scheduler: scheduler.NewScheduler(database, redisClient, cfg, id),
+		Executor:  executor,
+		Packages:  sandbox.NewPackageCache(cfg),
+		active:    make(map[string]*activeTask),
+	}
+
+	// Tasks take pre-started sandboxes from the pool when the backend supports it
+	if cfg.WarmPoolSize > 0 {
+		pool, err := sandbox.NewWarmPool(executor, cfg.WarmPoolSize)
+		if err != nil {
+			log.Printf("Warm sandbox pool disabled: %v\n", err)
+		} else {
+			w.WarmPool = pool
+			w.Executor = pool
+		}
+	}
+	return w
+}
+
+// Run keeps up to Config.ExecutionPoolSize tasks executing at once until ctx
+// is cancelled. Tasks already running when ctx is cancelled are allowed to finish.
+func (w *Worker) Run(ctx context.Context) error {
+	poolSize := w.Config.ExecutionPoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	log.Printf("Worker %s starting with %d execution slots\n", w.ID, poolSize)
+
+	// Cancel requests are handled until the last running task has finished,
+	// which may be after ctx is cancelled
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	pubsub, err := w.TaskQueue.SubscribeCancelRequests(watchCtx, w.ID)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to cancel requests: %w", err)
+	}
+	go w.watchCancels(pubsub)
+
+	// Tasks left behind by a previous crash are queued again or failed
+	w.reconcile()
+
+	// Register the worker and renew the leases of its tasks until the last
+	// running task has finished
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	defer stopHeartbeat()
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		w.heartbeat(heartbeatCtx, poolSize)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < poolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runSlot(ctx)
+		}()
+	}
+
+	// Interactive sessions have their own slots
+	if w.Config.SessionsPerWorker > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runSessionHost(ctx, &wg)
+		}()
+	}
+
+	// Keep sandboxes of the default runtime warm
+	if w.WarmPool != nil {
+		w.prepareWarmPool()
+	}
+
+	// Recover the tasks of workers that stopped responding
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.runReaper(ctx)
+	}()
+
+	// Only one worker at a time fires schedules
+	if w.Config.SchedulerInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Scheduler.Run(ctx)
+		}()
+	}
+	wg.Wait()
+	stopHeartbeat()
+	<-heartbeatDone
+	pubsub.Close()
+	if w.WarmPool != nil {
+		w.WarmPool.Close()
+	}
+	if err := w.TaskQueue.DeregisterWorker(w.ID); err != nil {
+		log.Printf("Failed to deregister worker: %v\n", err)
+	}
+
+	log.Printf("Worker %s stopped\n", w.ID)
+	return nil
+}
+
+// prepareWarmPool starts filling the warm pool for the default runtime
+func (w *Worker) prepareWarmPool() {
+	rt, err := db.ResolveRuntime(w.DB, "")
+	if err != nil {
+		log.Printf("Failed to resolve the default runtime for the warm pool: %v\n", err)
+		return
+	}
+	if err := w.WarmPool.Prepare(&sandbox.Job{Image: rt.Image, Command: rt.Command, Language: rt.Language}); err != nil {
+		log.Printf("Failed to prepare the warm pool: %v\n", err)
+	}
+}
+
+// heartbeat publishes the worker's status, renews the leases of the tasks it
+// holds and publishes the warm pool's statistics every heartbeatInterval
+// until ctx is cancelled
+func (w *Worker) heartbeat(ctx context.Context, slots int) {
+	ticker := time.NewTicker(w.heartbeatInterval())
+	defer ticker.Stop()
+
+	status := &db.WorkerStatus{WorkerID: w.ID, Slots: slots, StartedAt: db.CurrentTimestamp()}
+	for {
+		w.mu.Lock()
+		status.Running = len(w.active)
+		w.mu.Unlock()
+		if err := w.TaskQueue.PublishWorkerStatus(status); err != nil {
+			log.Printf("Failed to publish worker status: %v\n", err)
+		}
+		w.renewLeases()
+
+		if w.WarmPool != nil {
+			stats := w.WarmPool.Stats()
+			stats.WorkerID = w.ID
+			if err := w.TaskQueue.PublishWarmPoolStats(&stats); err != nil {
+				log.Printf("Failed to publish warm pool statistics: %v\n", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSlot processes tasks one at a time until ctx is cancelled
+func (w *Worker) runSlot(ctx context.Context) {
+	for ctx.Err() == nil {
+		task, err := w.TaskQueue.Dequeue(ctx, w.ID, w.leaseTimeout(), dequeueTimeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to dequeue task: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+
+		w.process(task)
+	}
+}
+
+// process executes a single task and records its outcome in Redis and the database
+func (w *Worker) process(task *db.Task) {
+	defer w.TaskQueue.Ack(task.ID, w.ID)
+
+	var execution models.CodeExecution
+	if err := w.DB.Where("id = ?", task.ID).First(&execution).Error; err != nil {
+		log.Printf("Execution %s not found, dropping task: %v\n", task.ID, err)
+		w.TaskQueue.MarkFinished(task.ID, models.StatusFailed, db.CurrentTimestamp(), nil, "Execution record not found")
+		w.TaskQueue.PublishFinalStatus(task.ID)
+		return
+	}
+
+	// The task may have been cancelled between being queued and being picked up
+	if models.IsTerminalStatus(execution.Status) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	active := w.track(task.ID, cancel, true)
+	defer w.untrack(task.ID)
+
+	// Update status to running unless a cancel arrived after the task was dequeued
+	startTime := db.CurrentTimestamp()
+	started, err := w.TaskQueue.MarkRunning(task.ID, w.ID, startTime)
+	if err != nil {
+		log.Printf("Failed to mark task %s running: %v\n", task.ID, err)
+	}
+	if err == nil && !started {
+		execution.Status = models.StatusCancelled
+		execution.EndTime = db.CurrentTimestamp()
+		execution.Error = "Cancelled by " + w.TaskQueue.CancelRequestedBy(task.ID)
+		if !w.finish(task.ID, &execution) {
+			return
+		}
+		w.TaskQueue.PublishFinalStatus(task.ID)
+		w.recordOutcome(&execution)
+		return
+	}
+	execution.Status = models.StatusRunning
+	execution.StartTime = startTime
+	execution.WorkerID = w.ID
+	w.DB.Save(&execution)
+
+	// Relay output to log stream subscribers while the task runs
+	runDone := make(chan struct{})
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		w.forwardLogs(task.ID, runDone)
+	}()
+
+	result, err := w.execute(ctx, task)
+	close(runDone)
+	<-logsDone
+
+	// The task was recovered while the worker was unresponsive and is
+	// owned by the queue again
+	if w.leaseLost(active) {
+		log.Printf("Lost the lease on task %s, discarding its result\n", task.ID)
+		return
+	}
+
+	execution.EndTime = db.CurrentTimestamp()
+	if result != nil {
+		execution.Results, _ = json.Marshal(result.ExecutionResult())
+	}
+
+	cancelledBy := w.cancelledBy(active)
+	switch {
+	case cancelledBy != "":
+		execution.Status = models.StatusCancelled
+		execution.Error = "Cancelled by " + cancelledBy
+	case errors.Is(err, sandbox.ErrTimedOut):
+		execution.Status = models.StatusTimedOut
+		execution.Error = fmt.Sprintf("Execution timed out after %d seconds", w.timeout(task))
+	case err != nil:
+		execution.Status = models.StatusFailed
+		execution.Error = err.Error()
+	case result.ExitCode != 0:
+		execution.Status = models.StatusFailed
+		execution.Error = fmt.Sprintf("Process exited with code %d", result.ExitCode)
+	default:
+		execution.Status = models.StatusCompleted
+	}
+	if !w.finish(task.ID, &execution) {
+		return
+	}
+	if result != nil {
+		w.saveArtifacts(task.ID, result.Artifacts)
+	}
+	w.TaskQueue.PublishFinalStatus(task.ID)
+	w.recordOutcome(&execution)
+}
+
+// finish records the outcome of a leased task unless the lease was lost, in
+// which case the task was recovered and the outcome is discarded. The lease
+// is checked and released together with the queue's record of the outcome,
+// so a task cannot be finished by both its worker and the reaper.
+func (w *Worker) finish(taskID string, execution *models.CodeExecution) bool {
+	finished, err := w.TaskQueue.FinishLeased(taskID, w.ID, execution.Status, execution.EndTime, execution.Results, execution.Error)
+	if err != nil {
+		log.Printf("Failed to record the outcome of task %s: %v\n", taskID, err)
+	} else if !finished {
+		log.Printf("Lost the lease on task %s, discarding its result\n", taskID)
+		return false
+	}
+	w.DB.Save(execution)
+	return true
+}
+
+// recordOutcome tells the schedule or pipeline a finished execution belongs to
+// how it ended
+func (w *Worker) recordOutcome(execution *models.CodeExecution) {
+	scheduler.RecordOutcome(w.DB, execution, w.Config.ScheduleMaxFailures)
+	pipeline.RecordOutcome(w.DB, w.TaskQueue, w.Config, execution)
+}
+
+// track registers a task as being processed so it can be cancelled. Leased
+// tasks have their lease renewed while they are tracked.
+func (w *Worker) track(taskID string, cancel context.CancelFunc, leased bool) *activeTask {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	active := &activeTask{cancel: cancel, leased: leased}
+	w.active[taskID] = active
+	return active
+}
+
+// untrack removes a task once it has been processed
+func (w *Worker) untrack(taskID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.active, taskID)
+}
+
+// cancelledBy returns who cancelled a task, or an empty string
+func (w *Worker) cancelledBy(active *activeTask) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return active.cancelledBy
+}
+
+// leaseLost reports whether the worker lost its lease on a task
+func (w *Worker) leaseLost(active *activeTask) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return active.leaseLost
+}
+
+// watchCancels stops the sandboxes of tasks cancelled through the API until
+// the subscription is closed
+func (w *Worker) watchCancels(pubsub *redis.PubSub) {
+	for message := range pubsub.Channel() {
+		request, err := db.ParseCancelRequest(message.Payload)
+		if err != nil {
+			log.Printf("Ignoring malformed cancel request: %v\n", err)
+			continue
+		}
+
+		w.mu.Lock()
+		active, ok := w.active[request.TaskID]
+		if ok && active.cancelledBy == "" {
+			active.cancelledBy = request.RequestedBy
+		}
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		log.Printf("Cancelling task %s at the request of %s\n", request.TaskID, request.RequestedBy)
+		// The context covers a sandbox that has not been started yet
+		w.Executor.Cancel(request.TaskID)
+		active.cancel()
+	}
+}
+
+// forwardLogs relays a task's output from the executor to Redis until the run
+// ends. The executor only accepts subscribers once the job has started, so
+// subscribing is retried until then.
+func (w *Worker) forwardLogs(taskID string, runDone <-chan struct{}) {
+	var lines <-chan sandbox.OutputLine
+	for lines == nil {
+		ch, err := w.Executor.Stream(taskID)
+		if err == nil {
+			lines = ch
+			break
+		}
+
+		select {
+		case <-runDone:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	for line := range lines {
+		if err := w.TaskQueue.AppendLog(taskID, line.Stream, line.Text, line.Time); err != nil {
+			log.Printf("Failed to publish log line for task %s: %v\n", taskID, err)
+		}
+	}
+}
+
+// execute runs the task's code in a sandbox against its datasets
+func (w *Worker) execute(ctx context.Context, task *db.Task) (*sandbox.Result, error) {
+	// Tasks queued before multi-dataset support only have DatasetID
+	aliases := task.Datasets
+	if len(aliases) == 0 {
+		aliases = map[string]string{models.PrimaryDatasetAlias: task.DatasetID}
+	}
+
+	datasetPath := ""
+	datasets := map[string]string{}
+	for alias, datasetID := range aliases {
+		var dataset models.Dataset
+		if err := w.DB.Where("id = ?", datasetID).First(&dataset).Error; err != nil {
+			return nil, fmt.Errorf("dataset %s not found", datasetID)
+		}
+		if alias == models.PrimaryDatasetAlias {
+			datasetPath = dataset.FilePath(w.Config.DatasetsDir)
+		} else {
+			datasets[alias] = dataset.FilePath(w.Config.DatasetsDir)
+		}
+	}
+
+	// Pipeline steps read the outputs of the steps they depend on
+	stepInputs, err := pipeline.StepInputs(w.DB, task.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load step inputs: %w", err)
+	}
+	inputs := make(map[string]string, len(stepInputs))
+	for name, executionID := range stepInputs {
+		inputs[name] = models.ArtifactsPath(w.Config.ArtifactsDir, executionID)
+		if err := os.MkdirAll(inputs[name], 0755); err != nil {
+			return nil, fmt.Errorf("failed to prepare inputs of step %s: %w", name, err)
+		}
+	}
+
+	rt, err := db.ResolveRuntime(w.DB, task.Runtime)
+	if err != nil {
+		return nil, fmt.Errorf("runtime is not available: %w", err)
+	}
+
+	limits, err := w.artifactLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from an empty artifacts directory in case the task is being re-run
+	artifactsDir := models.ArtifactsPath(w.Config.ArtifactsDir, task.ID)
+	if err := os.RemoveAll(artifactsDir); err != nil {
+		return nil, fmt.Errorf("failed to clear artifacts directory: %w", err)
+	}
+
+	job := &sandbox.Job{
+		ID:             task.ID,
+		Code:           task.Code,
+		Kind:           task.Kind,
+		DatasetPath:    datasetPath,
+		Datasets:       datasets,
+		Inputs:         inputs,
+		Image:          rt.Image,
+		Command:        rt.Command,
+		Language:       rt.Language,
+		Timeout:        time.Duration(w.timeout(task)) * time.Second,
+		ArtifactsDir:   artifactsDir,
+		ArtifactLimits: limits,
+	}
+
+	// Requirements are installed once per environment and then reused
+	if len(task.Requirements) > 0 {
+		if w.Packages == nil {
+			return nil, errors.New("requirements cannot be installed: PACKAGE_WHEELHOUSE is not set on this worker")
+		}
+		job.Packages, err = w.Packages.Environment(ctx, w.Executor, job, task.Requirements)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w.Executor.Run(ctx, job)
+}
+
+// artifactLimits returns the configured limits on the files kept per execution
+func (w *Worker) artifactLimits() (sandbox.ArtifactLimits, error) {
+	maxFileBytes, err := sandbox.ParseMemoryLimit(w.Config.ArtifactMaxFileSize)
+	if err != nil {
+		return sandbox.ArtifactLimits{}, fmt.Errorf("invalid ARTIFACT_MAX_FILE_SIZE: %w", err)
+	}
+	maxTotalBytes, err := sandbox.ParseMemoryLimit(w.Config.ArtifactMaxTotalSize)
+	if err != nil {
+		return sandbox.ArtifactLimits{}, fmt.Errorf("invalid ARTIFACT_MAX_TOTAL_SIZE: %w", err)
+	}
+
+	return sandbox.ArtifactLimits{
+		MaxFiles:      w.Config.ArtifactMaxFiles,
+		MaxFileBytes:  maxFileBytes,
+		MaxTotalBytes: maxTotalBytes,
+	}, nil
+}
+
+// saveArtifacts links the files kept from an execution's output directory to
+// its CodeExecution
+func (w *Worker) saveArtifacts(executionID string, artifacts []models.Artifact) {
+	w.DB.Where("execution_id = ?", executionID).Delete(&models.ExecutionArtifact{})
+	for _, artifact := range artifacts {
+		record := models.ExecutionArtifact{
+			ExecutionID: executionID,
+			Name:        artifact.Name,
+			ContentType: artifact.ContentType,
+			Size:        artifact.Size,
+		}
+		if err := w.DB.Create(&record).Error; err != nil {
+			log.Printf("Failed to record artifact %s of task %s: %v\n", artifact.Name, executionID, err)
+		}
+	}
+}
+
+// timeout returns the time limit in seconds applied to a task, falling back
+// to CONTAINER_TIMEOUT for tasks submitted without one
+func (w *Worker) timeout(task *db.Task) int {
+	if task.Timeout > 0 {
+		return task.Timeout
+	}
+	return w.Config.ContainerTimeout
+}
@@ -0,0 +1,312 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"go-deepsandbox/config"
+	"go-deepsandbox/db"
+	"go-deepsandbox/models"
+	"go-deepsandbox/sandbox"
+)
+
+// testWorker is a worker running tasks on a FakeExecutor, with its queue in
+// miniredis and its database in an in-memory SQLite database
+type testWorker struct {
+	*Worker
+	executor *sandbox.FakeExecutor
+	redis    *miniredis.Miniredis
+	dataset  *models.Dataset
+}
+
+// newTestWorker creates a worker with an empty queue and database and one
+// dataset to run tasks against
+func newTestWorker(t *testing.T) *testWorker {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	database, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// Every connection to an in-memory database gets a database of its own
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := database.AutoMigrate(
+		&models.Dataset{},
+		&models.CodeExecution{},
+		&models.ExecutionDataset{},
+		&models.ExecutionArtifact{},
+		&models.Session{},
+		&models.Schedule{},
+		&models.Pipeline{},
+		&models.PipelineStep{},
+		&models.Runtime{},
+	); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	dataset := &models.Dataset{ID: "dataset-1", UserID: "user-1", Filename: "data.csv"}
+	if err := database.Create(dataset).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	executor := sandbox.NewFakeExecutor()
+	cfg := &config.Config{
+		ContainerTimeout: 30,
+		DatasetsDir:      t.TempDir(),
+		ArtifactsDir:     t.TempDir(),
+		TaskLeaseTimeout: 60,
+		TaskMaxRetries:   2,
+	}
+	return &testWorker{
+		Worker: &Worker{
+			ID:        "worker-1",
+			DB:        database,
+			Config:    cfg,
+			TaskQueue: db.NewTaskQueue(client),
+			Sessions:  db.NewSessionQueue(client),
+			Executor:  executor,
+			active:    make(map[string]*activeTask),
+		},
+		executor: executor,
+		redis:    server,
+		dataset:  dataset,
+	}
+}
+
+// submit queues an execution of code the way the API does
+func (w *testWorker) submit(t *testing.T, userID, code string, timeout int) *models.CodeExecution {
+	t.Helper()
+
+	execution := &models.CodeExecution{
+		UserID:    userID,
+		DatasetID: w.dataset.ID,
+		Code:      code,
+		Timeout:   timeout,
+		Datasets:  []models.ExecutionDataset{{Alias: models.PrimaryDatasetAlias, DatasetID: w.dataset.ID}},
+	}
+	if err := db.SubmitExecution(w.DB, w.TaskQueue, execution); err != nil {
+		t.Fatalf("failed to submit execution: %v", err)
+	}
+	return execution
+}
+
+// dequeue takes the next task from the queue
+func (w *testWorker) dequeue(t *testing.T) *db.Task {
+	t.Helper()
+
+	task, err := w.TaskQueue.Dequeue(context.Background(), w.ID, w.leaseTimeout(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dequeue: %v", err)
+	}
+	if task == nil {
+		t.Fatal("no task was queued")
+	}
+	return task
+}
+
+// execution loads an execution from the database
+func (w *testWorker) execution(t *testing.T, id string) *models.CodeExecution {
+	t.Helper()
+
+	var execution models.CodeExecution
+	if err := w.DB.Where("id = ?", id).First(&execution).Error; err != nil {
+		t.Fatalf("failed to load execution %s: %v", id, err)
+	}
+	return &execution
+}
+
+// assertFinished checks that a task ended with status in both the database
+// and its status hash, and was released from the queue
+func (w *testWorker) assertFinished(t *testing.T, id, status string) *models.TaskStatus {
+	t.Helper()
+
+	if execution := w.execution(t, id); execution.Status != status {
+		t.Errorf("execution status = %q (%s), want %q", execution.Status, execution.Error, status)
+	}
+	taskStatus, err := w.TaskQueue.GetTaskStatus(id)
+	if err != nil {
+		t.Fatalf("failed to get task status: %v", err)
+	}
+	if taskStatus.Status != status {
+		t.Errorf("task status = %q, want %q", taskStatus.Status, status)
+	}
+	if pending, _ := w.TaskQueue.IsPending(id, models.PriorityNormal, w.dataset.UserID); pending {
+		t.Error("finished task is still on the processing list or leased")
+	}
+	return taskStatus
+}
+
+func TestProcessCompleted(t *testing.T) {
+	w := newTestWorker(t)
+	execution := w.submit(t, "user-1", "print('hello')", 0)
+
+	w.process(w.dequeue(t))
+
+	status := w.assertFinished(t, execution.ID, models.StatusCompleted)
+	if status.Results == nil || status.Results.Stdout != "print('hello')" {
+		t.Errorf("results = %+v, want the fake executor's output", status.Results)
+	}
+	if got := w.execution(t, execution.ID); got.WorkerID != w.ID || got.StartTime == 0 || got.EndTime < got.StartTime {
+		t.Errorf("execution worker = %q, start = %v, end = %v; want this worker and both times", got.WorkerID, got.StartTime, got.EndTime)
+	}
+
+	jobs := w.executor.Jobs()
+	if len(jobs) != 1 || jobs[0].Timeout != 30*time.Second {
+		t.Errorf("jobs = %+v, want one job with the default timeout", jobs)
+	}
+}
+
+func TestProcessFailed(t *testing.T) {
+	w := newTestWorker(t)
+	w.executor.Handler = func(job *sandbox.Job) (*sandbox.Result, error) {
+		return &sandbox.Result{Stderr: "ZeroDivisionError\n", ExitCode: 1}, nil
+	}
+	execution := w.submit(t, "user-1", "1/0", 0)
+
+	w.process(w.dequeue(t))
+
+	status := w.assertFinished(t, execution.ID, models.StatusFailed)
+	if status.Error != "Process exited with code 1" || status.Results == nil || status.Results.Stderr != "ZeroDivisionError\n" {
+		t.Errorf("status = %q, %+v; want the exit code and the traceback", status.Error, status.Results)
+	}
+}
+
+func TestProcessExecutorError(t *testing.T) {
+	w := newTestWorker(t)
+	w.executor.Handler = func(job *sandbox.Job) (*sandbox.Result, error) {
+		return nil, errors.New("sandbox unavailable")
+	}
+	execution := w.submit(t, "user-1", "print(1)", 0)
+
+	w.process(w.dequeue(t))
+
+	if status := w.assertFinished(t, execution.ID, models.StatusFailed); status.Error != "sandbox unavailable" {
+		t.Errorf("error = %q, want the executor's error", status.Error)
+	}
+}
+
+func TestProcessTimedOut(t *testing.T) {
+	w := newTestWorker(t)
+	w.executor.Delay = 5 * time.Second
+	execution := w.submit(t, "user-1", "while True: pass", 1)
+
+	started := time.Now()
+	w.process(w.dequeue(t))
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("task ran for %v, want it stopped after its 1 second timeout", elapsed)
+	}
+
+	if status := w.assertFinished(t, execution.ID, models.StatusTimedOut); status.Error != "Execution timed out after 1 seconds" {
+		t.Errorf("error = %q", status.Error)
+	}
+}
+
+func TestProcessCancelledBeforeStart(t *testing.T) {
+	w := newTestWorker(t)
+	execution := w.submit(t, "user-1", "print(1)", 0)
+	task := w.dequeue(t)
+
+	outcome, err := w.TaskQueue.CancelTask(task.ID, "user-1")
+	if err != nil || outcome != db.CancelPending {
+		t.Fatalf("CancelTask = %q, %v; want %q", outcome, err, db.CancelPending)
+	}
+	w.process(task)
+
+	if status := w.assertFinished(t, execution.ID, models.StatusCancelled); status.Error != "Cancelled by user-1" {
+		t.Errorf("error = %q", status.Error)
+	}
+	if jobs := w.executor.Jobs(); len(jobs) != 0 {
+		t.Errorf("executor ran %d jobs, want none", len(jobs))
+	}
+}
+
+// watchCancels relays cancel requests sent to the worker until the test ends
+func (w *testWorker) watchCancels(t *testing.T) {
+	t.Helper()
+
+	pubsub, err := w.TaskQueue.SubscribeCancelRequests(context.Background(), w.ID)
+	if err != nil {
+		t.Fatalf("failed to subscribe to cancel requests: %v", err)
+	}
+	t.Cleanup(func() { pubsub.Close() })
+	go w.Worker.watchCancels(pubsub)
+}
+
+// waitForStatus waits until a task's status hash reports status
+func (w *testWorker) waitForStatus(t *testing.T, id, status string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if taskStatus, err := w.TaskQueue.GetTaskStatus(id); err == nil && taskStatus.Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("task %s never became %s", id, status)
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	w := newTestWorker(t)
+	w.watchCancels(t)
+	w.executor.Delay = time.Minute
+	execution := w.submit(t, "user-1", "while True: pass", 0)
+	task := w.dequeue(t)
+
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		w.process(task)
+	}()
+	w.waitForStatus(t, task.ID, models.StatusRunning)
+
+	outcome, err := w.TaskQueue.CancelTask(task.ID, "admin")
+	if err != nil || outcome != db.CancelSignaled {
+		t.Fatalf("CancelTask = %q, %v; want %q", outcome, err, db.CancelSignaled)
+	}
+	select {
+	case <-processed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the running task was not stopped")
+	}
+
+	if status := w.assertFinished(t, execution.ID, models.StatusCancelled); status.Error != "Cancelled by admin" {
+		t.Errorf("error = %q", status.Error)
+	}
+}
+
+func TestCancelQueuedTask(t *testing.T) {
+	w := newTestWorker(t)
+	execution := w.submit(t, "user-1", "print(1)", 0)
+
+	outcome, err := w.TaskQueue.CancelTask(execution.ID, "user-1")
+	if err != nil || outcome != db.CancelRemoved {
+		t.Fatalf("CancelTask = %q, %v; want %q", outcome, err, db.CancelRemoved)
+	}
+	task, err := w.TaskQueue.Dequeue(context.Background(), w.ID, w.leaseTimeout(), time.Second)
+	if err != nil || task != nil {
+		t.Errorf("Dequeue = %v, %v; want the cancelled task gone from the queue", task, err)
+	}
+
+	status, err := w.TaskQueue.GetTaskStatus(execution.ID)
+	if err != nil || status.Status != models.StatusCancelled {
+		t.Errorf("task status = %+v, %v; want cancelled", status, err)
+	}
+}